@@ -0,0 +1,263 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	localSetup "ganesh.provengo.io/internal/setup"
+	localStructs "ganesh.provengo.io/internal/structs"
+	localMetrics "ganesh.provengo.io/pkg/metrics"
+	localPublisher "ganesh.provengo.io/pkg/publisher"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"github.com/nats-io/nats.go"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Longest NDJSON line accepted by /send-users.
+const maxBulkLine = 1 << 20
+
+// Room given to each record when a signed /send-users body is buffered to
+// be hashed, a DataLogin line takes a few hundred bytes.
+const bulkRecordBudget = 4 << 10
+
+// BulkMaxBody returns the largest signed /send-users body: max_records
+// records of bulkRecordBudget bytes.
+func BulkMaxBody(cfg localSetup.Bulk) int64 {
+	return int64(cfg.MaxRecords) * bulkRecordBudget
+}
+
+const (
+	BulkAccepted = "accepted"
+	BulkRejected = "rejected"
+	BulkFailed   = "failed"
+)
+
+// BulkResult reports one record of /send-users. Line is the line number for
+// NDJSON and the position in the array for JSON arrays, both starting at 1.
+type BulkResult struct {
+	Line      int    `json:"line"`
+	Status    string `json:"status"`
+	UUID      string `json:"uuid,omitempty"`
+	MessageID string `json:"message_id,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+type BulkResponse struct {
+	Accepted int          `json:"accepted"`
+	Rejected int          `json:"rejected"`
+	Failed   int          `json:"failed"`
+	Error    string       `json:"error,omitempty"`
+	Results  []BulkResult `json:"results"`
+}
+
+// recordReader returns the raw records of a bulk body one by one and io.EOF
+// after the last one.
+type recordReader interface {
+	next() (line int, raw []byte, err error)
+}
+
+type ndjsonReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func (r *ndjsonReader) next() (int, []byte, error) {
+	for r.scanner.Scan() {
+		r.line++
+		if raw := r.scanner.Bytes(); len(bytes.TrimSpace(raw)) > 0 {
+			return r.line, raw, nil
+		}
+	}
+	if err := r.scanner.Err(); err != nil {
+		return r.line + 1, nil, fmt.Errorf("line %d: %w", r.line+1, err)
+	}
+	return r.line, nil, io.EOF
+}
+
+type arrayReader struct {
+	decoder *json.Decoder
+	index   int
+	started bool
+}
+
+func (r *arrayReader) next() (int, []byte, error) {
+	if !r.started {
+		r.started = true
+		if token, err := r.decoder.Token(); err != nil || token != json.Delim('[') {
+			return 0, nil, errors.New("body is not a JSON array")
+		}
+	}
+	if !r.decoder.More() {
+		if _, err := r.decoder.Token(); err != nil {
+			return r.index + 1, nil, fmt.Errorf("element %d: %w", r.index+1, err)
+		}
+		return r.index, nil, io.EOF
+	}
+
+	r.index++
+	var raw json.RawMessage
+	if err := r.decoder.Decode(&raw); err != nil {
+		return r.index, nil, fmt.Errorf("element %d: %w", r.index, err)
+	}
+	return r.index, raw, nil
+}
+
+// newRecordReader picks the format from the Content-Type, sniffing the first
+// byte for application/json so a single object works like one NDJSON line.
+func newRecordReader(contentType string, body io.Reader) (recordReader, error) {
+	buffered := bufio.NewReaderSize(body, 64*1024)
+
+	switch contentType {
+	case "application/x-ndjson", "application/jsonl", "application/x-jsonlines", "":
+	case "application/json":
+		for {
+			b, err := buffered.Peek(1)
+			if err != nil {
+				break
+			}
+			if b[0] == ' ' || b[0] == '\t' || b[0] == '\r' || b[0] == '\n' {
+				_, _ = buffered.ReadByte()
+				continue
+			}
+			if b[0] == '[' {
+				return &arrayReader{decoder: json.NewDecoder(buffered)}, nil
+			}
+			break
+		}
+	default:
+		return nil, fmt.Errorf("unsupported content type %q, use application/x-ndjson or application/json", contentType)
+	}
+
+	scanner := bufio.NewScanner(buffered)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBulkLine)
+	return &ndjsonReader{scanner: scanner}, nil
+}
+
+// validationReason turns binding errors into "Password: required, UUID: required".
+func validationReason(err error) string {
+	var fields validator.ValidationErrors
+	if !errors.As(err, &fields) {
+		return err.Error()
+	}
+	reasons := make([]string, len(fields))
+	for i, field := range fields {
+		reasons[i] = field.Field() + ": " + field.Tag()
+	}
+	return strings.Join(reasons, ", ")
+}
+
+type bulkRecord struct {
+	result int
+	data   localStructs.DataLogin
+}
+
+// SendUsers publishes NDJSON or a JSON array of users in chunks and reports
+// the outcome of every record. Invalid records are rejected without
+// stopping the others.
+func SendUsers(publisher *localPublisher.Publisher, queueName string, cfg localSetup.Bulk) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		reader, err := newRecordReader(c.ContentType(), c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+			return
+		}
+
+		response := BulkResponse{Results: []BulkResult{}}
+		chunk := make([]bulkRecord, 0, cfg.ChunkSize)
+		unavailable := 0
+
+		flush := func() {
+			if len(chunk) == 0 {
+				return
+			}
+			msgs := make([]*nats.Msg, len(chunk))
+			for i, record := range chunk {
+				// DataLogin encodes with every codec, the error cannot happen.
+				msgs[i], _ = publisher.NewMsg(fmt.Sprintf("%s.%s", queueName, record.data.UUID), &record.data)
+			}
+			for i, published := range publisher.PublishMany(c.Request.Context(), msgs) {
+				result := &response.Results[chunk[i].result]
+				result.MessageID = published.Ack.MessageID
+				if published.Err != nil {
+					result.Status = BulkFailed
+					result.Reason = published.Err.Error()
+					if errors.Is(published.Err, localPublisher.ErrUnavailable) {
+						unavailable++
+					}
+					response.Failed++
+					continue
+				}
+				result.Status = BulkAccepted
+				response.Accepted++
+			}
+			chunk = chunk[:0]
+		}
+
+		reject := func(line int, uuid string, reason string) {
+			response.Results = append(response.Results, BulkResult{Line: line, Status: BulkRejected, UUID: uuid, Reason: reason})
+			response.Rejected++
+		}
+
+		records := 0
+		for {
+			line, raw, err := reader.next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				response.Error = err.Error()
+				break
+			}
+			if records++; records > cfg.MaxRecords {
+				response.Error = fmt.Sprintf("more than %d records, line %d and the following were ignored", cfg.MaxRecords, line)
+				break
+			}
+
+			localMetrics.MessagesReceived.WithLabelValues(component).Inc()
+			var data localStructs.DataLogin
+			if err := json.Unmarshal(raw, &data); err != nil {
+				localMetrics.MessagesFailed.WithLabelValues(component, "decode").Inc()
+				reject(line, "", err.Error())
+				continue
+			}
+			// The record decoded, a missing field makes it invalid.
+			if err := binding.Validator.ValidateStruct(&data); err != nil {
+				localMetrics.MessagesFailed.WithLabelValues(component, "invalid").Inc()
+				reject(line, data.UUID, validationReason(err))
+				continue
+			}
+			if err := data.Validate(); err != nil {
+				localMetrics.MessagesFailed.WithLabelValues(component, "invalid").Inc()
+				reject(line, data.UUID, err.Error())
+				continue
+			}
+			localMetrics.MessagesDecoded.WithLabelValues(component).Inc()
+
+			response.Results = append(response.Results, BulkResult{Line: line, UUID: data.UUID})
+			chunk = append(chunk, bulkRecord{result: len(response.Results) - 1, data: data})
+			if len(chunk) >= cfg.ChunkSize {
+				flush()
+			}
+		}
+		flush()
+
+		status := http.StatusAccepted
+		switch {
+		case response.Accepted > 0:
+		case unavailable > 0:
+			c.Header("Retry-After", "1")
+			status = http.StatusServiceUnavailable
+		case response.Failed > 0:
+			status = http.StatusInternalServerError
+		default:
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, response)
+	}
+}
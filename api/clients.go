@@ -0,0 +1,69 @@
+package api
+
+import (
+	"errors"
+	localClients "ganesh.provengo.io/pkg/clients"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+type ClientsResponse struct {
+	Online  int                   `json:"online"`
+	Stale   int                   `json:"stale"`
+	Offline int                   `json:"offline"`
+	Clients []localClients.Client `json:"clients"`
+}
+
+// Clients lists the clients seen within the retention, most recent first.
+// ?status=online|stale|offline keeps only the clients in that status, the
+// counters always cover every client.
+func Clients(registry *localClients.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter := c.Query("status")
+		switch filter {
+		case "", localClients.StatusOnline, localClients.StatusStale, localClients.StatusOffline:
+		default:
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "status must be online, stale or offline"})
+			return
+		}
+
+		clients, err := registry.List(c.Request.Context())
+		if err != nil {
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+			return
+		}
+
+		response := ClientsResponse{Clients: []localClients.Client{}}
+		for _, client := range clients {
+			switch client.Status {
+			case localClients.StatusOnline:
+				response.Online++
+			case localClients.StatusStale:
+				response.Stale++
+			default:
+				response.Offline++
+			}
+			if filter == "" || filter == client.Status {
+				response.Clients = append(response.Clients, client)
+			}
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func Client(registry *localClients.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client, err := registry.Get(c.Request.Context(), c.Param("id"))
+		if errors.Is(err, localClients.ErrNotFound) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, client)
+	}
+}
@@ -1,21 +1,53 @@
 package api
 
 import (
+	"errors"
+	"fmt"
 	localStructs "ganesh.provengo.io/internal/structs"
+	localClients "ganesh.provengo.io/pkg/clients"
+	localLogging "ganesh.provengo.io/pkg/logging"
+	localMetrics "ganesh.provengo.io/pkg/metrics"
+	localPublisher "ganesh.provengo.io/pkg/publisher"
 	"ganesh.provengo.io/pkg/responses/keepalive"
 	"github.com/gin-gonic/gin"
+	"log/slog"
 	"net/http"
 )
 
+const component = "http"
+
+type SendUserResponse struct {
+	Status string `json:"status"`
+	UUID   string `json:"uuid"`
+	localPublisher.Ack
+}
+
 func Ping() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.JSON(200, gin.H{"status": "pong"})
 	}
 }
 
-func KeepAlive() gin.HandlerFunc {
+// KeepAlive records the call as a heartbeat of the client. When the
+// heartbeat cannot be stored it answers 503 so the client retries.
+func KeepAlive(registry *localClients.Registry) gin.HandlerFunc {
+	logger := localLogging.Component(component)
 	return func(c *gin.Context) {
-		c.JSON(200, keepalive.GetKeepAlive(c))
+		response := keepalive.GetKeepAlive(c)
+		err := registry.Record(c.Request.Context(), localStructs.Heartbeat{
+			ClientID:  response.ClientID,
+			IP:        response.ClientIP,
+			UserAgent: response.ClientUserAgent,
+			Protocol:  response.ClientVersion,
+			LastSeen:  response.Timestamp,
+		})
+		if err != nil {
+			logger.Warn("error recording heartbeat", "client_id", response.ClientID, "error", err)
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, response)
 	}
 }
 
@@ -25,15 +57,49 @@ func Default() gin.HandlerFunc {
 	}
 }
 
-func SendUser(channel chan localStructs.DataLogin) gin.HandlerFunc {
+// SendUser publishes the user to QueueName.<uuid>, the subject the producer
+// uses, and answers 202 once NATS (or JetStream, when acks are enabled) took
+// it. A broker that cannot be reached answers 503 so the client retries.
+func SendUser(publisher *localPublisher.Publisher, queueName string) gin.HandlerFunc {
+	logger := localLogging.Component(component)
 	return func(c *gin.Context) {
+		localMetrics.MessagesReceived.WithLabelValues(component).Inc()
 		data := localStructs.DataLogin{}
 		err := c.BindJSON(&data)
 		if err != nil {
+			localMetrics.MessagesFailed.WithLabelValues(component, "decode").Inc()
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		// The consumer would reject it, the client gets to know now.
+		if err := data.Validate(); err != nil {
+			localMetrics.MessagesFailed.WithLabelValues(component, "invalid").Inc()
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		} else {
-			channel <- data
-			c.JSON(200, gin.H{"status": "ok"})
+			return
+		}
+		localMetrics.MessagesDecoded.WithLabelValues(component).Inc()
+
+		msg, err := publisher.NewMsg(fmt.Sprintf("%s.%s", queueName, data.UUID), &data)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		ack, err := publisher.PublishMsg(c.Request.Context(), msg)
+		if err != nil {
+			localLogging.Message(logger, data).Warn("error publishing user", "error", err)
+			if errors.Is(err, localPublisher.ErrUnavailable) {
+				c.Header("Retry-After", "1")
+				c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if logger.Enabled(c.Request.Context(), slog.LevelDebug) {
+			localLogging.Message(logger, data).Debug("user published", "message_id", ack.MessageID, "subject", ack.Subject)
 		}
+		c.JSON(http.StatusAccepted, SendUserResponse{Status: "accepted", UUID: data.UUID, Ack: ack})
 	}
 }
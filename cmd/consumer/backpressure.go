@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	localSetup "ganesh.provengo.io/internal/setup"
+	"ganesh.provengo.io/pkg/codec"
+	localLogging "ganesh.provengo.io/pkg/logging"
+	localMetrics "ganesh.provengo.io/pkg/metrics"
+	"ganesh.provengo.io/pkg/partition"
+	"github.com/nats-io/nats.go"
+)
+
+// Saturation is logged at most once per interval and queue, with the count
+// since the previous line.
+const saturationLogInterval = 10 * time.Second
+
+var errDropped = errors.New("sink queue full, message dropped")
+
+// saturation logs the pushes finding a queue full.
+type saturation struct {
+	queue  string
+	policy string
+	logger *slog.Logger
+	count  atomic.Int64
+	last   atomic.Int64
+}
+
+func (s *saturation) full(partition int) {
+	localMetrics.ChannelSaturated.WithLabelValues(s.queue).Inc()
+	count := s.count.Add(1)
+	now := time.Now().UnixNano()
+	last := s.last.Load()
+	if now-last < int64(saturationLogInterval) || !s.last.CompareAndSwap(last, now) {
+		return
+	}
+	s.count.Add(-count)
+	s.logger.Warn("sink queue saturated", "queue", s.queue, "partition", partition, "policy", s.policy, "full_pushes", count)
+}
+
+// newSinkQueue returns the queue of a sink with its buffer and policy. acks
+// tells whether the sink confirms the delivery of its jobs, a job it never
+// gets is then failed so that JetStream redelivers it or it goes to the
+// dead-letter subject.
+func newSinkQueue(cfg *localSetup.Config, name string, sink localSetup.SinkQueue, acks bool) (*partition.Queue[Job], error) {
+	logger := localLogging.Component("backpressure").With("queue", name)
+	lost := func(job Job, err error) {
+		localLogging.Message(logger, job.Data).Debug("message not delivered to sink", "error", err)
+		if acks {
+			job.Done(fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	sat := &saturation{queue: name, policy: sink.Policy, logger: logger}
+
+	queue, err := partition.New(partition.Options[Job]{
+		Partitions: cfg.Consumer.Ordering.Partitions,
+		Size:       sink.Buffer,
+		Key:        orderingKey(cfg.Consumer.Ordering.Key),
+		Policy:     partition.Policy(sink.Policy),
+		OnFull:     sat.full,
+		OnDrop: func(job Job) {
+			localMetrics.MessagesDropped.WithLabelValues(name).Inc()
+			lost(job, errDropped)
+		},
+		// The user goes to disk, the delivery and trace context stay in
+		// memory.
+		Spill: partition.Spill[Job]{
+			Dir:  cfg.Consumer.Backpressure.SpillDir,
+			Name: name,
+			Detach: func(job Job) ([]byte, Job) {
+				data, _ := codec.JSON.Marshal(job.Data)
+				return data, Job{ctx: job.ctx, delivery: job.delivery, span: job.span}
+			},
+			Attach: func(data []byte, job Job) (Job, error) {
+				err := codec.JSON.Unmarshal(data, &job.Data)
+				return job, err
+			},
+			OnError: func(job Job, err error) {
+				logger.Error("error spilling message", "error", err)
+				if job.delivery != nil {
+					lost(job, err)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s queue: %w", name, err)
+	}
+	localMetrics.RegisterChannelDepth(name, queue.Len)
+	if sink.Policy == string(partition.SpillToDisk) {
+		localMetrics.RegisterChannelSpilled(name, queue.Spilled)
+	}
+	return queue, nil
+}
+
+// subscriptions tracks the core NATS subscriptions for their drop count.
+type subscriptions struct {
+	mu      sync.Mutex
+	subs    []*nats.Subscription
+	dropped map[*nats.Subscription]int
+}
+
+func (s *subscriptions) add(sub *nats.Subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subs = append(s.subs, sub)
+}
+
+// Dropped returns the messages dropped by every subscription, the last
+// count of the closed ones included.
+func (s *subscriptions) Dropped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dropped == nil {
+		s.dropped = map[*nats.Subscription]int{}
+	}
+	total := 0
+	for _, sub := range s.subs {
+		if dropped, err := sub.Dropped(); err == nil {
+			s.dropped[sub] = dropped
+		}
+		total += s.dropped[sub]
+	}
+	return total
+}
+
+var natsSubscriptions = &subscriptions{}
+
+// slowConsumerHandler reports the asynchronous NATS errors, slow consumers
+// first: the subscription buffered pending_msgs or pending_bytes and drops
+// what comes next until the callbacks catch up.
+func slowConsumerHandler(logger *slog.Logger) nats.ErrHandler {
+	return func(_ *nats.Conn, sub *nats.Subscription, err error) {
+		if !errors.Is(err, nats.ErrSlowConsumer) {
+			logger.Error("asynchronous NATS error", "error", err)
+			return
+		}
+		localMetrics.SlowConsumers.WithLabelValues(component).Inc()
+		if sub == nil {
+			logger.Warn("NATS slow consumer", "error", err)
+			return
+		}
+		pending, bytes, _ := sub.Pending()
+		dropped, _ := sub.Dropped()
+		logger.Warn("NATS slow consumer, messages are dropped", "subject", sub.Subject, "pending", pending, "pending_bytes", bytes, "dropped", dropped)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	localSetup "ganesh.provengo.io/internal/setup"
+	localLogging "ganesh.provengo.io/pkg/logging"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderDeadLetterError    = "Ganesh-Dlq-Error"
+	HeaderDeadLetterAttempts = "Ganesh-Dlq-Attempts"
+	HeaderDeadLetterOrigin   = "Ganesh-Dlq-Origin-Subject"
+	HeaderDeadLetterFailedAt = "Ganesh-Dlq-Failed-At"
+)
+
+var deadLetterHeaders = []string{
+	HeaderDeadLetterError,
+	HeaderDeadLetterAttempts,
+	HeaderDeadLetterOrigin,
+	HeaderDeadLetterFailedAt,
+}
+
+// copyHeader copies the headers of src but the Nats-Msg-Id set by the
+// publisher: JetStream would drop a second dead-letter or a replay of the
+// same message within its duplicate window as a duplicate.
+func copyHeader(dst nats.Header, src nats.Header) {
+	for key, values := range src {
+		if key == jetstream.MsgIDHeader {
+			continue
+		}
+		for _, value := range values {
+			dst.Add(key, value)
+		}
+	}
+}
+
+// ensureDeadLetterStream makes sure dead-letter messages are retained for
+// replay. Without JetStream they are still published but nothing keeps them.
+func ensureDeadLetterStream(ctx context.Context, cfg *localSetup.Config, nc *nats.Conn) (jetstream.Stream, error) {
+	dlq := cfg.Consumer.DeadLetter
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, fmt.Errorf("error creating jetstream context: %w", err)
+	}
+
+	stream, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     dlq.Stream,
+		Subjects: []string{dlq.Subject},
+		Storage:  jetstream.FileStorage,
+		MaxAge:   dlq.MaxAge.Duration,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error provisioning dead-letter stream %s: %w", dlq.Stream, err)
+	}
+	return stream, nil
+}
+
+// deadLetter publishes the original payload to the dead-letter subject with
+// the failure details in the headers.
+func deadLetter(nc *nats.Conn, cfg *localSetup.Config, logger *slog.Logger, origin string, header nats.Header, data []byte, attempts uint64, cause error) {
+	msg := nats.NewMsg(cfg.Consumer.DeadLetter.Subject)
+	copyHeader(msg.Header, header)
+	msg.Header.Set(HeaderDeadLetterError, cause.Error())
+	msg.Header.Set(HeaderDeadLetterAttempts, strconv.FormatUint(attempts, 10))
+	msg.Header.Set(HeaderDeadLetterOrigin, origin)
+	msg.Header.Set(HeaderDeadLetterFailedAt, time.Now().UTC().Format(time.RFC3339Nano))
+	msg.Data = data
+
+	if err := nc.PublishMsg(msg); err != nil {
+		logger.Error("error publishing to dead-letter subject, message lost", "dlq_subject", msg.Subject, "origin", origin, "error", err)
+		return
+	}
+	logger.Warn("message sent to dead-letter subject", "origin", origin, "attempts", attempts, "error", cause)
+}
+
+type replayFilter struct {
+	sequences     map[uint64]bool
+	fromSeq       uint64
+	toSeq         uint64
+	origin        string
+	errorContains string
+}
+
+func (f replayFilter) match(msg *jetstream.RawStreamMsg) bool {
+	if len(f.sequences) > 0 && !f.sequences[msg.Sequence] {
+		return false
+	}
+	if msg.Sequence < f.fromSeq || (f.toSeq > 0 && msg.Sequence > f.toSeq) {
+		return false
+	}
+	if f.origin != "" && msg.Header.Get(HeaderDeadLetterOrigin) != f.origin {
+		return false
+	}
+	if f.errorContains != "" && !strings.Contains(msg.Header.Get(HeaderDeadLetterError), f.errorContains) {
+		return false
+	}
+	return true
+}
+
+func parseSequences(value string) (map[uint64]bool, error) {
+	sequences := map[uint64]bool{}
+	if value == "" {
+		return sequences, nil
+	}
+	for _, item := range strings.Split(value, ",") {
+		seq, err := strconv.ParseUint(strings.TrimSpace(item), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sequence %q", item)
+		}
+		sequences[seq] = true
+	}
+	return sequences, nil
+}
+
+// replayDeadLetters re-publishes the selected dead-letter messages to their
+// origin subject, stripping the dead-letter headers.
+func replayDeadLetters(args []string) error {
+	fs := flag.NewFlagSet("dlq replay", flag.ExitOnError)
+	seqList := fs.String("seq", "", "comma separated dead-letter sequences to replay")
+	fromSeq := fs.Uint64("from-seq", 0, "first dead-letter sequence to replay")
+	toSeq := fs.Uint64("to-seq", 0, "last dead-letter sequence to replay, 0 for the end of the stream")
+	origin := fs.String("origin", "", "only replay messages originally published on this subject")
+	errorContains := fs.String("error-contains", "", "only replay messages whose error contains this text")
+	purge := fs.Bool("purge", false, "delete replayed messages from the dead-letter stream")
+	dryRun := fs.Bool("dry-run", false, "list the selected messages without publishing them")
+
+	cfg, err := localSetup.Load(localSetup.BinaryConsumer, fs, args)
+	if err != nil {
+		return err
+	}
+	logger := localLogging.Init(cfg.Logging, "ganesh-consumer-dlq")
+
+	sequences, err := parseSequences(*seqList)
+	if err != nil {
+		return err
+	}
+	filter := replayFilter{
+		sequences:     sequences,
+		fromSeq:       *fromSeq,
+		toSeq:         *toSeq,
+		origin:        *origin,
+		errorContains: *errorContains,
+	}
+
+	nc, err := nats.Connect(cfg.Nats.URL)
+	if err != nil {
+		return fmt.Errorf("error connecting to NATS: %w", err)
+	}
+	defer nc.Close()
+
+	ctx := context.Background()
+	stream, err := ensureDeadLetterStream(ctx, cfg, nc)
+	if err != nil {
+		return err
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return fmt.Errorf("error creating jetstream context: %w", err)
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		return fmt.Errorf("error reading dead-letter stream: %w", err)
+	}
+
+	replayed := 0
+	for seq := info.State.FirstSeq; seq <= info.State.LastSeq && info.State.Msgs > 0; seq++ {
+		if filter.toSeq > 0 && seq > filter.toSeq {
+			break
+		}
+		msg, err := stream.GetMsg(ctx, seq)
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error reading dead-letter message %d: %w", seq, err)
+		}
+		if !filter.match(msg) {
+			continue
+		}
+
+		subject := msg.Header.Get(HeaderDeadLetterOrigin)
+		if subject == "" {
+			logger.Warn("missing origin header, skipping", "seq", seq, "header", HeaderDeadLetterOrigin)
+			continue
+		}
+
+		logger.Info("replaying dead-letter message", "seq", seq, "subject", subject, "attempts", msg.Header.Get(HeaderDeadLetterAttempts), "error", msg.Header.Get(HeaderDeadLetterError), "dry_run", *dryRun)
+		if *dryRun {
+			continue
+		}
+
+		out := nats.NewMsg(subject)
+		copyHeader(out.Header, msg.Header)
+		for _, key := range deadLetterHeaders {
+			out.Header.Del(key)
+		}
+		out.Data = msg.Data
+		if err := publishReplay(ctx, cfg, nc, js, out); err != nil {
+			return fmt.Errorf("error replaying dead-letter message %d: %w", seq, err)
+		}
+		replayed++
+
+		if *purge {
+			if err := stream.DeleteMsg(ctx, seq); err != nil {
+				logger.Error("error deleting from dead-letter stream", "seq", seq, "error", err)
+			}
+		}
+	}
+
+	if err := nc.Flush(); err != nil {
+		return err
+	}
+	logger.Info("dead-letter messages replayed", "replayed", replayed)
+	return nil
+}
+
+// publishReplay waits for the stream to store the message in jetstream mode,
+// so that a replay rejected by JetStream is reported. The core modes have no
+// stream on the origin subject and nothing to acknowledge the publish.
+func publishReplay(ctx context.Context, cfg *localSetup.Config, nc *nats.Conn, js jetstream.JetStream, msg *nats.Msg) error {
+	if cfg.Consumer.Type != "jetstream" {
+		return nc.PublishMsg(msg)
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.Nats.Publisher.AckTimeout.Duration)
+	defer cancel()
+	ack, err := js.PublishMsg(ctx, msg)
+	if err != nil {
+		return err
+	}
+	if ack.Duplicate {
+		return fmt.Errorf("dropped by stream %s as a duplicate", ack.Stream)
+	}
+	return nil
+}
+
+func runDeadLetterCommand(args []string) {
+	if len(args) == 0 || args[0] != "replay" {
+		fmt.Fprintln(os.Stderr, "usage: consumer dlq replay [-seq 1,2] [-from-seq N] [-to-seq M] [-origin subject] [-error-contains text] [-purge] [-dry-run]")
+		os.Exit(2)
+	}
+	if err := replayDeadLetters(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "dlq replay: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	localSetup "ganesh.provengo.io/internal/setup"
+	localLogging "ganesh.provengo.io/pkg/logging"
+	localRedis "ganesh.provengo.io/pkg/redis"
+)
+
+// Values of the idempotency keys. A UUID is claimed as processing when its
+// message is received and marked done once every sink stored it.
+const (
+	claimProcessing = "processing"
+	claimDone       = "done"
+)
+
+type claim int
+
+const (
+	// claimed: the message is processed by this consumer.
+	claimed claim = iota
+	// duplicate: the UUID was processed within the window, the message is
+	// skipped.
+	duplicate
+	// inFlight: another delivery of the UUID is being processed.
+	inFlight
+)
+
+// Deduper skips the redeliveries of messages already processed, keyed by
+// DataLogin.UUID. A claim expires after claimTTL so that a consumer dying
+// mid-message does not hide the JetStream redelivery, which comes after
+// ack_wait. Redis errors never block a message: Postgres ignores the UUIDs
+// it already stored, so the worst case is a repeated Redis write.
+type Deduper struct {
+	conn     *localRedis.RedisService
+	breaker  *localRedis.Breaker
+	prefix   string
+	window   time.Duration
+	claimTTL time.Duration
+	logger   *slog.Logger
+}
+
+// newDeduper returns nil when the window is 0, every method of a nil
+// Deduper claims the message. It has its own breaker, an idempotency check
+// failing must not hold the Redis sink back.
+func newDeduper(ctx context.Context, cfg *localSetup.Config) *Deduper {
+	idempotency := cfg.Consumer.Idempotency
+	if idempotency.Window.Duration == 0 {
+		return nil
+	}
+	logger := localLogging.Component("idempotency")
+	conn, err := localRedis.RedisConnection(ctx, cfg.Redis)
+	if err != nil {
+		localLogging.Fatal(logger, "error connecting to Redis", "error", err)
+	}
+	return &Deduper{
+		conn:     conn,
+		breaker:  localRedis.NewBreaker(cfg.Redis.Breaker.Threshold, cfg.Redis.Breaker.Cooldown.Duration),
+		prefix:   idempotency.KeyPrefix,
+		window:   idempotency.Window.Duration,
+		claimTTL: min(cfg.Consumer.JetStream.AckWait.Duration, idempotency.Window.Duration),
+		logger:   logger,
+	}
+}
+
+func (d *Deduper) key(uuid string) string {
+	return d.prefix + uuid
+}
+
+// Claim records uuid as processing unless it is known already.
+func (d *Deduper) Claim(ctx context.Context, uuid string) claim {
+	if d == nil || d.breaker.Allow() != nil {
+		return claimed
+	}
+	ok, err := d.conn.SetNX(ctx, localRedis.RedisData{Key: d.key(uuid), Value: claimProcessing, TTL: d.claimTTL})
+	if err != nil {
+		d.failed("claim", uuid, err)
+		return claimed
+	}
+	d.breaker.Success()
+	if ok {
+		return claimed
+	}
+
+	state, err := d.conn.Get(ctx, localRedis.RedisData{Key: d.key(uuid)})
+	switch {
+	case localRedis.IsMissing(err):
+		// Expired between the two calls, the next delivery will claim it.
+		return inFlight
+	case err != nil:
+		d.failed("claim", uuid, err)
+		return claimed
+	case state == claimDone:
+		return duplicate
+	default:
+		return inFlight
+	}
+}
+
+// Release marks uuid as done for the window when it was processed, or
+// forgets it so that its redelivery is processed again.
+func (d *Deduper) Release(uuid string, err error) {
+	if d == nil || d.breaker.Allow() != nil {
+		return
+	}
+	// The sinks may be cancelled on shutdown, the release must still happen.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	data := localRedis.RedisData{Key: d.key(uuid), Value: claimDone, TTL: d.window}
+	if err != nil {
+		err = d.conn.Del(ctx, data)
+	} else {
+		err = d.conn.Set(ctx, data)
+	}
+	if err != nil {
+		d.failed("release", uuid, err)
+		return
+	}
+	d.breaker.Success()
+}
+
+func (d *Deduper) failed(operation string, uuid string, err error) {
+	d.breaker.Failure()
+	d.logger.Warn("error updating idempotency key, the message is processed regardless", "operation", operation, "uuid", uuid, "error", err)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	localSetup "ganesh.provengo.io/internal/setup"
+	"github.com/alicebob/miniredis/v2"
+)
+
+// The Redis client is a process wide singleton, every test shares one
+// miniredis and flushes it first.
+var testRedis *miniredis.Miniredis
+
+func deduper(t *testing.T) (*Deduper, *miniredis.Miniredis) {
+	t.Helper()
+	if testRedis == nil {
+		mr, err := miniredis.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		testRedis = mr
+	}
+	testRedis.FlushAll()
+
+	cfg := localSetup.Default()
+	cfg.Redis.URL = "redis://" + testRedis.Addr()
+	cfg.Consumer.Idempotency.Window.Duration = time.Hour
+	cfg.Consumer.JetStream.AckWait.Duration = 30 * time.Second
+	return newDeduper(context.Background(), cfg), testRedis
+}
+
+func TestDeduperProcessedIsDuplicate(t *testing.T) {
+	d, mr := deduper(t)
+	ctx := context.Background()
+	key := d.key("u1")
+
+	if got := d.Claim(ctx, "u1"); got != claimed {
+		t.Fatalf("first claim = %d, want claimed", got)
+	}
+	if state, _ := mr.Get(key); state != claimProcessing || mr.TTL(key) != 30*time.Second {
+		t.Fatalf("claim stored %q for %s, want %q for ack_wait", state, mr.TTL(key), claimProcessing)
+	}
+	if got := d.Claim(ctx, "u1"); got != inFlight {
+		t.Fatalf("claim while processing = %d, want inFlight", got)
+	}
+
+	d.Release("u1", nil)
+	if state, _ := mr.Get(key); state != claimDone || mr.TTL(key) != time.Hour {
+		t.Fatalf("release stored %q for %s, want %q for the window", state, mr.TTL(key), claimDone)
+	}
+	if got := d.Claim(ctx, "u1"); got != duplicate {
+		t.Fatalf("claim after release = %d, want duplicate", got)
+	}
+
+	mr.FastForward(time.Hour + time.Second)
+	if got := d.Claim(ctx, "u1"); got != claimed {
+		t.Fatalf("claim after the window = %d, want claimed", got)
+	}
+}
+
+func TestDeduperFailedIsClaimableAgain(t *testing.T) {
+	d, mr := deduper(t)
+	ctx := context.Background()
+
+	if got := d.Claim(ctx, "u2"); got != claimed {
+		t.Fatalf("first claim = %d, want claimed", got)
+	}
+	d.Release("u2", errors.New("postgres: connection refused"))
+	if mr.Exists(d.key("u2")) {
+		t.Fatal("failed message still claimed")
+	}
+	if got := d.Claim(ctx, "u2"); got != claimed {
+		t.Fatalf("claim of the redelivery = %d, want claimed", got)
+	}
+}
+
+func TestDeduperClaimExpires(t *testing.T) {
+	d, mr := deduper(t)
+	ctx := context.Background()
+
+	// A consumer died mid-message: the redelivery after ack_wait is claimed.
+	d.Claim(ctx, "u3")
+	mr.FastForward(31 * time.Second)
+	if got := d.Claim(ctx, "u3"); got != claimed {
+		t.Fatalf("claim after ack_wait = %d, want claimed", got)
+	}
+}
+
+func TestDeduperFailsOpen(t *testing.T) {
+	d, mr := deduper(t)
+	ctx := context.Background()
+
+	d.Claim(ctx, "u4")
+	d.Release("u4", nil)
+	mr.Close()
+	defer func() {
+		if err := mr.Restart(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if got := d.Claim(ctx, "u4"); got != claimed {
+		t.Fatalf("claim with Redis down = %d, want claimed", got)
+	}
+}
+
+func TestNilDeduperClaimsEverything(t *testing.T) {
+	cfg := localSetup.Default()
+	cfg.Consumer.Idempotency.Window.Duration = 0
+	d := newDeduper(context.Background(), cfg)
+	if d != nil {
+		t.Fatal("window 0 returned a Deduper")
+	}
+	if got := d.Claim(context.Background(), "u5"); got != claimed {
+		t.Fatalf("nil claim = %d, want claimed", got)
+	}
+	d.Release("u5", nil)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	localSetup "ganesh.provengo.io/internal/setup"
+	localLogging "ganesh.provengo.io/pkg/logging"
+	localMetrics "ganesh.provengo.io/pkg/metrics"
+	localTracing "ganesh.provengo.io/pkg/tracing"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"go.opentelemetry.io/otel/attribute"
+	"log/slog"
+	"time"
+)
+
+func provisionJetStream(ctx context.Context, cfg *localSetup.Config, nc *nats.Conn) (jetstream.Consumer, error) {
+	jsCfg := cfg.Consumer.JetStream
+	subject := fmt.Sprintf("%s.*", cfg.QueueName)
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, fmt.Errorf("error creating jetstream context: %w", err)
+	}
+
+	stream, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     jsCfg.Stream,
+		Subjects: []string{subject},
+		Storage:  jetstream.FileStorage,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error provisioning stream %s: %w", jsCfg.Stream, err)
+	}
+
+	consumer, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+		Durable:       jsCfg.Durable,
+		FilterSubject: subject,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       jsCfg.AckWait.Duration,
+		MaxDeliver:    jsCfg.MaxDeliver,
+		DeliverPolicy: jetstream.DeliverAllPolicy,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error provisioning consumer %s: %w", jsCfg.Durable, err)
+	}
+	return consumer, nil
+}
+
+// consumeJetStream pulls batches from the durable consumer. Each message is
+// acked once both Redis and Postgres confirmed the write and nak'ed with the
+// configured backoff otherwise.
+func consumeJetStream(ctx context.Context, cfg *localSetup.Config, nc *nats.Conn, reqChannel Channels, logger *slog.Logger) error {
+	jsCfg := cfg.Consumer.JetStream
+
+	consumer, err := provisionJetStream(ctx, cfg, nc)
+	if err != nil {
+		return err
+	}
+
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		batch, err := consumer.Fetch(jsCfg.BatchSize, jetstream.FetchMaxWait(jsCfg.FetchMaxWait.Duration))
+		if err != nil {
+			logger.Error("error fetching from jetstream", "error", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(jsCfg.FetchMaxWait.Duration):
+			}
+			continue
+		}
+
+		for msg := range batch.Messages() {
+			handleJetStreamMessage(nc, cfg, msg, reqChannel, logger)
+		}
+
+		if err := batch.Error(); err != nil && !errors.Is(err, nats.ErrTimeout) {
+			logger.Error("error in jetstream batch", "error", err)
+		}
+	}
+}
+
+func deliveryAttempts(msg jetstream.Msg) uint64 {
+	if meta, err := msg.Metadata(); err == nil {
+		return meta.NumDelivered
+	}
+	return 1
+}
+
+func handleJetStreamMessage(nc *nats.Conn, cfg *localSetup.Config, msg jetstream.Msg, reqChannel Channels, logger *slog.Logger) {
+	localMetrics.MessagesReceived.WithLabelValues(component).Inc()
+	ctx, span := localTracing.StartReceive(msg.Subject(), msg.Headers())
+	span.SetAttributes(attribute.Int64("ganesh.delivery_attempt", int64(deliveryAttempts(msg))))
+	req, stage, err := decodeMessage(msg.Headers(), msg.Data())
+	if err != nil {
+		logger.Warn("rejecting message from NATS", "subject", msg.Subject(), "stage", stage, "error", err)
+		localMetrics.MessagesFailed.WithLabelValues(component, stage).Inc()
+		reqChannel.stats.reject()
+		deadLetter(nc, cfg, logger, msg.Subject(), msg.Headers(), msg.Data(), deliveryAttempts(msg), fmt.Errorf("%s: %w", stage, err))
+		// Redelivery cannot fix the payload.
+		reason := "undecodable payload"
+		if stage == "invalid" {
+			reason = "invalid payload"
+		}
+		_ = msg.TermWithReason(reason)
+		localTracing.End(span, err)
+		return
+	}
+	localMetrics.MessagesDecoded.WithLabelValues(component).Inc()
+	span.SetAttributes(attribute.String("ganesh.uuid", req.UUID), attribute.Int64("ganesh.sequence", req.Sequence))
+
+	switch reqChannel.dedupe.Claim(ctx, req.UUID) {
+	case duplicate:
+		reqChannel.stats.duplicate("redis")
+		localLogging.Message(logger, req).Debug("duplicate message acked", "subject", msg.Subject(), "delivery", deliveryAttempts(msg))
+		if _err := msg.Ack(); _err != nil {
+			localLogging.Message(logger, req).Error("error acking message", "error", _err)
+		}
+		span.SetAttributes(attribute.Bool("ganesh.duplicate", true))
+		localTracing.End(span, nil)
+		return
+	case inFlight:
+		// The other delivery may still fail, this one comes back once its
+		// claim is released or expired.
+		localMetrics.MessagesDuplicate.WithLabelValues("in_flight").Inc()
+		delay := cfg.Consumer.JetStream.Backoff(deliveryAttempts(msg))
+		localLogging.Message(logger, req).Debug("message in flight elsewhere, retrying", "delay", delay)
+		_ = msg.NakWithDelay(delay)
+		localTracing.End(span, nil)
+		return
+	}
+
+	delivery := reqChannel.newDelivery(req, func(err error) {
+		defer localTracing.End(span, err)
+		if err == nil {
+			if _err := msg.Ack(); _err != nil {
+				localLogging.Message(logger, req).Error("error acking message", "error", _err)
+			}
+			return
+		}
+
+		delivered := deliveryAttempts(msg)
+		maxDeliver := cfg.Consumer.JetStream.MaxDeliver
+		if maxDeliver > 0 && delivered >= uint64(maxDeliver) {
+			deadLetter(nc, cfg, localLogging.Message(logger, req), msg.Subject(), msg.Headers(), msg.Data(), delivered, err)
+			_ = msg.TermWithReason("max deliveries exhausted")
+			return
+		}
+
+		delay := cfg.Consumer.JetStream.Backoff(delivered)
+		localLogging.Message(logger, req).Warn("message failed, retrying", "delivery", delivered, "delay", delay, "error", err)
+		if _err := msg.NakWithDelay(delay); _err != nil {
+			localLogging.Message(logger, req).Error("error nak'ing message", "error", _err)
+		}
+	})
+
+	reqChannel.dispatch(Job{Data: req, ctx: ctx, delivery: delivery})
+}
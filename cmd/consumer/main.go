@@ -2,33 +2,51 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	localEncrypt "ganesh.provengo.io/internal/encrypt"
 	localSetup "ganesh.provengo.io/internal/setup"
 	localStructs "ganesh.provengo.io/internal/structs"
+	localLogging "ganesh.provengo.io/pkg/logging"
+	localMetrics "ganesh.provengo.io/pkg/metrics"
+	"ganesh.provengo.io/pkg/partition"
 	localPostgres "ganesh.provengo.io/pkg/postgres"
 	localRedis "ganesh.provengo.io/pkg/redis"
+	"ganesh.provengo.io/pkg/schema"
+	localTracing "ganesh.provengo.io/pkg/tracing"
 	"github.com/nats-io/nats.go"
-	"log"
+	"go.opentelemetry.io/otel/attribute"
+	"log/slog"
 	"os"
+	"os/signal"
 	"runtime"
+	"strconv"
 	"sync"
-	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-const (
-	remoteQueue  = localSetup.QueueName
-	totalTasks   = localSetup.TotalTasks
-	queueGroup   = localSetup.QueueGroup
-	consumerType = localSetup.ConsumerType // pubSub
-)
+const component = "consumer"
 
 type Channels struct {
-	passwordQueue chan localStructs.DataLogin
-	redisQueue    chan localStructs.DataLogin
-	postgresQueue chan localStructs.DataLogin
+	passwordQueue *partition.Queue[Job]
+	redisQueue    *partition.Queue[Job]
+	postgresQueue *partition.Queue[Job]
+	stats         *Stats
+	dedupe        *Deduper
+}
+
+// Workers groups the goroutines of each stage so they can be stopped in
+// order: NATS intake first, then the sinks, then the NATS connections that
+// are still needed to ack and dead-letter in-flight messages.
+type Workers struct {
+	intake      sync.WaitGroup
+	password    sync.WaitGroup
+	redis       sync.WaitGroup
+	postgres    sync.WaitGroup
+	connections sync.WaitGroup
+	release     chan struct{}
 }
 
 func UserPassword(c *localStructs.DataLogin) string {
@@ -38,179 +56,450 @@ func UserPassword(c *localStructs.DataLogin) string {
 	return encrypt
 }
 
-func PasswordWorkers(idGg int, reqChannel chan localStructs.DataLogin, wg *sync.WaitGroup) {
+func PasswordWorkers(idGg int, reqChannel <-chan Job, wg *sync.WaitGroup) {
 	defer wg.Done()
-	fmt.Printf("Starting Password Worker %d\n", idGg)
-	for req := range reqChannel {
-		password := UserPassword(&req)
-		totalTime := time.Now().UnixMilli() - req.Timestamp
-		fmt.Printf("Seq: %d Username %s Password %s, Total Time %d\n", req.Sequence, req.Username, password, totalTime)
+	logger := localLogging.Component("password").With("worker", idGg)
+	logger.Info("starting password worker")
+	for job := range reqChannel {
+		req := job.Data
+		_, span := job.startSpan("password.hash")
+		_ = UserPassword(&req)
+		span.End()
+		localMetrics.MessagesWritten.WithLabelValues("password").Inc()
+		localLogging.Message(logger, req).Debug("password hashed", "total_time_ms", time.Now().UnixMilli()-req.Timestamp)
 	}
 }
 
-func NatsWorker(idGg int, reqChannel Channels, wg *sync.WaitGroup, messageCounter *uint32) {
-	log.Printf("Starting NATS worker: %d\n", idGg)
-	nc, err := nats.Connect(localSetup.NatsAddress)
+func NatsWorker(idGg int, cfg *localSetup.Config, reqChannel Channels, workers *Workers, ctx context.Context) {
+	logger := localLogging.Component("nats").With("worker", idGg)
+	logger.Info("starting NATS worker")
+	nc, err := nats.Connect(cfg.Nats.URL, nats.ErrorHandler(slowConsumerHandler(logger)))
 	if err != nil {
-		log.Fatal("error connecting to NATS")
+		localLogging.Fatal(logger, "error connecting to NATS", "error", err)
 	}
 
+	intakeDone := false
 	defer func() {
+		if !intakeDone {
+			workers.intake.Done()
+		}
+		<-workers.release
+		_ = nc.Flush()
 		nc.Close()
-		wg.Done()
+		workers.connections.Done()
 	}()
 
-	switch consumerType {
+	if idGg == 0 {
+		if _, _err := ensureDeadLetterStream(ctx, cfg, nc); _err != nil {
+			logger.Warn("dead-letter messages will not be retained", "error", _err)
+		}
+	}
+
+	var sub *nats.Subscription
+	switch cfg.Consumer.Type {
 	case "pub_sub":
 		//PUB/SUB PATTERN GROUP QUEUE
-		_, err = nc.Subscribe(remoteQueue, func(msg *nats.Msg) {
-			var req localStructs.DataLogin
-			_err := json.Unmarshal(msg.Data, &req)
-			if _err != nil {
-				log.Printf("error unmarshalling data from NATS: %v", err)
-			}
-			reqChannel.redisQueue <- req
-			reqChannel.postgresQueue <- req
-			reqChannel.passwordQueue <- req
-			atomic.AddUint32(messageCounter, 1)
-
+		sub, err = nc.Subscribe(cfg.QueueName, func(msg *nats.Msg) {
+			handleCoreMessage(nc, cfg, msg, reqChannel, logger)
 		})
+		if err != nil {
+			localLogging.Fatal(logger, "error subscribing to NATS", "error", err)
+		}
 	case "workers":
 		//WORKER PROCESS PATTERN
-		subject := fmt.Sprintf("%s.*", remoteQueue)
-		_, err = nc.QueueSubscribe(subject, queueGroup, func(msg *nats.Msg) {
-			var req localStructs.DataLogin
-			_err := json.Unmarshal(msg.Data, &req)
-			if _err != nil {
-				log.Printf("error unmarshalling data from NATS: %v", err)
-			}
-			reqChannel.redisQueue <- req
-			reqChannel.postgresQueue <- req
-			reqChannel.passwordQueue <- req
-			atomic.AddUint32(messageCounter, 1)
+		subject := fmt.Sprintf("%s.*", cfg.QueueName)
+		sub, err = nc.QueueSubscribe(subject, cfg.Consumer.QueueGroup, func(msg *nats.Msg) {
+			handleCoreMessage(nc, cfg, msg, reqChannel, logger)
 		})
 
 		if err != nil {
-			log.Fatalf("error subscribing to NATS: %v", err)
+			localLogging.Fatal(logger, "error subscribing to NATS", "error", err)
+		}
+	case "jetstream":
+		//DURABLE PULL CONSUMER, ACK AFTER REDIS AND POSTGRES
+		err = consumeJetStream(ctx, cfg, nc, reqChannel, logger)
+		if err != nil {
+			localLogging.Fatal(logger, "error consuming from JetStream", "error", err)
+		}
+		logger.Info("NATS worker stopped fetching")
+		return
+	}
+
+	// Past these limits the client drops messages and reports a slow
+	// consumer instead of buffering without bound.
+	backpressure := cfg.Consumer.Backpressure
+	if err := sub.SetPendingLimits(backpressure.PendingMsgs, backpressure.PendingBytes); err != nil {
+		localLogging.Fatal(logger, "error setting NATS pending limits", "error", err)
+	}
+	natsSubscriptions.add(sub)
+
+	<-ctx.Done()
+
+	// Drain stops the interest but lets the callbacks already queued run
+	if err := sub.Drain(); err != nil {
+		logger.Error("error draining NATS subscription", "error", err)
+	}
+	for sub.IsValid() {
+		select {
+		case <-workers.release:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	logger.Info("NATS worker drained")
+	workers.intake.Done()
+	intakeDone = true
+}
+
+// decodeMessage returns the user of a message upcast to the current version
+// of its schema. On error stage is "decode" for payloads that could not be
+// read and "invalid" for those failing validation, neither reaches the sinks.
+func decodeMessage(header nats.Header, data []byte) (localStructs.DataLogin, string, error) {
+	req, version, err := localStructs.DataLoginSchema.Decode(header, data)
+	if errors.Is(err, schema.ErrInvalid) {
+		return req, "invalid", err
+	}
+	if err != nil {
+		return req, "decode", err
+	}
+	if version != localStructs.DataLoginSchema.Current() {
+		localMetrics.MessagesUpcast.WithLabelValues(localStructs.DataLoginSchema.Name(), strconv.Itoa(version)).Inc()
+	}
+	return req, "", nil
+}
+
+// handleCoreMessage decodes a core NATS message and fans it out. Core NATS
+// has no redelivery, so a failed write goes straight to the dead-letter subject.
+func handleCoreMessage(nc *nats.Conn, cfg *localSetup.Config, msg *nats.Msg, reqChannel Channels, logger *slog.Logger) {
+	localMetrics.MessagesReceived.WithLabelValues(component).Inc()
+	ctx, span := localTracing.StartReceive(msg.Subject, msg.Header)
+	req, stage, err := decodeMessage(msg.Header, msg.Data)
+	if err != nil {
+		logger.Warn("rejecting message from NATS", "subject", msg.Subject, "stage", stage, "error", err)
+		localMetrics.MessagesFailed.WithLabelValues(component, stage).Inc()
+		reqChannel.stats.reject()
+		deadLetter(nc, cfg, logger, msg.Subject, msg.Header, msg.Data, 1, fmt.Errorf("%s: %w", stage, err))
+		localTracing.End(span, err)
+		return
+	}
+	localMetrics.MessagesDecoded.WithLabelValues(component).Inc()
+	span.SetAttributes(attribute.String("ganesh.uuid", req.UUID), attribute.Int64("ganesh.sequence", req.Sequence))
+
+	// Core NATS does not redeliver, a message being processed elsewhere is
+	// a duplicate as well.
+	if state := reqChannel.dedupe.Claim(ctx, req.UUID); state != claimed {
+		stage := "redis"
+		if state == inFlight {
+			stage = "in_flight"
 		}
+		reqChannel.stats.duplicate(stage)
+		localLogging.Message(logger, req).Debug("duplicate message skipped", "subject", msg.Subject, "stage", stage)
+		span.SetAttributes(attribute.Bool("ganesh.duplicate", true))
+		localTracing.End(span, nil)
+		return
 	}
 
-	select {}
+	delivery := reqChannel.newDelivery(req, func(err error) {
+		if err != nil {
+			deadLetter(nc, cfg, localLogging.Message(logger, req), msg.Subject, msg.Header, msg.Data, 1, err)
+		}
+		localTracing.End(span, err)
+	})
+	reqChannel.dispatch(Job{Data: req, ctx: ctx, delivery: delivery})
 }
 
-func RedisWorker(idGg int, reqChannel chan localStructs.DataLogin, wg *sync.WaitGroup, ctx context.Context) {
+func RedisWorker(idGg int, cfg *localSetup.Config, reqChannel <-chan Job, breaker *localRedis.Breaker, wg *sync.WaitGroup, ctx context.Context) {
 
-	fmt.Printf("Starting Redis worker: %d\n", idGg)
+	logger := localLogging.Component("redis").With("worker", idGg)
+	logger.Info("starting Redis worker")
 
-	conn, _err := localRedis.RedisConnection(ctx)
+	conn, _err := localRedis.RedisConnection(ctx, cfg.Redis)
 	if _err != nil {
-		log.Fatalf("Error connecting to Redis %v", _err)
+		localLogging.Fatal(logger, "error connecting to Redis", "error", _err)
 	}
 
-	defer func() {
-		wg.Done()
-		conn.Close()
-	}()
+	defer wg.Done()
 
-	_randoTime := localSetup.RedisDefaultTTL
+	batchCfg := cfg.Redis.Batch
+	batch := make([]Job, 0, batchCfg.Size)
+	ticker := time.NewTicker(batchCfg.Interval.Duration)
+	defer ticker.Stop()
 
-	for req := range reqChannel {
-		_data := localRedis.RedisData{
-			Key:   req.UUID,
-			Value: fmt.Sprintf("Username %s Password %s", req.Username, req.Password),
-			TTL:   _randoTime,
+	flush := func() {
+		if len(batch) == 0 {
+			return
 		}
+		flushRedis(ctx, cfg, conn, breaker, batch, logger)
+		batch = make([]Job, 0, batchCfg.Size)
+	}
 
-		go func() {
-			_err := conn.Set(ctx, _data)
-			if _err != nil {
-				log.Fatalf("Error setting data in Redis %v", _err)
+	for {
+		select {
+		case job, ok := <-reqChannel:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, job.withSpan("redis.set"))
+			if len(batch) >= batchCfg.Size {
+				flush()
 			}
-		}()
+		case <-ticker.C:
+			flush()
+		}
 	}
 }
 
-func PostgresWorker(idGg int, reqChannel chan localStructs.DataLogin, wg *sync.WaitGroup, ctx context.Context) {
-	fmt.Printf("Starting Postgres Worker: %d\n", idGg)
+// flushRedis writes a batch through a pipeline, retrying the failed keys with
+// backoff. While the breaker is open the worker waits instead of hammering
+// Redis, jobs still failing after the retries are reported as failed.
+func flushRedis(ctx context.Context, cfg *localSetup.Config, conn *localRedis.RedisService, breaker *localRedis.Breaker, jobs []Job, logger *slog.Logger) {
+	backoff := cfg.Redis.Batch.RetryBackoff.Duration
+	pending := jobs
+	var lastErr error
+
+	for attempt := 0; len(pending) > 0 && attempt <= cfg.Redis.Batch.MaxRetries; attempt++ {
+		if attempt > 0 {
+			wait := backoff
+			if cooldown := breaker.Cooldown(); cooldown > wait {
+				wait = cooldown
+			}
+			select {
+			case <-ctx.Done():
+				lastErr = ctx.Err()
+				attempt = cfg.Redis.Batch.MaxRetries
+				continue
+			case <-time.After(wait):
+			}
+			backoff *= 2
+		}
 
-	conn, err := localPostgres.PostgresConnection(ctx, localSetup.PostgresURI)
+		if err := breaker.Allow(); err != nil {
+			lastErr = err
+			continue
+		}
+
+		data := make([]localRedis.RedisData, len(pending))
+		for i, job := range pending {
+			data[i] = localRedis.RedisData{
+				Key:   job.Data.UUID,
+				Value: fmt.Sprintf("Username %s Password %s", job.Data.Username, job.Data.Password),
+				TTL:   cfg.Redis.DefaultTTL.Duration,
+			}
+		}
+
+		var failed []Job
+		start := time.Now()
+		errs := conn.SetMany(ctx, data)
+		localMetrics.SinkWriteLatency.WithLabelValues("redis").Observe(time.Since(start).Seconds())
+		for i, err := range errs {
+			if err != nil {
+				lastErr = err
+				failed = append(failed, pending[i])
+				continue
+			}
+			localMetrics.MessagesWritten.WithLabelValues("redis").Inc()
+			pending[i].Done(nil)
+		}
+
+		if len(failed) == 0 {
+			breaker.Success()
+		} else {
+			breaker.Failure()
+		}
+		pending = failed
+	}
+
+	if len(pending) > 0 {
+		logger.Error("error setting keys in Redis", "keys", len(pending), "error", lastErr)
+		localMetrics.MessagesFailed.WithLabelValues(component, "redis").Add(float64(len(pending)))
+		for _, job := range pending {
+			localLogging.Message(logger, job.Data).Debug("redis write abandoned", "error", lastErr)
+			job.Done(lastErr)
+		}
+	}
+}
+
+func PostgresWorker(idGg int, cfg *localSetup.Config, reqChannel <-chan Job, wg *sync.WaitGroup, ctx context.Context) {
+	logger := localLogging.Component("postgres").With("worker", idGg)
+	logger.Info("starting Postgres worker")
+
+	conn, err := localPostgres.PostgresConnection(ctx, cfg.Postgres)
 
 	if err != nil {
-		log.Fatalf("Error connecting to Postgres %v", err)
+		localLogging.Fatal(logger, "error connecting to Postgres", "error", err)
 	}
 
 	err = conn.Ping(ctx)
 	if err != nil {
-		log.Fatalf("Error pinging Postgres %v", err)
+		localLogging.Fatal(logger, "error pinging Postgres", "error", err)
 	}
 
+	batchCfg := cfg.Postgres.Batch
+	writer := conn.NewBatchWriter(ctx, localPostgres.BatchConfig{
+		Size:         batchCfg.Size,
+		Interval:     batchCfg.Interval.Duration,
+		MaxRetries:   batchCfg.MaxRetries,
+		RetryBackoff: batchCfg.RetryBackoff.Duration,
+		OnFlush: func(rows int, elapsed time.Duration) {
+			localMetrics.SinkWriteLatency.WithLabelValues("postgres").Observe(elapsed.Seconds())
+		},
+		Logger: logger,
+	})
+
 	defer func() {
+		writer.Close(ctx)
 		wg.Done()
-		conn.Close()
 	}()
 
-	for req := range reqChannel {
-		wg.Add(1)
-		go func() {
-			err := conn.InsertUserPassword(ctx, req)
-			if err != nil {
-				log.Fatalf("Error inserting user password %v", err)
-			}
-		}()
+	for job := range reqChannel {
+		job := job.withSpan("postgres.copy")
+		writer.Add(ctx, localPostgres.BatchRow{
+			Data: job.Data,
+			Result: func(err error) {
+				if errors.Is(err, localPostgres.ErrDuplicate) {
+					// A redelivery whose row was stored, the message is
+					// complete.
+					localLogging.Message(logger, job.Data).Debug("user already stored, row skipped")
+					localMetrics.MessagesDuplicate.WithLabelValues("postgres").Inc()
+					err = nil
+				}
+				if err != nil {
+					localLogging.Message(logger, job.Data).Error("error inserting user password", "error", err)
+					localMetrics.MessagesFailed.WithLabelValues(component, "postgres").Inc()
+				} else {
+					localMetrics.MessagesWritten.WithLabelValues("postgres").Inc()
+				}
+				job.Done(err)
+			},
+		})
 	}
 }
 
-func startWorkTasks(wg *sync.WaitGroup, reqChannel Channels, ctx context.Context) {
-	var totalMessages uint32
-	log.Printf("Starting work tasks")
-
-	for i := 0; i < totalTasks; i++ {
+func startWorkTasks(ctx context.Context, sinkCtx context.Context, cfg *localSetup.Config, reqChannel Channels) *Workers {
+	logger := localLogging.Component("pipeline")
+	logger.Info("starting work tasks", "tasks", cfg.Consumer.Tasks, "type", cfg.Consumer.Type)
+	for _, s := range schema.Registered() {
+		logger.Info("accepting schema", "schema", s.Name(), "current", s.Current(), "versions", s.Versions())
+	}
+	workers := &Workers{release: make(chan struct{})}
+	breaker := localRedis.NewBreaker(cfg.Redis.Breaker.Threshold, cfg.Redis.Breaker.Cooldown.Duration)
+
+	// Ordering takes a single intake, several subscriptions or fetchers would
+	// interleave the messages of a key, and one worker per partition.
+	intake, passwords, sinks := cfg.Consumer.Tasks, cfg.Consumer.Tasks, cfg.Consumer.Tasks+2
+	if reqChannel.redisQueue.Ordered() {
+		intake, passwords, sinks = 1, reqChannel.passwordQueue.Partitions(), reqChannel.redisQueue.Partitions()
+		logger.Info("ordering messages", "key", cfg.Consumer.Ordering.Key, "partitions", sinks)
+	}
 
+	for i := 0; i < intake; i++ {
 		//Nats workers
-		wg.Add(1)
-		go NatsWorker(i, reqChannel, wg, &totalMessages)
+		workers.intake.Add(1)
+		workers.connections.Add(1)
+		go NatsWorker(i, cfg, reqChannel, workers, ctx)
+	}
 
+	for i := 0; i < passwords; i++ {
 		//Passwords workers
-		wg.Add(1)
-		go PasswordWorkers(i, reqChannel.passwordQueue, wg)
+		workers.password.Add(1)
+		go PasswordWorkers(i, reqChannel.passwordQueue.Partition(i), &workers.password)
 	}
 
-	for i := 0; i < totalTasks+2; i++ {
+	for i := 0; i < sinks; i++ {
 		//Redis Workers
-		wg.Add(1)
-		go RedisWorker(i, reqChannel.redisQueue, wg, ctx)
+		workers.redis.Add(1)
+		go RedisWorker(i, cfg, reqChannel.redisQueue.Partition(i), breaker, &workers.redis, sinkCtx)
 
 		//Postgres Workers
-		wg.Add(1)
-		go PostgresWorker(i, reqChannel.postgresQueue, wg, ctx)
+		workers.postgres.Add(1)
+		go PostgresWorker(i, cfg, reqChannel.postgresQueue.Partition(i), &workers.postgres, sinkCtx)
 	}
 
 	go func() {
 		for {
-			fmt.Printf("Total Messages: %d\n", atomic.LoadUint32(&totalMessages))
-			time.Sleep(1 * time.Second)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(1 * time.Second):
+				logger.Debug("progress", "received", reqChannel.stats.Received(), "in_flight", reqChannel.stats.InFlight(), "duplicates", reqChannel.stats.Duplicates())
+			}
 		}
 	}()
-	go func() {
-		wg.Wait()
-	}()
+
+	return workers
 }
 
-func runningServer(ctx context.Context, wg *sync.WaitGroup) {
+func runningServer(ctx context.Context, cfg *localSetup.Config) {
+	// A metrics port already in use fails before anything else started.
+	metricsServer, err := localMetrics.Serve(cfg.Metrics.Port, cfg.Metrics.LogLevelEndpoint)
+	if err != nil {
+		localLogging.Fatal(localLogging.Component("metrics"), "error starting the metrics server", "error", err)
+	}
+
+	sinkCtx, cancelSinks := context.WithCancel(context.Background())
+	defer cancelSinks()
 
 	var channels Channels
-	channels.passwordQueue = make(chan localStructs.DataLogin, totalTasks)
-	channels.redisQueue = make(chan localStructs.DataLogin, totalTasks)
-	channels.postgresQueue = make(chan localStructs.DataLogin, totalTasks)
+	backpressure := cfg.Consumer.Backpressure
+	// The password worker stores nothing, its jobs are not acknowledged.
+	for _, q := range []struct {
+		queue **partition.Queue[Job]
+		name  string
+		sink  localSetup.SinkQueue
+		acks  bool
+	}{
+		{&channels.passwordQueue, "password", backpressure.Password, false},
+		{&channels.redisQueue, "redis", backpressure.Redis, true},
+		{&channels.postgresQueue, "postgres", backpressure.Postgres, true},
+	} {
+		queue, err := newSinkQueue(cfg, q.name, q.sink, q.acks)
+		if err != nil {
+			localLogging.Fatal(localLogging.Component("backpressure"), "error creating sink queue", "error", err)
+		}
+		*q.queue = queue
+	}
+	channels.stats = &Stats{}
+	channels.dedupe = newDeduper(sinkCtx, cfg)
 
-	startWorkTasks(wg, channels, ctx)
+	if cfg.Consumer.Type != "jetstream" {
+		localMetrics.RegisterNatsDropped(component, natsSubscriptions.Dropped)
+	}
+
+	workers := startWorkTasks(ctx, sinkCtx, cfg, channels)
 
+	<-ctx.Done()
+	shutdown(cfg, channels, workers, metricsServer, cancelSinks)
 }
 
 func main() {
-	var ctx = context.Background()
-	wg := sync.WaitGroup{}
+	if len(os.Args) > 1 && os.Args[1] == "dlq" {
+		runDeadLetterCommand(os.Args[2:])
+		return
+	}
+
+	cfg, err := localSetup.Load(localSetup.BinaryConsumer, flag.NewFlagSet("consumer", flag.ExitOnError), os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading configuration: %v\n", err)
+		os.Exit(1)
+	}
+	logger := localLogging.Init(cfg.Logging, "ganesh-"+component)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := localTracing.Init(ctx, cfg.Tracing, "ganesh-"+component)
+	if err != nil {
+		localLogging.Fatal(logger, "error initializing tracing", "error", err)
+	}
+	defer func() {
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			logger.Error("error flushing spans", "error", err)
+		}
+	}()
+
 	runtime.GOMAXPROCS(2)
-	runningServer(ctx, &wg)
-	select {}
+	runningServer(ctx, cfg)
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	localStructs "ganesh.provengo.io/internal/structs"
+	localMetrics "ganesh.provengo.io/pkg/metrics"
+	localTracing "ganesh.provengo.io/pkg/tracing"
+	"go.opentelemetry.io/otel/trace"
+	"sync"
+	"sync/atomic"
+)
+
+// Sinks that must confirm a message before it is considered processed.
+const ackSinks = 2
+
+// Job is what flows through the fan-out channels. The delivery is shared by
+// the copies sent to each sink and is nil for modes that never ack. ctx
+// carries the receive span, each sink adds its own span to its copy.
+type Job struct {
+	Data     localStructs.DataLogin
+	ctx      context.Context
+	delivery *Delivery
+	span     trace.Span
+}
+
+func (j Job) startSpan(name string) (context.Context, trace.Span) {
+	ctx := j.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return localTracing.Tracer().Start(ctx, name)
+}
+
+// withSpan returns a copy of the job whose Done also ends a span named name.
+func (j Job) withSpan(name string) Job {
+	_, j.span = j.startSpan(name)
+	return j
+}
+
+func (j Job) Done(err error) {
+	if j.span != nil {
+		localTracing.End(j.span, err)
+	}
+	if j.delivery != nil {
+		j.delivery.Done(err)
+	}
+}
+
+type Delivery struct {
+	pending int32
+	mu      sync.Mutex
+	errs    []error
+	onDone  func(err error)
+}
+
+func NewDelivery(sinks int, onDone func(err error)) *Delivery {
+	return &Delivery{
+		pending: int32(sinks),
+		onDone:  onDone,
+	}
+}
+
+// Done records the result of one sink. The last sink to report triggers
+// onDone with the joined errors, if any.
+func (d *Delivery) Done(err error) {
+	if err != nil {
+		d.mu.Lock()
+		d.errs = append(d.errs, err)
+		d.mu.Unlock()
+	}
+	if atomic.AddInt32(&d.pending, -1) != 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onDone(errors.Join(d.errs...))
+}
+
+// Stats counts messages across the pipeline. A message is completed once
+// every sink reported, successfully or not.
+type Stats struct {
+	received   uint64
+	completed  uint64
+	failed     uint64
+	rejected   uint64
+	duplicates uint64
+}
+
+func (s *Stats) Received() uint64 {
+	return atomic.LoadUint64(&s.received)
+}
+
+func (s *Stats) Completed() uint64 {
+	return atomic.LoadUint64(&s.completed)
+}
+
+func (s *Stats) Failed() uint64 {
+	return atomic.LoadUint64(&s.failed)
+}
+
+func (s *Stats) Rejected() uint64 {
+	return atomic.LoadUint64(&s.rejected)
+}
+
+func (s *Stats) Duplicates() uint64 {
+	return atomic.LoadUint64(&s.duplicates)
+}
+
+func (s *Stats) InFlight() uint64 {
+	return s.Received() - s.Completed()
+}
+
+func (s *Stats) reject() {
+	atomic.AddUint64(&s.rejected, 1)
+}
+
+// duplicate counts a message skipped at the given stage.
+func (s *Stats) duplicate(stage string) {
+	localMetrics.MessagesDuplicate.WithLabelValues(stage).Inc()
+	atomic.AddUint64(&s.duplicates, 1)
+}
+
+// newDelivery creates the delivery of a received message, counting it until
+// onDone runs. The idempotency claim of the message is released first.
+func (c Channels) newDelivery(req localStructs.DataLogin, onDone func(err error)) *Delivery {
+	atomic.AddUint64(&c.stats.received, 1)
+	return NewDelivery(ackSinks, func(err error) {
+		c.dedupe.Release(req.UUID, err)
+		if err != nil {
+			atomic.AddUint64(&c.stats.failed, 1)
+		} else {
+			localMetrics.ObserveEndToEnd(req.Timestamp)
+		}
+		onDone(err)
+		atomic.AddUint64(&c.stats.completed, 1)
+	})
+}
+
+func (c Channels) dispatch(job Job) {
+	c.redisQueue.Push(job)
+	c.postgresQueue.Push(job)
+	c.passwordQueue.Push(job)
+}
+
+// orderingKey returns the key partitioning the jobs for consumer.ordering.key,
+// nil when ordering is disabled.
+func orderingKey(field string) func(Job) string {
+	switch field {
+	case "username":
+		return func(job Job) string { return job.Data.Username }
+	case "uuid":
+		return func(job Job) string { return job.Data.UUID }
+	}
+	return nil
+}
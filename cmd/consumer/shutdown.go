@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	localSetup "ganesh.provengo.io/internal/setup"
+	localLogging "ganesh.provengo.io/pkg/logging"
+	localPostgres "ganesh.provengo.io/pkg/postgres"
+	localRedis "ganesh.provengo.io/pkg/redis"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Time given to the sinks to report after their context was cancelled, so
+// the failures can still be nak'ed or dead-lettered.
+const shutdownGrace = 1 * time.Second
+
+func waitUntil(wg *sync.WaitGroup, deadline time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Until(deadline)):
+		return false
+	}
+}
+
+// shutdown stops the pipeline in order: NATS intake is drained, the fan-out
+// channels are closed, the sinks flush what they hold and only then the NATS
+// connections, still needed for acks and dead-letters, are closed. The
+// metrics server goes last, the drain can be followed until then.
+func shutdown(cfg *localSetup.Config, channels Channels, workers *Workers, metricsServer *http.Server, cancelSinks context.CancelFunc) {
+	logger := localLogging.Component("shutdown")
+	stats := channels.stats
+	inFlight := stats.InFlight()
+	deadline := time.Now().Add(cfg.Consumer.ShutdownTimeout.Duration)
+	logger.Info("shutting down", "in_flight", inFlight, "deadline", cfg.Consumer.ShutdownTimeout.Duration)
+
+	flushed := false
+	if waitUntil(&workers.intake, deadline) {
+		channels.passwordQueue.Close()
+		channels.redisQueue.Close()
+		channels.postgresQueue.Close()
+
+		flushed = waitUntil(&workers.redis, deadline) &&
+			waitUntil(&workers.postgres, deadline) &&
+			waitUntil(&workers.password, deadline)
+	} else {
+		logger.Warn("NATS intake did not stop before the deadline")
+	}
+
+	if !flushed {
+		logger.Warn("sinks did not flush before the deadline, cancelling pending writes")
+		cancelSinks()
+		grace := time.Now().Add(shutdownGrace)
+		waitUntil(&workers.redis, grace)
+		waitUntil(&workers.postgres, grace)
+	}
+
+	close(workers.release)
+	if !waitUntil(&workers.connections, time.Now().Add(shutdownGrace)) {
+		logger.Warn("NATS connections did not close in time")
+	}
+	cancelSinks()
+
+	localRedis.CloseConnection()
+	localPostgres.CloseConnection()
+
+	if metricsServer != nil {
+		metricsCtx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+		_ = metricsServer.Shutdown(metricsCtx)
+		cancel()
+	}
+
+	logger.Info("consumer stopped",
+		"received", stats.Received(),
+		"processed", stats.Completed()-stats.Failed(),
+		"failed", stats.Failed(),
+		"rejected", stats.Rejected(),
+		"duplicates", stats.Duplicates(),
+		"in_flight_at_shutdown", inFlight,
+		"abandoned", stats.InFlight(),
+	)
+}
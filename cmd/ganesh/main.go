@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	localSetup "ganesh.provengo.io/internal/setup"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const usage = `usage:
+  ganesh secrets encrypt [-key-file path] [value]
+  ganesh secrets decrypt [-key-file path] value
+  ganesh secrets rotate [-key-file path] -new-key-file path config-file...
+
+The master key is read from -key-file, or else from GANESH_MASTER_KEY or
+GANESH_MASTER_KEY_FILE.
+encrypt reads the value from stdin when it is not given as an argument.`
+
+func readValue(args []string) (string, error) {
+	if len(args) > 0 {
+		return args[0], nil
+	}
+	reader := bufio.NewReader(os.Stdin)
+	line, err := reader.ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("error reading value from stdin: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func secretsEncrypt(args []string) error {
+	fs := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	keyFile := fs.String("key-file", "", "master key file")
+	_ = fs.Parse(args)
+
+	key, err := localSetup.MasterKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	value, err := readValue(fs.Args())
+	if err != nil {
+		return err
+	}
+	encrypted, err := localSetup.EncryptValue(value, key)
+	if err != nil {
+		return err
+	}
+	fmt.Println(encrypted)
+	return nil
+}
+
+func secretsDecrypt(args []string) error {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	keyFile := fs.String("key-file", "", "master key file")
+	_ = fs.Parse(args)
+
+	key, err := localSetup.MasterKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	value, err := readValue(fs.Args())
+	if err != nil {
+		return err
+	}
+	if !localSetup.IsEncrypted(value) {
+		return fmt.Errorf("value is not prefixed with %q", localSetup.SecretPrefix)
+	}
+	plaintext, err := localSetup.DecryptValue(value, key)
+	if err != nil {
+		return err
+	}
+	fmt.Println(plaintext)
+	return nil
+}
+
+func secretsRotate(args []string) error {
+	fs := flag.NewFlagSet("rotate", flag.ExitOnError)
+	keyFile := fs.String("key-file", "", "current master key file")
+	newKeyFile := fs.String("new-key-file", "", "new master key file")
+	_ = fs.Parse(args)
+
+	if *newKeyFile == "" || fs.NArg() == 0 {
+		return fmt.Errorf("rotate requires -new-key-file and at least one config file")
+	}
+
+	oldKey, err := localSetup.MasterKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	raw, err := os.ReadFile(*newKeyFile)
+	if err != nil {
+		return fmt.Errorf("error reading new master key file: %w", err)
+	}
+	newKey := strings.TrimSpace(string(raw))
+
+	// Every file is rotated in memory first, so a wrong key or a corrupt
+	// value leaves all of them untouched.
+	type rotation struct {
+		path    string
+		mode    os.FileMode
+		content string
+		total   int
+	}
+	var rotations []rotation
+	for _, path := range fs.Args() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rotated, total, err := localSetup.RotateText(string(content), oldKey, newKey)
+		if err != nil {
+			return fmt.Errorf("%s: %w, no file was changed", path, err)
+		}
+		rotations = append(rotations, rotation{path: path, mode: info.Mode().Perm(), content: rotated, total: total})
+	}
+
+	for _, r := range rotations {
+		if err := writeFileAtomic(r.path, []byte(r.content), r.mode); err != nil {
+			return err
+		}
+		log.Printf("%s: %d secrets rotated", r.path, r.total)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces path with data through a synced temporary file in
+// the same directory, so a crash leaves either the old or the new content.
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file for %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error setting the mode of %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error syncing %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing %s: %w", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error replacing %s: %w", path, err)
+	}
+	return nil
+}
+
+func main() {
+	if len(os.Args) < 3 || os.Args[1] != "secrets" {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[2] {
+	case "encrypt":
+		err = secretsEncrypt(os.Args[3:])
+	case "decrypt":
+		err = secretsDecrypt(os.Args[3:])
+	case "rotate":
+		err = secretsRotate(os.Args[3:])
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("secrets %s: %v", os.Args[2], err)
+	}
+}
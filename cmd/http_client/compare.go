@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	GaneshHttpClient "ganesh.provengo.io/pkg/http/client"
+	"os"
+	"text/tabwriter"
+)
+
+// runCompare diffs two JSON reports and exits with 1 when the candidate
+// regressed, so it can gate a CI job.
+func runCompare(args []string) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	threshold := fs.Float64("threshold", 10, "change in percent above which a metric is flagged as a regression")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: http_client compare [-threshold 10] baseline.json candidate.json")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	baseline, err := GaneshHttpClient.ReadReport(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "compare: %v\n", err)
+		os.Exit(2)
+	}
+	candidate, err := GaneshHttpClient.ReadReport(fs.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "compare: %v\n", err)
+		os.Exit(2)
+	}
+
+	regressions := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "metric\tbaseline\tcandidate\tchange\t")
+	for _, d := range GaneshHttpClient.Compare(baseline, candidate, *threshold) {
+		flagged := ""
+		if d.Regression {
+			flagged = "REGRESSION"
+			regressions++
+		}
+		fmt.Fprintf(w, "%s\t%.3f\t%.3f\t%+.1f%%\t%s\n", d.Metric, d.Baseline, d.Candidate, d.Change, flagged)
+	}
+	_ = w.Flush()
+
+	if regressions > 0 {
+		fmt.Printf("%d regression(s) beyond %.1f%%\n", regressions, *threshold)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	localSetup "ganesh.provengo.io/internal/setup"
+	GaneshHttpClient "ganesh.provengo.io/pkg/http/client"
+	localLogging "ganesh.provengo.io/pkg/logging"
+	"github.com/nats-io/nats.go"
+)
+
+func connect(cfg *localSetup.Config, role string) *nats.Conn {
+	logger := localLogging.Component("nats")
+	nc, err := nats.Connect(cfg.Nats.URL,
+		nats.Name("ganesh-http-client-"+role),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+	)
+	if err != nil {
+		localLogging.Fatal(logger, "error connecting to NATS", "url", cfg.Nats.URL, "error", err)
+	}
+	return nc
+}
+
+// runAgent waits for plans from a coordinator until SIGINT or SIGTERM.
+func runAgent(cfg *localSetup.Config, credentials GaneshHttpClient.Credentials) {
+	distributed := cfg.HTTPClient.Distributed
+	if distributed.AgentID == "" {
+		hostname, _ := os.Hostname()
+		distributed.AgentID = fmt.Sprintf("%s-%d", strings.NewReplacer(".", "-", " ", "-").Replace(hostname), os.Getpid())
+	}
+
+	nc := connect(cfg, "agent")
+	defer nc.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := GaneshHttpClient.RunAgent(ctx, nc, distributed, credentials); err != nil {
+		localLogging.Fatal(localLogging.Component("agent"), "agent failed", "error", err)
+	}
+}
+
+// runCoordinator spreads the configured load test over the agents.
+func runCoordinator(cfg *localSetup.Config) (GaneshHttpClient.Report, error) {
+	nc := connect(cfg, "coordinator")
+	defer nc.Close()
+
+	run := GaneshHttpClient.Plan{
+		Mode:     cfg.HTTPClient.Mode,
+		URL:      cfg.HTTPClient.URL,
+		Scenario: cfg.HTTPClient.Scenario,
+		Workers:  cfg.HTTPClient.Workers,
+		Duration: cfg.HTTPClient.Duration.Duration,
+		Rate:     float64(cfg.HTTPClient.Rate),
+		Stages:   stages(cfg),
+	}
+	return GaneshHttpClient.Coordinate(nc, cfg.HTTPClient.Distributed, run)
+}
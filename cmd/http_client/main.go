@@ -1,13 +1,100 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	localSetup "ganesh.provengo.io/internal/setup"
 	GaneshHttpClient "ganesh.provengo.io/pkg/http/client"
-	"time"
+	localLogging "ganesh.provengo.io/pkg/logging"
+	"log/slog"
+	"os"
 )
 
 func main() {
-	url := "http://192.168.86.45:8080/send-user"
+	if len(os.Args) > 1 && os.Args[1] == "compare" {
+		runCompare(os.Args[2:])
+		return
+	}
 
-	GaneshHttpClient.StartClient(url, 100, 30*time.Second)
+	cfg, err := localSetup.Load(localSetup.BinaryHTTPClient, flag.NewFlagSet("http_client", flag.ExitOnError), os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading configuration: %v\n", err)
+		os.Exit(1)
+	}
+	localLogging.Init(cfg.Logging, "ganesh-http-client")
 
+	credentials := GaneshHttpClient.Credentials{
+		ClientID: cfg.HTTPClient.ClientID,
+		Secret:   cfg.HTTPClient.Secret,
+	}
+
+	var report GaneshHttpClient.Report
+	switch cfg.HTTPClient.Distributed.Role {
+	case "agent":
+		runAgent(cfg, credentials)
+		return
+	case "coordinator":
+		report, err = runCoordinator(cfg)
+	default:
+		report = runLocal(cfg, credentials)
+	}
+
+	if err != nil {
+		slog.Error("distributed run failed", "error", err)
+		if len(report.Agents) == 0 {
+			os.Exit(1)
+		}
+	}
+
+	report.Print(os.Stdout)
+	if cfg.HTTPClient.ResultsDir == "" {
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+	name := fmt.Sprintf("http-client-%s-%s", report.Mode, report.StartedAt.Format("2006-01-02-15-04-05"))
+	paths, werr := report.Write(cfg.HTTPClient.ResultsDir, name)
+	if werr != nil {
+		slog.Error("error writing report", "dir", cfg.HTTPClient.ResultsDir, "error", werr)
+		os.Exit(1)
+	}
+	for _, path := range paths {
+		fmt.Printf("Report: %s\n", path)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+
+}
+
+// runLocal runs the whole load test from this process.
+func runLocal(cfg *localSetup.Config, credentials GaneshHttpClient.Credentials) GaneshHttpClient.Report {
+	scenario := GaneshHttpClient.DefaultScenario(cfg.HTTPClient.URL)
+	if cfg.HTTPClient.Scenario != "" {
+		var err error
+		if scenario, err = GaneshHttpClient.LoadScenario(cfg.HTTPClient.Scenario, cfg.HTTPClient.URL); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if cfg.HTTPClient.Mode == "open" {
+		load := GaneshHttpClient.OpenLoad{
+			Rate:     float64(cfg.HTTPClient.Rate),
+			Duration: cfg.HTTPClient.Duration.Duration,
+			Workers:  cfg.HTTPClient.Workers,
+		}
+		load.Stages = stages(cfg)
+		return GaneshHttpClient.StartOpenClient(scenario, load, credentials)
+	}
+	return GaneshHttpClient.StartClient(scenario, cfg.HTTPClient.Workers, cfg.HTTPClient.Duration.Duration, credentials)
+}
+
+func stages(cfg *localSetup.Config) []GaneshHttpClient.Stage {
+	var stages []GaneshHttpClient.Stage
+	for _, stage := range cfg.HTTPClient.Stages {
+		stages = append(stages, GaneshHttpClient.Stage{Duration: stage.Duration.Duration, Target: float64(stage.Target)})
+	}
+	return stages
 }
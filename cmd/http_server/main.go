@@ -1,16 +1,43 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	localSetup "ganesh.provengo.io/internal/setup"
 	GaneshHTTPServer "ganesh.provengo.io/pkg/http/server"
+	localLogging "ganesh.provengo.io/pkg/logging"
+	localTracing "ganesh.provengo.io/pkg/tracing"
+	"os"
+	"os/signal"
 	"runtime"
-)
-
-const (
-	ServicePort = 8080
-	IsSSL       = false
+	"syscall"
 )
 
 func main() {
+	cfg, err := localSetup.Load(localSetup.BinaryHTTPServer, flag.NewFlagSet("http_server", flag.ExitOnError), os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading configuration: %v\n", err)
+		os.Exit(1)
+	}
+	logger := localLogging.Init(cfg.Logging, "ganesh-http-server")
+
+	shutdownTracing, err := localTracing.Init(context.Background(), cfg.Tracing, "ganesh-http-server")
+	if err != nil {
+		localLogging.Fatal(logger, "error initializing tracing", "error", err)
+	}
+	defer func() {
+		_ = shutdownTracing(context.Background())
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	runtime.GOMAXPROCS(2)
-	GaneshHTTPServer.Run(ServicePort, IsSSL)
+	if err := GaneshHTTPServer.Run(ctx, cfg); err != nil {
+		logger.Error("HTTP server failed", "error", err)
+		stop()
+		_ = shutdownTracing(context.Background())
+		os.Exit(1)
+	}
 }
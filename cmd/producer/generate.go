@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	localSetup "ganesh.provengo.io/internal/setup"
+	localStructs "ganesh.provengo.io/internal/structs"
+	"ganesh.provengo.io/pkg/codec"
+	"ganesh.provengo.io/pkg/schema"
+	fkrV4 "github.com/go-faker/faker/v4"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field number of the padding with the protobuf codec, unknown to consumers
+// which skip it.
+const protoPadding protowire.Number = 15
+
+type paddedLogin struct {
+	localStructs.DataLogin
+	Padding string `json:"padding,omitempty"`
+}
+
+func (p paddedLogin) AppendProto(b []byte) []byte {
+	b = p.DataLogin.AppendProto(b)
+	b = protowire.AppendTag(b, protoPadding, protowire.BytesType)
+	return protowire.AppendString(b, p.Padding)
+}
+
+func (p *paddedLogin) UnmarshalProto(b []byte) error {
+	return p.DataLogin.UnmarshalProto(b)
+}
+
+// generator builds the users in sequence order from sources seeded once, so
+// a seed gives the same users, subjects and payloads whatever the
+// concurrency. Only the timestamps differ between runs.
+type generator struct {
+	random      *rand.Rand
+	codec       codec.Codec
+	queue       string
+	subject     string
+	payloadSize int
+}
+
+func newGenerator(cfg *localSetup.Config, seed int64) (*generator, error) {
+	encoder, err := codec.ByName(cfg.Producer.Codec)
+	if err != nil {
+		return nil, err
+	}
+	random := rand.New(rand.NewSource(seed))
+	fkrV4.SetRandomSource(rand.NewSource(random.Int63()))
+	fkrV4.SetCryptoSource(rand.New(rand.NewSource(random.Int63())))
+	return &generator{
+		random:      random,
+		codec:       encoder,
+		queue:       cfg.QueueName,
+		subject:     cfg.Producer.Subject,
+		payloadSize: cfg.Producer.PayloadSize,
+	}, nil
+}
+
+// next returns the message of sequence.
+func (g *generator) next(sequence int64) (*nats.Msg, localStructs.DataLogin, error) {
+	id, err := uuid.NewRandomFromReader(g.random)
+	if err != nil {
+		return nil, localStructs.DataLogin{}, err
+	}
+	user := localStructs.DataLogin{
+		UUID:      id.String(),
+		Username:  fkrV4.Username(),
+		Password:  fkrV4.Password(),
+		Timestamp: time.Now().UnixMilli(),
+		Sequence:  sequence,
+	}
+
+	payload, err := g.pad(user)
+	if err != nil {
+		return nil, user, err
+	}
+
+	msg := nats.NewMsg(strings.NewReplacer(
+		"{queue}", g.queue,
+		"{uuid}", user.UUID,
+		"{sequence}", strconv.FormatInt(sequence, 10),
+		"{username}", user.Username,
+	).Replace(g.subject))
+	msg.Data = payload
+	msg.Header.Set(codec.Header, g.codec.ContentType())
+	schema.Stamp(msg.Header, user)
+	return msg, user, nil
+}
+
+// pad encodes user, with a padding field bringing it to payloadSize when it
+// is shorter. The size of the field header depends on the codec and on the
+// padding length, it is measured and the padding corrected once.
+func (g *generator) pad(user localStructs.DataLogin) ([]byte, error) {
+	payload, err := g.codec.Marshal(user)
+	if err != nil || len(payload) >= g.payloadSize {
+		return payload, err
+	}
+	padding := g.payloadSize - len(payload)
+	for range 2 {
+		padded, err := g.codec.Marshal(&paddedLogin{DataLogin: user, Padding: strings.Repeat("x", padding)})
+		if err != nil {
+			return nil, err
+		}
+		payload = padded
+		if len(padded) == g.payloadSize || padding <= len(padded)-g.payloadSize {
+			break
+		}
+		padding -= len(padded) - g.payloadSize
+	}
+	return payload, nil
+}
@@ -1,120 +1,172 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"flag"
 	"fmt"
+	"io"
+	"os"
+	"os/signal"
 	"runtime"
-	"sync/atomic"
+	"sync"
+	"syscall"
 	"time"
 
 	localSetup "ganesh.provengo.io/internal/setup"
-	localStructs "ganesh.provengo.io/internal/structs"
-	fkrV4 "github.com/go-faker/faker/v4"
-	"github.com/google/uuid"
-	"github.com/nats-io/nats.go"
-	"log"
-
-	"sync"
+	localLogging "ganesh.provengo.io/pkg/logging"
+	localMetrics "ganesh.provengo.io/pkg/metrics"
+	localTracing "ganesh.provengo.io/pkg/tracing"
 )
 
-const (
-	remoteQueue = localSetup.QueueName
-	totalTasks  = localSetup.TotalTasks
-)
-
-func GenerateUsers(total int) []localStructs.DataLogin {
-	var users []localStructs.DataLogin
-	for i := 0; i < total; i++ {
-		UniqueUser := uuid.New().String()
-		users = append(users, localStructs.DataLogin{
-			UUID:      UniqueUser,
-			Username:  fkrV4.Username(),
-			Password:  fkrV4.Password(),
-			Timestamp: time.Now().UnixMilli(),
-			Sequence:  int64(i),
-		})
-	}
-	return users
-}
+const component = "producer"
+
+// schedule generates the messages in sequence order and hands them to the
+// publishers, at the configured rate, until the count is reached or ctx is
+// done.
+func schedule(ctx context.Context, cfg localSetup.Producer, gen *generator, jobs chan<- job) {
+	defer close(jobs)
+	logger := localLogging.Component("generator")
+	start := time.Now()
+	for n := 0; cfg.Count == 0 || n < cfg.Count; n++ {
+		if cfg.Rate > 0 {
+			intended := start.Add(time.Duration(float64(n) / float64(cfg.Rate) * float64(time.Second)))
+			if wait := time.Until(intended); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
 
-func GoUsers(reqChan chan localStructs.DataLogin, totalUsers *uint32) {
-	totalMessages := 0
-	for _, value := range GenerateUsers(localSetup.UsersGenerate) {
-		reqChan <- value
-		_ = value
-		totalMessages += 1
-		atomic.AddUint32(totalUsers, 1)
+		msg, user, err := gen.next(int64(n + 1))
+		if err != nil {
+			localLogging.Fatal(localLogging.Message(logger, user), "error generating message", "error", err)
+		}
+		select {
+		case jobs <- job{msg: msg, user: user}:
+		case <-ctx.Done():
+			return
+		}
 	}
+}
 
-	log.Printf("%d users generated", totalMessages)
+type summary struct {
+	cfg     localSetup.Producer
+	seed    int64
+	elapsed time.Duration
+	*stats
 }
 
-func NatsWorker(idGg int, reqChannel chan localStructs.DataLogin, wg *sync.WaitGroup, totalMessages *uint32) {
-	log.Printf("Starting NATS worker: %d\n", idGg)
-	nc, err := nats.Connect(nats.DefaultURL)
+func (s summary) Print(w io.Writer) {
+	fmt.Fprintf(w, "Messages: %d Failed: %d Elapsed Time: %v Seed: %d\n", s.published, s.failed, s.elapsed.Round(time.Millisecond), s.seed)
+	rate, throughput := 0.0, 0.0
+	if s.elapsed > 0 {
+		rate = float64(s.published) / s.elapsed.Seconds()
+		throughput = float64(s.bytes) / s.elapsed.Seconds() / (1 << 20)
+	}
+	fmt.Fprintf(w, "Throughput: %.1f msg/s %.2f MiB/s", rate, throughput)
+	if s.cfg.Rate > 0 {
+		fmt.Fprintf(w, " Target: %d msg/s", s.cfg.Rate)
+	}
+	fmt.Fprintln(w)
 
-	if err != nil {
-		log.Fatal("error connecting to NATS")
+	name := "Publish Latency"
+	if s.cfg.JetStream {
+		name = "Ack Latency"
 	}
+	ms := func(v int64) float64 { return float64(v) / 1000 }
+	h := s.latency
+	fmt.Fprintf(w, "%s (ms): mean %.3f p50 %.3f p90 %.3f p99 %.3f p99.9 %.3f max %.3f\n", name, h.Mean()/1000,
+		ms(h.ValueAtPercentile(50)), ms(h.ValueAtPercentile(90)), ms(h.ValueAtPercentile(99)), ms(h.ValueAtPercentile(99.9)), ms(h.Max()))
+}
 
-	defer func() {
-		wg.Done()
-	}()
+func runProducer(ctx context.Context, cfg *localSetup.Config) summary {
+	logger := localLogging.Component(component)
+	seed := cfg.Producer.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
 
-	for req := range reqChannel {
-		msg, err := json.Marshal(&req)
+	publishers := make([]*publisher, cfg.Producer.Concurrency)
+	for i := range publishers {
+		p, err := newPublisher(i, cfg)
 		if err != nil {
-			log.Fatal("Error marshalling data:", err)
+			localLogging.Fatal(logger, "error starting publisher", "error", err)
 		}
+		publishers[i] = p
+	}
 
-		subject := fmt.Sprintf("%s.%s", remoteQueue, req.UUID)
-		err = nc.Publish(subject, msg)
-		if err != nil {
-			log.Fatal("Error publishing message to NATS", err)
-		}
-		atomic.AddUint32(totalMessages, 1)
+	if cfg.Producer.Duration.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Producer.Duration.Duration)
+		defer cancel()
 	}
-}
 
-func startWorkTasks(wg *sync.WaitGroup, reqChannel chan localStructs.DataLogin, totalMesssages *uint32) {
-	for i := 0; i < totalTasks; i++ {
-		wg.Add(1)
-		go NatsWorker(i, reqChannel, wg, totalMesssages)
+	logger.Info("publishing", "count", cfg.Producer.Count, "duration", cfg.Producer.Duration.Duration, "rate", cfg.Producer.Rate,
+		"concurrency", cfg.Producer.Concurrency, "subject", cfg.Producer.Subject, "jetstream", cfg.Producer.JetStream, "codec", cfg.Producer.Codec, "seed", seed)
+	gen, err := newGenerator(cfg, seed)
+	if err != nil {
+		localLogging.Fatal(logger, "error creating generator", "error", err)
 	}
-	defer func() {
-		wg.Done()
-	}()
-}
+	jobs := make(chan job, cfg.Producer.Concurrency)
+	start := time.Now()
+	go schedule(ctx, cfg.Producer, gen, jobs)
 
-func runningServer() {
 	wg := sync.WaitGroup{}
-	loginQueue := make(chan localStructs.DataLogin)
-	var totalMessages uint32
-	var totalUsers uint32
-
-	wg.Add(1)
-	go startWorkTasks(&wg, loginQueue, &totalMessages)
-
-	for i := 0; i < 4; i++ {
-		GoUsers(loginQueue, &totalUsers)
+	for _, p := range publishers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.run(jobs)
+		}()
 	}
+	wg.Wait()
 
-	//WAITING FOR ALL MESSAGES HAS BEEN SENT BEFORE CLOSE CHANNEL
-	for {
-		if totalMessages == totalUsers {
-			close(loginQueue)
-			break
-		}
-		time.Sleep(100 * time.Millisecond)
+	total := summary{cfg: cfg.Producer, seed: seed, elapsed: time.Since(start), stats: newStats()}
+	for _, p := range publishers {
+		total.merge(p.stats)
 	}
-
-	defer func() {
-		fmt.Printf("Total Messages: %d\n", totalMessages)
-		fmt.Printf("Total Users: %d\n", totalUsers)
-	}()
+	return total
 }
 
 func main() {
+	cfg, err := localSetup.Load(localSetup.BinaryProducer, flag.NewFlagSet("producer", flag.ExitOnError), os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading configuration: %v\n", err)
+		os.Exit(1)
+	}
+	logger := localLogging.Init(cfg.Logging, "ganesh-"+component)
+
+	shutdownTracing, err := localTracing.Init(context.Background(), cfg.Tracing, "ganesh-"+component)
+	if err != nil {
+		localLogging.Fatal(logger, "error initializing tracing", "error", err)
+	}
+
 	runtime.GOMAXPROCS(2)
-	runningServer()
+	metricsServer, err := localMetrics.Serve(cfg.Metrics.Port, cfg.Metrics.LogLevelEndpoint)
+	if err != nil {
+		localLogging.Fatal(logger, "error starting the metrics server", "error", err)
+	}
+
+	// SIGINT stops the run early, the summary covers what was published.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	result := runProducer(ctx, cfg)
+	result.Print(os.Stdout)
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if metricsServer != nil {
+		_ = metricsServer.Shutdown(flushCtx)
+	}
+	if err := shutdownTracing(flushCtx); err != nil {
+		logger.Error("error flushing spans", "error", err)
+	}
+	if result.failed > 0 {
+		os.Exit(1)
+	}
 }
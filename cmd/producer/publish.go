@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	localSetup "ganesh.provengo.io/internal/setup"
+	localStructs "ganesh.provengo.io/internal/structs"
+	localLogging "ganesh.provengo.io/pkg/logging"
+	localMetrics "ganesh.provengo.io/pkg/metrics"
+	localTracing "ganesh.provengo.io/pkg/tracing"
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type job struct {
+	msg  *nats.Msg
+	user localStructs.DataLogin
+}
+
+// stats are kept by each publisher and merged at the end. Latencies are in
+// microseconds: the publish call for core NATS, up to the ack for JetStream.
+type stats struct {
+	published int64
+	failed    int64
+	bytes     int64
+	latency   *hdrhistogram.Histogram
+}
+
+func newStats() *stats {
+	return &stats{latency: hdrhistogram.New(1, int64(time.Hour/time.Microsecond), 3)}
+}
+
+func (s *stats) merge(other *stats) {
+	s.published += other.published
+	s.failed += other.failed
+	s.bytes += other.bytes
+	s.latency.Merge(other.latency)
+}
+
+type publisher struct {
+	id     int
+	cfg    localSetup.Producer
+	nc     *nats.Conn
+	js     jetstream.JetStream
+	stats  *stats
+	logger *slog.Logger
+	// errors logs the first failure at warning level, the others at debug
+	errors int64
+}
+
+func newPublisher(id int, cfg *localSetup.Config) (*publisher, error) {
+	p := &publisher{
+		id:     id,
+		cfg:    cfg.Producer,
+		stats:  newStats(),
+		logger: localLogging.Component("nats").With("worker", id),
+	}
+	nc, err := nats.Connect(cfg.Nats.URL, nats.Name(fmt.Sprintf("ganesh-%s-%d", component, id)))
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to NATS: %w", err)
+	}
+	p.nc = nc
+	if cfg.Producer.JetStream {
+		if p.js, err = jetstream.New(nc, jetstream.WithPublishAsyncMaxPending(cfg.Producer.MaxPending)); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("error creating jetstream context: %w", err)
+		}
+	}
+	return p, nil
+}
+
+func (p *publisher) done(j job, span trace.Span, start time.Time, err error) {
+	localTracing.End(span, err)
+	if err != nil {
+		p.stats.failed++
+		localMetrics.MessagesFailed.WithLabelValues(component, "publish").Inc()
+		level := slog.LevelDebug
+		if p.errors++; p.errors == 1 {
+			level = slog.LevelWarn
+		}
+		localLogging.Message(p.logger, j.user).Log(context.Background(), level, "error publishing message", "subject", j.msg.Subject, "error", err)
+		return
+	}
+	elapsed := time.Since(start)
+	p.stats.published++
+	p.stats.bytes += int64(len(j.msg.Data))
+	_ = p.stats.latency.RecordValue(max(elapsed.Microseconds(), 1))
+	localMetrics.PublishLatency.WithLabelValues(component).Observe(elapsed.Seconds())
+	localMetrics.MessagesPublished.WithLabelValues(component).Inc()
+}
+
+// run publishes the jobs until the channel is closed and every message is
+// flushed or acknowledged.
+func (p *publisher) run(jobs <-chan job) {
+	defer p.nc.Close()
+	if p.js != nil {
+		p.runJetStream(jobs)
+	} else {
+		p.runCore(jobs)
+	}
+	if p.errors > 1 {
+		p.logger.Warn("messages not published", "failed", p.errors)
+	}
+}
+
+func (p *publisher) runCore(jobs <-chan job) {
+	for j := range jobs {
+		_, span := localTracing.StartPublish(context.Background(), j.msg)
+		start := time.Now()
+		p.done(j, span, start, p.nc.PublishMsg(j.msg))
+	}
+	if err := p.nc.FlushTimeout(p.cfg.AckTimeout.Duration); err != nil {
+		p.logger.Error("error flushing messages", "error", err)
+	}
+}
+
+type inflight struct {
+	job    job
+	span   trace.Span
+	start  time.Time
+	future jetstream.PubAckFuture
+}
+
+func (p *publisher) runJetStream(jobs <-chan job) {
+	pending := make(chan inflight, p.cfg.MaxPending)
+	acked := make(chan struct{})
+	// Acks arrive in publish order, waiting for them in turn measures each
+	// one without a goroutine per message.
+	go func() {
+		defer close(acked)
+		for f := range pending {
+			timeout := time.NewTimer(time.Until(f.start.Add(p.cfg.AckTimeout.Duration)))
+			select {
+			case <-f.future.Ok():
+				p.done(f.job, f.span, f.start, nil)
+			case err := <-f.future.Err():
+				p.done(f.job, f.span, f.start, err)
+			case <-timeout.C:
+				p.done(f.job, f.span, f.start, context.DeadlineExceeded)
+			}
+			timeout.Stop()
+		}
+	}()
+
+	for j := range jobs {
+		j.msg.Header.Set(jetstream.MsgIDHeader, nuid.Next())
+		_, span := localTracing.StartPublish(context.Background(), j.msg)
+		start := time.Now()
+		// Past MaxPending outstanding acks the publish stalls, up to the
+		// ack timeout, until the oldest one arrives.
+		future, err := p.js.PublishMsgAsync(j.msg, jetstream.WithStallWait(p.cfg.AckTimeout.Duration))
+		if err != nil {
+			// The failure is recorded in order with the acks.
+			future = failedFuture{err: err}
+		}
+		pending <- inflight{job: j, span: span, start: start, future: future}
+	}
+	close(pending)
+	<-acked
+}
+
+// failedFuture stands for a publish that never reached the broker.
+type failedFuture struct {
+	jetstream.PubAckFuture
+	err error
+}
+
+func (f failedFuture) Ok() <-chan *jetstream.PubAck { return nil }
+
+func (f failedFuture) Err() <-chan error {
+	errs := make(chan error, 1)
+	errs <- f.err
+	return errs
+}
@@ -3,12 +3,14 @@ package encrypt
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"io"
 
 	"golang.org/x/crypto/bcrypt"
@@ -77,6 +79,9 @@ func DecryptString(ciphertext string, key string) (string, error) {
 	}
 
 	nonceSize := aesGCM.NonceSize()
+	if len(data) < nonceSize {
+		return "", errors.New("ciphertext too short")
+	}
 	nonce, ciphertext := data[:nonceSize], string(data[nonceSize:])
 
 	plaintext, err := aesGCM.Open(nil, nonce, []byte(ciphertext), nil)
@@ -86,3 +91,22 @@ func DecryptString(ciphertext string, key string) (string, error) {
 
 	return string(plaintext), nil
 }
+
+// SignHMAC returns the hex encoded HMAC-SHA256 of data keyed with key.
+func SignHMAC(data []byte, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyHMAC reports whether signature is the hex HMAC-SHA256 of data keyed
+// with key. The comparison takes constant time.
+func VerifyHMAC(data []byte, key string, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(data)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
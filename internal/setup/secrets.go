@@ -0,0 +1,171 @@
+package setup
+
+import (
+	"errors"
+	"fmt"
+	localEncrypt "ganesh.provengo.io/internal/encrypt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Any string in the configuration may hold a value produced by
+// EncryptValue. Those are decrypted in place by Load using the master key.
+
+const (
+	SecretPrefix     = "enc:"
+	EnvMasterKey     = "GANESH_MASTER_KEY"
+	EnvMasterKeyFile = "GANESH_MASTER_KEY_FILE"
+)
+
+var secretPattern = regexp.MustCompile(`enc:[A-Za-z0-9+/]+=*`)
+
+type Secrets struct {
+	KeyFile string `yaml:"key_file" toml:"key_file"`
+}
+
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, SecretPrefix)
+}
+
+func validateKey(key string) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	}
+	return fmt.Errorf("master key must be 16, 24 or 32 bytes long, got %d", len(key))
+}
+
+// MasterKey reads the key from keyFile when one is given, so that an
+// explicit -master-key-file or -key-file wins over the environment, and
+// falls back to GANESH_MASTER_KEY, then to the file named by
+// GANESH_MASTER_KEY_FILE.
+func MasterKey(keyFile string) (string, error) {
+	if keyFile == "" {
+		if key, ok := os.LookupEnv(EnvMasterKey); ok && key != "" {
+			key = strings.TrimSpace(key)
+			return key, validateKey(key)
+		}
+		keyFile = os.Getenv(EnvMasterKeyFile)
+	}
+	if keyFile == "" {
+		return "", fmt.Errorf("master key not found, set %s or %s", EnvMasterKey, EnvMasterKeyFile)
+	}
+
+	raw, err := os.ReadFile(keyFile)
+	if err != nil {
+		return "", fmt.Errorf("error reading master key file: %w", err)
+	}
+	key := strings.TrimSpace(string(raw))
+	return key, validateKey(key)
+}
+
+func EncryptValue(plaintext string, key string) (string, error) {
+	if err := validateKey(key); err != nil {
+		return "", err
+	}
+	ciphertext, err := localEncrypt.EncryptString(plaintext, key)
+	if err != nil {
+		return "", fmt.Errorf("error encrypting value: %w", err)
+	}
+	return SecretPrefix + ciphertext, nil
+}
+
+func DecryptValue(value string, key string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	if err := validateKey(key); err != nil {
+		return "", err
+	}
+	plaintext, err := localEncrypt.DecryptString(strings.TrimPrefix(value, SecretPrefix), key)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting value: %w", err)
+	}
+	return plaintext, nil
+}
+
+// RotateText re-encrypts every secret found in text with newKey, keeping the
+// rest of the document untouched. It returns the number of rotated values.
+func RotateText(text string, oldKey string, newKey string) (string, int, error) {
+	var errs []error
+	total := 0
+
+	rotated := secretPattern.ReplaceAllStringFunc(text, func(value string) string {
+		plaintext, err := DecryptValue(value, oldKey)
+		if err != nil {
+			errs = append(errs, err)
+			return value
+		}
+		encrypted, err := EncryptValue(plaintext, newKey)
+		if err != nil {
+			errs = append(errs, err)
+			return value
+		}
+		total++
+		return encrypted
+	})
+
+	if len(errs) > 0 {
+		return "", 0, errors.Join(errs...)
+	}
+	return rotated, total, nil
+}
+
+func (c *Config) decryptSecrets() error {
+	var key string
+	var errs []error
+
+	walkStrings(reflect.ValueOf(c).Elem(), "", func(path string, value reflect.Value) {
+		if !IsEncrypted(value.String()) {
+			return
+		}
+		if key == "" {
+			var err error
+			key, err = MasterKey(c.Secrets.KeyFile)
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+		}
+		plaintext, err := DecryptValue(value.String(), key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			return
+		}
+		value.SetString(plaintext)
+	})
+
+	return errors.Join(errs...)
+}
+
+func walkStrings(value reflect.Value, path string, visit func(path string, value reflect.Value)) {
+	switch value.Kind() {
+	case reflect.String:
+		if value.CanSet() {
+			visit(path, value)
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			if !value.Type().Field(i).IsExported() {
+				continue
+			}
+			walkStrings(value.Field(i), strings.TrimPrefix(path+"."+value.Type().Field(i).Name, "."), visit)
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			walkStrings(value.Index(i), fmt.Sprintf("%s[%d]", path, i), visit)
+		}
+	case reflect.Map:
+		if value.Type().Elem().Kind() != reflect.String {
+			return
+		}
+		for _, k := range value.MapKeys() {
+			item := reflect.New(value.Type().Elem()).Elem()
+			item.Set(value.MapIndex(k))
+			walkStrings(item, fmt.Sprintf("%s[%v]", path, k), visit)
+			value.SetMapIndex(k, item)
+		}
+	}
+}
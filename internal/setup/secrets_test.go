@@ -0,0 +1,213 @@
+package setup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMasterKeyPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, key string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(key+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	explicit := write("explicit.key", "0123456789abcdef")
+	fromEnv := write("env.key", "fedcba9876543210")
+
+	tests := []struct {
+		name    string
+		keyFile string
+		key     string
+		file    string
+		want    string
+	}{
+		{"key file over env", explicit, "ffffffffffffffff", fromEnv, "0123456789abcdef"},
+		{"env key without key file", "", "ffffffffffffffff", fromEnv, "ffffffffffffffff"},
+		{"env key file last", "", "", fromEnv, "fedcba9876543210"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(EnvMasterKey, tt.key)
+			t.Setenv(EnvMasterKeyFile, tt.file)
+			got, err := MasterKey(tt.keyFile)
+			if err != nil || got != tt.want {
+				t.Errorf("MasterKey(%q) = %q, %v; want %q", tt.keyFile, got, err, tt.want)
+			}
+		})
+	}
+
+	t.Setenv(EnvMasterKey, "")
+	t.Setenv(EnvMasterKeyFile, "")
+	if _, err := MasterKey(""); err == nil {
+		t.Error("MasterKey without any key succeeded")
+	}
+}
+
+const (
+	testKey  = "0123456789abcdef"
+	otherKey = "fedcba9876543210"
+)
+
+func encrypt(t *testing.T, plaintext, key string) string {
+	t.Helper()
+	value, err := EncryptValue(plaintext, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestEncryptDecryptValue(t *testing.T) {
+	for _, plaintext := range []string{"", "secret", "postgres://postgres:s3cr3t@db:5432/ganesh", "ünïcødé 名前"} {
+		value := encrypt(t, plaintext, testKey)
+		if !IsEncrypted(value) {
+			t.Fatalf("%q encrypted without the %s prefix: %q", plaintext, SecretPrefix, value)
+		}
+		if got, err := DecryptValue(value, testKey); err != nil || got != plaintext {
+			t.Errorf("DecryptValue(EncryptValue(%q)) = %q, %v", plaintext, got, err)
+		}
+	}
+
+	value := encrypt(t, "secret", testKey)
+	tampered := []byte(value)
+	i := len(SecretPrefix) + (len(value)-len(SecretPrefix))/2
+	if tampered[i] == 'A' {
+		tampered[i] = 'B'
+	} else {
+		tampered[i] = 'A'
+	}
+	tests := []struct {
+		name  string
+		value string
+		key   string
+	}{
+		{"wrong key", value, otherKey},
+		{"tampered ciphertext", string(tampered), testKey},
+		{"truncated ciphertext", value[:len(SecretPrefix)+8], testKey},
+		{"short key", value, "short"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := DecryptValue(tt.value, tt.key); err == nil {
+				t.Errorf("DecryptValue() = %q, want an error", got)
+			}
+		})
+	}
+
+	if got, err := DecryptValue("plain", ""); err != nil || got != "plain" {
+		t.Errorf("DecryptValue of a plain value = %q, %v", got, err)
+	}
+}
+
+func TestRotateText(t *testing.T) {
+	first, second := encrypt(t, "first", testKey), encrypt(t, "second", testKey)
+	text := "# enc: values below\npostgres:\n  url: " + first + "\n\nclients: {a: " + second + ", b: plain}\nencore: " + first + "\n"
+
+	tests := []struct {
+		name   string
+		text   string
+		oldKey string
+		total  int
+		fails  bool
+	}{
+		{"every occurrence", text, testKey, 3, false},
+		{"no secret", "queue_name: users\n", testKey, 0, false},
+		{"wrong old key", text, otherKey, 0, true},
+		{"corrupt value", "url: enc:AAAAAAAAAAAAAAAAAAAAAAAA\n", testKey, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rotated, total, err := RotateText(tt.text, tt.oldKey, otherKey)
+			if tt.fails {
+				if err == nil {
+					t.Fatalf("RotateText() rotated %d values, want an error", total)
+				}
+				return
+			}
+			if err != nil || total != tt.total {
+				t.Fatalf("RotateText() = %d, %v; want %d", total, err, tt.total)
+			}
+
+			before, after := secretPattern.Split(tt.text, -1), secretPattern.Split(rotated, -1)
+			if strings.Join(before, "|") != strings.Join(after, "|") {
+				t.Errorf("text around the secrets changed:\n%q\n%q", tt.text, rotated)
+			}
+			olds, news := secretPattern.FindAllString(tt.text, -1), secretPattern.FindAllString(rotated, -1)
+			for i := range news {
+				want, _ := DecryptValue(olds[i], tt.oldKey)
+				if got, err := DecryptValue(news[i], otherKey); err != nil || got != want {
+					t.Errorf("secret %d: %q, %v; want %q with the new key", i, got, err, want)
+				}
+				if _, err := DecryptValue(news[i], tt.oldKey); err == nil {
+					t.Errorf("secret %d still decrypts with the old key", i)
+				}
+			}
+		})
+	}
+}
+
+func TestDecryptSecrets(t *testing.T) {
+	postgresURL := "postgres://postgres:s3cr3t@db:5432/ganesh"
+	redisURL := "redis://:s3cr3t@cache:6379"
+
+	tests := []struct {
+		name   string
+		binary Binary
+		file   string
+		env    map[string]string
+		get    func(cfg *Config) string
+		want   string
+		err    string
+	}{
+		{
+			name: "struct field", binary: BinaryConsumer,
+			file: "postgres:\n  url: " + encrypt(t, postgresURL, testKey) + "\n",
+			env:  map[string]string{EnvMasterKey: testKey},
+			get:  func(cfg *Config) string { return cfg.Postgres.URL }, want: postgresURL,
+		},
+		{
+			name: "map value", binary: BinaryHTTPServer,
+			file: "http_server:\n  signing:\n    clients:\n      loadtest: " + encrypt(t, "client-secret", testKey) + "\n",
+			env:  map[string]string{EnvMasterKey: testKey},
+			get:  func(cfg *Config) string { return cfg.HTTPServer.Signing.Clients["loadtest"] }, want: "client-secret",
+		},
+		{
+			name: "env override", binary: BinaryConsumer,
+			env: map[string]string{EnvMasterKey: testKey, EnvRedisURL: encrypt(t, redisURL, testKey)},
+			get: func(cfg *Config) string { return cfg.Redis.URL }, want: redisURL,
+		},
+		{
+			name: "no master key", binary: BinaryConsumer,
+			file: "postgres:\n  url: " + encrypt(t, postgresURL, testKey) + "\n",
+			err:  "master key not found",
+		},
+		{
+			name: "wrong master key", binary: BinaryConsumer,
+			file: "postgres:\n  url: " + encrypt(t, postgresURL, testKey) + "\n",
+			env:  map[string]string{EnvMasterKey: otherKey},
+			err:  "Postgres.URL",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := load(t, tt.binary, tt.file, tt.env)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Load() = %v, want an error about %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.get(cfg); got != tt.want {
+				t.Errorf("decrypted %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package setup
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// load runs Load for binary with a config file holding file (none when
+// empty), the environment env and the command line args, everything else
+// unset.
+func load(t *testing.T, binary Binary, file string, env map[string]string, args ...string) (*Config, error) {
+	t.Helper()
+	for _, name := range []string{EnvConfigFile, EnvNatsURL, EnvPostgresURL, EnvRedisURL, EnvLogLevel, EnvMasterKey, EnvMasterKeyFile} {
+		t.Setenv(name, env[name])
+	}
+	if file != "" {
+		path := filepath.Join(t.TempDir(), "ganesh.yaml")
+		if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		args = append([]string{"-config", path}, args...)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return Load(binary, fs, args)
+}
+
+func TestLoadLayers(t *testing.T) {
+	const file = `
+nats:
+  url: nats://file:4222
+logging:
+  level: warn
+consumer:
+  tasks: 7
+`
+	tests := []struct {
+		name  string
+		file  string
+		env   map[string]string
+		args  []string
+		nats  string
+		level string
+		tasks int
+	}{
+		{name: "defaults", nats: "nats://localhost:4222", level: "info", tasks: Default().Consumer.Tasks},
+		{name: "file over defaults", file: file, nats: "nats://file:4222", level: "warn", tasks: 7},
+		{
+			name: "env over file", file: file,
+			env:  map[string]string{EnvNatsURL: "nats://env:4222", EnvLogLevel: "ERROR"},
+			nats: "nats://env:4222", level: "error", tasks: 7,
+		},
+		{
+			name: "flags over env", file: file,
+			env:  map[string]string{EnvNatsURL: "nats://env:4222", EnvLogLevel: "error"},
+			args: []string{"-nats-url", "nats://flag:4222", "-consumer-tasks", "3"},
+			nats: "nats://flag:4222", level: "error", tasks: 3,
+		},
+		{
+			name: "empty env is ignored", file: file,
+			env:  map[string]string{EnvNatsURL: ""},
+			nats: "nats://file:4222", level: "warn", tasks: 7,
+		},
+		{
+			name: "flag set to its default still overrides", file: file,
+			args: []string{"-nats-url", "nats://localhost:4222"},
+			nats: "nats://localhost:4222", level: "warn", tasks: 7,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := load(t, BinaryConsumer, tt.file, tt.env, tt.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Nats.URL != tt.nats || cfg.Logging.Level != tt.level || cfg.Consumer.Tasks != tt.tasks {
+				t.Errorf("got nats %q, level %q, tasks %d; want %q, %q, %d", cfg.Nats.URL, cfg.Logging.Level, cfg.Consumer.Tasks, tt.nats, tt.level, tt.tasks)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileFromEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ganesh.toml")
+	if err := os.WriteFile(path, []byte("queue_name = \"from.toml\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := load(t, BinaryConsumer, "", map[string]string{EnvConfigFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.QueueName != "from.toml" {
+		t.Errorf("queue_name %q, want from.toml", cfg.QueueName)
+	}
+}
+
+func TestLoadFlagsParseNakBackoff(t *testing.T) {
+	cfg, err := load(t, BinaryConsumer, "", nil, "-jetstream-backoff", "2s, 1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backoff := cfg.Consumer.JetStream.NakBackoff
+	if len(backoff) != 2 || backoff[0].Duration != 2*time.Second || backoff[1].Duration != time.Minute {
+		t.Errorf("nak_backoff %v", backoff)
+	}
+	if _, err := load(t, BinaryConsumer, "", nil, "-jetstream-backoff", "soon"); err == nil {
+		t.Error("invalid -jetstream-backoff accepted")
+	}
+}
+
+func TestLogLevelEndpointIsOptIn(t *testing.T) {
+	if Default().Metrics.LogLevelEndpoint {
+		t.Fatal("/log-level enabled by default")
+	}
+	cfg, err := load(t, BinaryConsumer, "", nil, "-metrics-log-level")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Metrics.LogLevelEndpoint {
+		t.Error("-metrics-log-level did not enable /log-level")
+	}
+}
+
+func TestDefaultIsValid(t *testing.T) {
+	for binary := range binarySections {
+		if err := Default().Validate(binary); err != nil {
+			t.Errorf("%s: %v", binary, err)
+		}
+	}
+}
+
+func TestValidateRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		binary Binary
+		change func(cfg *Config)
+		want   string
+	}{
+		{"empty queue", BinaryHTTPClient, func(c *Config) { c.QueueName = "" }, "queue_name"},
+		{"nats scheme", BinaryProducer, func(c *Config) { c.Nats.URL = "http://localhost:4222" }, "nats.url"},
+		{"postgres scheme", BinaryConsumer, func(c *Config) { c.Postgres.URL = "mysql://localhost" }, "postgres.url"},
+		{"pool bounds", BinaryHTTPServer, func(c *Config) { c.Postgres.MinConns = 10; c.Postgres.MaxConns = 5 }, "postgres: invalid pool size"},
+		{"consumer type", BinaryConsumer, func(c *Config) { c.Consumer.Type = "push" }, "consumer.type"},
+		{"publisher codec", BinaryHTTPServer, func(c *Config) { c.Nats.Publisher.Codec = "xml" }, "nats.publisher.codec"},
+		{"ordering key", BinaryConsumer, func(c *Config) { c.Consumer.Ordering.Key = "email" }, "consumer.ordering.key"},
+		{"sink buffer", BinaryConsumer, func(c *Config) { c.Consumer.Backpressure.Redis.Buffer = 0 }, "consumer.backpressure.redis.buffer"},
+		{"sink policy", BinaryConsumer, func(c *Config) { c.Consumer.Backpressure.Postgres.Policy = "retry" }, "consumer.backpressure.postgres.policy"},
+		{"spill dir", BinaryConsumer, func(c *Config) {
+			c.Consumer.Backpressure.Password.Policy = "spill-to-disk"
+			c.Consumer.Backpressure.SpillDir = ""
+		}, "spill_dir"},
+		{"dedupe window", BinaryConsumer, func(c *Config) { c.Consumer.Idempotency.Window.Duration = -time.Second }, "consumer.idempotency.window"},
+		{"producer subject", BinaryProducer, func(c *Config) { c.Producer.Subject = "users.*" }, "producer.subject"},
+		{"signing without clients", BinaryHTTPServer, func(c *Config) { c.HTTPServer.Signing.Enabled = true }, "http_server.signing.clients"},
+		{"metrics on the http port", BinaryHTTPServer, func(c *Config) { c.Metrics.Port = c.HTTPServer.Port }, "metrics.port"},
+		{"client stages", BinaryHTTPClient, func(c *Config) {
+			c.HTTPClient.Mode = "open"
+			c.HTTPClient.Stages = []Stage{{Target: -1}}
+		}, "http_client.stages[0]"},
+		{"log level", BinaryProducer, func(c *Config) { c.Logging.Level = "verbose" }, "logging.level"},
+		{"metrics port", BinaryConsumer, func(c *Config) { c.Metrics.Port = 70000 }, "metrics.port"},
+		{"unknown binary", "ganesh", func(c *Config) {}, "unknown binary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			tt.change(cfg)
+			err := cfg.Validate(tt.binary)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Validate(%s) = %v, want an error about %s", tt.binary, err, tt.want)
+			}
+		})
+	}
+}
+
+// A consumer does not fail on the sections only other binaries use.
+func TestLoadIgnoresOtherBinariesSections(t *testing.T) {
+	const file = `
+metrics:
+  port: 8080
+producer:
+  subject: "users.*"
+http_server:
+  port: 8080
+  signing:
+    enabled: true
+  bulk:
+    max_records: 0
+http_client:
+  mode: open
+  stages:
+    - duration: 10s
+      target: -1
+`
+	if _, err := load(t, BinaryConsumer, file, nil); err != nil {
+		t.Fatalf("consumer: %v", err)
+	}
+	_, err := load(t, BinaryHTTPServer, file, nil)
+	for _, want := range []string{"http_server.signing.clients", "http_server.bulk", "metrics.port"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("http_server: Load() = %v, want an error about %s", err, want)
+		}
+	}
+}
+
+func TestLoadRegistersTheBinaryFlags(t *testing.T) {
+	if _, err := load(t, BinaryConsumer, "", nil, "-port", "8081"); err == nil {
+		t.Error("consumer accepted the http_server -port flag")
+	}
+	cfg, err := load(t, BinaryHTTPServer, "", nil, "-port", "8081", "-redis-url", "redis://cache:6379")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.HTTPServer.Port != 8081 || cfg.Redis.URL != "redis://cache:6379" {
+		t.Errorf("port %d, redis %q", cfg.HTTPServer.Port, cfg.Redis.URL)
+	}
+}
+
+func TestLoadRejectsInvalidFlag(t *testing.T) {
+	if _, err := load(t, BinaryConsumer, "", nil, "-consumer-type", "push"); err == nil || !strings.Contains(err.Error(), "consumer.type") {
+		t.Errorf("Load() = %v, want a consumer.type error", err)
+	}
+	if _, err := load(t, BinaryConsumer, "", nil, "-consumer-tasks", "many"); err == nil {
+		t.Error("non numeric -consumer-tasks accepted")
+	}
+}
@@ -0,0 +1,87 @@
+package LocalStructs
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of datalogin.proto.
+const (
+	protoUsername  protowire.Number = 1
+	protoPassword  protowire.Number = 2
+	protoUUID      protowire.Number = 3
+	protoTimestamp protowire.Number = 4
+	protoSequence  protowire.Number = 5
+)
+
+// AppendProto appends d in the protobuf wire format of datalogin.proto.
+// Zero values are left out like proto3 does.
+func (d DataLogin) AppendProto(b []byte) []byte {
+	for _, field := range []struct {
+		number protowire.Number
+		value  string
+	}{{protoUsername, d.Username}, {protoPassword, d.Password}, {protoUUID, d.UUID}} {
+		if field.value != "" {
+			b = protowire.AppendTag(b, field.number, protowire.BytesType)
+			b = protowire.AppendString(b, field.value)
+		}
+	}
+	if d.Timestamp != 0 {
+		b = protowire.AppendTag(b, protoTimestamp, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(d.Timestamp))
+	}
+	if d.Sequence != 0 {
+		b = protowire.AppendTag(b, protoSequence, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(d.Sequence))
+	}
+	return b
+}
+
+// UnmarshalProto decodes the protobuf wire format of datalogin.proto into d,
+// skipping unknown fields.
+func (d *DataLogin) UnmarshalProto(b []byte) error {
+	*d = DataLogin{}
+	for len(b) > 0 {
+		number, wireType, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("protobuf: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		switch {
+		case wireType == protowire.BytesType && (number == protoUsername || number == protoPassword || number == protoUUID):
+			value, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return fmt.Errorf("protobuf field %d: %w", number, protowire.ParseError(n))
+			}
+			switch number {
+			case protoUsername:
+				d.Username = value
+			case protoPassword:
+				d.Password = value
+			default:
+				d.UUID = value
+			}
+			b = b[n:]
+		case wireType == protowire.VarintType && (number == protoTimestamp || number == protoSequence):
+			value, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return fmt.Errorf("protobuf field %d: %w", number, protowire.ParseError(n))
+			}
+			if number == protoTimestamp {
+				d.Timestamp = int64(value)
+			} else {
+				d.Sequence = int64(value)
+			}
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(number, wireType, b)
+			if n < 0 {
+				return fmt.Errorf("protobuf field %d: %w", number, protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package LocalStructs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"ganesh.provengo.io/pkg/schema"
+	"github.com/google/uuid"
+)
+
+// DataLoginVersion is the version of DataLogin published today. Version 1
+// is the unversioned layout, with the same fields but published before the
+// consumer checked them.
+const DataLoginVersion = 2
+
+// DataLoginV1 is a DataLogin published without schema headers.
+type DataLoginV1 DataLogin
+
+func (d *DataLoginV1) UnmarshalProto(b []byte) error {
+	return (*DataLogin)(d).UnmarshalProto(b)
+}
+
+// DataLoginSchema decodes every version of DataLogin and rejects the
+// messages failing DataLogin.Validate.
+var DataLoginSchema = schema.New("datalogin", DataLoginVersion, DataLogin.Validate)
+
+func init() {
+	// Version 1 UUIDs were never checked, any form uuid.Parse accepts
+	// (uppercase, braces, urn:uuid:) is brought to the canonical one the
+	// Redis keys and Postgres rows use.
+	schema.Older(DataLoginSchema, 1, func(v DataLoginV1) (any, error) {
+		if id, err := uuid.Parse(v.UUID); err == nil {
+			v.UUID = id.String()
+		}
+		return DataLogin(v), nil
+	})
+	schema.Register(DataLoginSchema)
+}
+
+func (DataLogin) Schema() (string, int) {
+	return DataLoginSchema.Name(), DataLoginVersion
+}
+
+// Validate applies the binding tags of the Gin path to messages from any
+// source, and requires a canonical UUID since it is the key of both sinks.
+// The reasons are joined on one line, like "password: required, uuid:
+// required", to fit the dead-letter headers.
+func (d DataLogin) Validate() error {
+	var reasons []string
+	for _, field := range []struct {
+		name  string
+		empty bool
+	}{
+		{"username", d.Username == ""},
+		{"password", d.Password == ""},
+		{"uuid", d.UUID == ""},
+		{"timestamp", d.Timestamp == 0},
+		{"sequence", d.Sequence == 0},
+	} {
+		if field.empty {
+			reasons = append(reasons, field.name+": required")
+		}
+	}
+	if d.UUID != "" {
+		if id, err := uuid.Parse(d.UUID); err != nil || id.String() != d.UUID {
+			reasons = append(reasons, fmt.Sprintf("uuid: %q is not a canonical UUID", d.UUID))
+		}
+	}
+	if d.Timestamp < 0 {
+		reasons = append(reasons, "timestamp: negative")
+	}
+	if d.Sequence < 0 {
+		reasons = append(reasons, "sequence: negative")
+	}
+	if len(reasons) > 0 {
+		return errors.New(strings.Join(reasons, ", "))
+	}
+	return nil
+}
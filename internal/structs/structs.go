@@ -1,5 +1,7 @@
 package LocalStructs
 
+import "log/slog"
+
 type KeepAlive struct {
 	ClientIP         string `json:"client_ip" binding:"required"`
 	CliendID         string `json:"cliend_id" binding:"required"`
@@ -7,6 +9,16 @@ type KeepAlive struct {
 	RequestSignature string `json:"request_signature" binding:"required"`
 }
 
+// Heartbeat is the last /keep-alive call of a client. LastSeen is in unix
+// milliseconds like DataLogin.Timestamp.
+type Heartbeat struct {
+	ClientID  string `json:"client_id"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	Protocol  string `json:"protocol"`
+	LastSeen  int64  `json:"last_seen"`
+}
+
 type DataLogin struct {
 	Username  string `json:"username" binding:"required"`
 	Password  string `json:"password" binding:"required"`
@@ -14,3 +26,13 @@ type DataLogin struct {
 	Timestamp int64  `json:"timestamp" binding:"required"`
 	Sequence  int64  `json:"sequence" binding:"required"`
 }
+
+// LogValue leaves the password out when a DataLogin is logged.
+func (d DataLogin) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("uuid", d.UUID),
+		slog.Int64("sequence", d.Sequence),
+		slog.String("username", d.Username),
+		slog.Int64("timestamp", d.Timestamp),
+	)
+}
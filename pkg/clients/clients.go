@@ -0,0 +1,360 @@
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"time"
+
+	localSetup "ganesh.provengo.io/internal/setup"
+	localStructs "ganesh.provengo.io/internal/structs"
+	localLogging "ganesh.provengo.io/pkg/logging"
+	localPostgres "ganesh.provengo.io/pkg/postgres"
+	localPublisher "ganesh.provengo.io/pkg/publisher"
+	localRedis "ganesh.provengo.io/pkg/redis"
+)
+
+const (
+	StatusOnline  = "online"
+	StatusStale   = "stale"
+	StatusOffline = "offline"
+)
+
+const (
+	recordPrefix = "ganesh:client:"
+	stalePrefix  = "ganesh:client:stale:"
+	// lastSeenKey scores every client ID by its last heartbeat.
+	lastSeenKey = "ganesh:clients"
+)
+
+var ErrNotFound = errors.New("client not found")
+
+// Client is the last heartbeat of a client with the status it implies.
+type Client struct {
+	localStructs.Heartbeat
+	Status string `json:"status"`
+}
+
+// Event is published on <event_subject>.<type> when a client changes status.
+type Event struct {
+	Type   string `json:"type"`
+	At     int64  `json:"at"`
+	Client Client `json:"client"`
+}
+
+// heartbeatStore keeps the heartbeats once they left Redis.
+type heartbeatStore interface {
+	UpsertHeartbeats(ctx context.Context, heartbeats []localStructs.Heartbeat) error
+	SelectHeartbeat(ctx context.Context, clientID string) (localStructs.Heartbeat, error)
+}
+
+// eventPublisher publishes the status events.
+type eventPublisher interface {
+	Publish(ctx context.Context, subject string, data []byte) (localPublisher.Ack, error)
+}
+
+// Registry records heartbeats in Redis, where they expire once the client is
+// offline, and copies them to Postgres in the background. Every HTTP server
+// shares the same Redis, so any of them answers for every client.
+type Registry struct {
+	cfg       localSetup.Clients
+	redis     localSetup.Redis
+	store     func(ctx context.Context) (heartbeatStore, error)
+	publisher eventPublisher
+	logger    *slog.Logger
+}
+
+func New(cfg localSetup.Clients, redis localSetup.Redis, postgres localSetup.Postgres, publisher *localPublisher.Publisher) *Registry {
+	return &Registry{
+		cfg:   cfg,
+		redis: redis,
+		store: func(ctx context.Context) (heartbeatStore, error) {
+			return localPostgres.PostgresConnection(ctx, postgres)
+		},
+		publisher: publisher,
+		logger:    localLogging.Component("clients"),
+	}
+}
+
+func (r *Registry) status(lastSeen int64, now time.Time) string {
+	age := now.Sub(time.UnixMilli(lastSeen))
+	switch {
+	case age <= r.cfg.StaleAfter.Duration:
+		return StatusOnline
+	case age <= r.cfg.OfflineAfter.Duration:
+		return StatusStale
+	default:
+		return StatusOffline
+	}
+}
+
+// Record stores hb as the last heartbeat of its client.
+func (r *Registry) Record(ctx context.Context, hb localStructs.Heartbeat) error {
+	conn, err := localRedis.RedisConnection(ctx, r.redis)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(hb)
+	if err != nil {
+		return err
+	}
+	err = conn.Set(ctx, localRedis.RedisData{Key: recordPrefix + hb.ClientID, Value: payload, TTL: r.cfg.OfflineAfter.Duration})
+	if err != nil {
+		return err
+	}
+	return conn.ZAdd(ctx, lastSeenKey, hb.ClientID, float64(hb.LastSeen))
+}
+
+// records reads the heartbeats of members. A client whose record expired
+// only has its ID and last seen time.
+func (r *Registry) records(ctx context.Context, conn *localRedis.RedisService, members []localRedis.ScoredMember) ([]localStructs.Heartbeat, []bool, error) {
+	keys := make([]localRedis.RedisData, len(members))
+	for i, member := range members {
+		keys[i] = localRedis.RedisData{Key: recordPrefix + member.Member}
+	}
+	values, errs := conn.GetMany(ctx, keys)
+
+	heartbeats := make([]localStructs.Heartbeat, len(members))
+	found := make([]bool, len(members))
+	for i, member := range members {
+		heartbeats[i] = localStructs.Heartbeat{ClientID: member.Member, LastSeen: int64(member.Score)}
+		if localRedis.IsMissing(errs[i]) {
+			continue
+		}
+		if errs[i] != nil {
+			return nil, nil, errs[i]
+		}
+		if err := json.Unmarshal([]byte(values[i]), &heartbeats[i]); err != nil {
+			return nil, nil, fmt.Errorf("client %q: %w", member.Member, err)
+		}
+		found[i] = true
+	}
+	return heartbeats, found, nil
+}
+
+// List returns the clients seen within the retention, most recent first.
+func (r *Registry) List(ctx context.Context) ([]Client, error) {
+	conn, err := localRedis.RedisConnection(ctx, r.redis)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	members, err := conn.ZRangeByScore(ctx, lastSeenKey, float64(now.Add(-r.cfg.Retention.Duration).UnixMilli()), math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+	heartbeats, _, err := r.records(ctx, conn, members)
+	if err != nil {
+		return nil, err
+	}
+
+	clients := make([]Client, len(heartbeats))
+	for i, hb := range heartbeats {
+		clients[i] = Client{Heartbeat: hb, Status: r.status(hb.LastSeen, now)}
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].LastSeen > clients[j].LastSeen })
+	return clients, nil
+}
+
+// Get returns a client from Redis, or from Postgres once it left the
+// retention window.
+func (r *Registry) Get(ctx context.Context, clientID string) (Client, error) {
+	conn, err := localRedis.RedisConnection(ctx, r.redis)
+	if err != nil {
+		return Client{}, err
+	}
+	now := time.Now()
+
+	value, err := conn.Get(ctx, localRedis.RedisData{Key: recordPrefix + clientID})
+	if err == nil {
+		hb := localStructs.Heartbeat{}
+		if err := json.Unmarshal([]byte(value), &hb); err != nil {
+			return Client{}, fmt.Errorf("client %q: %w", clientID, err)
+		}
+		return Client{Heartbeat: hb, Status: r.status(hb.LastSeen, now)}, nil
+	}
+	if !localRedis.IsMissing(err) {
+		return Client{}, err
+	}
+
+	store, err := r.store(ctx)
+	if err == nil {
+		var hb localStructs.Heartbeat
+		hb, err = store.SelectHeartbeat(ctx, clientID)
+		if err == nil {
+			return Client{Heartbeat: hb, Status: StatusOffline}, nil
+		}
+	}
+	if err != nil && !errors.Is(err, localPostgres.ErrNotFound) {
+		r.logger.Warn("error reading client from postgres", "client_id", clientID, "error", err)
+	}
+
+	// Not persisted yet, or Postgres is down: the sorted set still knows
+	// when the client was last seen.
+	score, zErr := conn.ZScore(ctx, lastSeenKey, clientID)
+	if zErr == nil {
+		return Client{Heartbeat: localStructs.Heartbeat{ClientID: clientID, LastSeen: int64(score)}, Status: StatusOffline}, nil
+	}
+	if !localRedis.IsMissing(zErr) {
+		return Client{}, zErr
+	}
+	if err != nil && !errors.Is(err, localPostgres.ErrNotFound) {
+		return Client{}, err
+	}
+	return Client{}, fmt.Errorf("%w: %s", ErrNotFound, clientID)
+}
+
+// Run announces the clients going stale every sweep_interval and persists
+// the new heartbeats every persist_interval until ctx is cancelled, then
+// persists one last time.
+func (r *Registry) Run(ctx context.Context) {
+	sweep := time.NewTicker(r.cfg.SweepInterval.Duration)
+	defer sweep.Stop()
+	persist := time.NewTicker(r.cfg.PersistInterval.Duration)
+	defer persist.Stop()
+
+	// Clients already stale when the server starts were announced before,
+	// or went stale while no server was running.
+	staleCutoff := time.Now().Add(-r.cfg.StaleAfter.Duration).UnixMilli()
+	var persisted int64
+
+	for {
+		select {
+		case <-ctx.Done():
+			finalCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if _, err := r.persist(finalCtx, persisted); err != nil {
+				r.logger.Warn("error persisting heartbeats", "error", err)
+			}
+			cancel()
+			return
+		case <-sweep.C:
+			cutoff, err := r.sweep(ctx, staleCutoff)
+			if err != nil {
+				r.logger.Warn("error sweeping clients", "error", err)
+			}
+			staleCutoff = cutoff
+		case <-persist.C:
+			last, err := r.persist(ctx, persisted)
+			if err != nil {
+				r.logger.Warn("error persisting heartbeats", "error", err)
+			}
+			persisted = last
+		}
+	}
+}
+
+// sweep publishes a stale event for the clients whose last heartbeat is
+// older than stale_after since the previous sweep, and drops the clients
+// past the retention. It returns the cutoff the next sweep starts from,
+// which does not move when an event could not be published.
+func (r *Registry) sweep(ctx context.Context, from int64) (int64, error) {
+	conn, err := localRedis.RedisConnection(ctx, r.redis)
+	if err != nil {
+		return from, err
+	}
+	now := time.Now()
+	cutoff := now.Add(-r.cfg.StaleAfter.Duration).UnixMilli()
+	if cutoff <= from {
+		return from, nil
+	}
+
+	members, err := conn.ZRangeByScore(ctx, lastSeenKey, float64(from+1), float64(cutoff))
+	if err != nil {
+		return from, err
+	}
+	heartbeats, _, err := r.records(ctx, conn, members)
+	if err != nil {
+		return from, err
+	}
+
+	var errs []error
+	for _, hb := range heartbeats {
+		// Every server sweeps, the first to claim the transition publishes.
+		claim := localRedis.RedisData{Key: fmt.Sprintf("%s%s:%d", stalePrefix, hb.ClientID, hb.LastSeen), Value: 1, TTL: r.cfg.OfflineAfter.Duration}
+		claimed, err := conn.SetNX(ctx, claim)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		if err := r.publish(ctx, StatusStale, Client{Heartbeat: hb, Status: StatusStale}, now); err != nil {
+			_ = conn.Del(ctx, claim)
+			errs = append(errs, err)
+		}
+	}
+
+	if err := conn.ZRemRangeByScore(ctx, lastSeenKey, 0, float64(now.Add(-r.cfg.Retention.Duration).UnixMilli())); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return from, errors.Join(errs...)
+	}
+	return cutoff, nil
+}
+
+func (r *Registry) publish(ctx context.Context, eventType string, client Client, at time.Time) error {
+	payload, err := json.Marshal(Event{Type: eventType, At: at.UnixMilli(), Client: client})
+	if err != nil {
+		return err
+	}
+	subject := r.cfg.EventSubject + "." + eventType
+	if _, err := r.publisher.Publish(ctx, subject, payload); err != nil {
+		return fmt.Errorf("error publishing %s event of %q: %w", eventType, client.ClientID, err)
+	}
+	r.logger.Info("client status changed", "client_id", client.ClientID, "status", eventType, "last_seen", client.LastSeen)
+	return nil
+}
+
+// persist upserts the heartbeats newer than since into Postgres and returns
+// the most recent one persisted. The persist_interval before since is read
+// again: a heartbeat recorded by another server, whose clock runs behind or
+// whose request was still in flight, can land below the cursor. The upsert
+// keeps the newest heartbeat, reading one twice is harmless.
+func (r *Registry) persist(ctx context.Context, since int64) (int64, error) {
+	conn, err := localRedis.RedisConnection(ctx, r.redis)
+	if err != nil {
+		return since, err
+	}
+	from := since + 1
+	if since > 0 {
+		from -= r.cfg.PersistInterval.Duration.Milliseconds()
+	}
+	members, err := conn.ZRangeByScore(ctx, lastSeenKey, float64(from), math.MaxInt64)
+	if err != nil || len(members) == 0 {
+		return since, err
+	}
+	heartbeats, found, err := r.records(ctx, conn, members)
+	if err != nil {
+		return since, err
+	}
+
+	rows := make([]localStructs.Heartbeat, 0, len(heartbeats))
+	last := since
+	for i, hb := range heartbeats {
+		// Without its record only the last seen time is known, upserting it
+		// would erase the IP and user agent stored before.
+		if found[i] {
+			rows = append(rows, hb)
+		}
+		last = max(last, int64(members[i].Score))
+	}
+	if len(rows) == 0 {
+		return last, nil
+	}
+
+	store, err := r.store(ctx)
+	if err != nil {
+		return since, err
+	}
+	if err := store.UpsertHeartbeats(ctx, rows); err != nil {
+		return since, err
+	}
+	r.logger.Debug("heartbeats persisted", "clients", len(rows))
+	return last, nil
+}
@@ -0,0 +1,309 @@
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	localSetup "ganesh.provengo.io/internal/setup"
+	localStructs "ganesh.provengo.io/internal/structs"
+	localLogging "ganesh.provengo.io/pkg/logging"
+	localPostgres "ganesh.provengo.io/pkg/postgres"
+	localPublisher "ganesh.provengo.io/pkg/publisher"
+	"github.com/alicebob/miniredis/v2"
+)
+
+// The Redis client is a process wide singleton, every test shares one
+// miniredis and flushes it first.
+var testRedis *miniredis.Miniredis
+
+// memoryStore stands for Postgres.
+type memoryStore struct {
+	mu      sync.Mutex
+	rows    map[string]localStructs.Heartbeat
+	upserts [][]string
+	err     error
+}
+
+func (m *memoryStore) UpsertHeartbeats(_ context.Context, heartbeats []localStructs.Heartbeat) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	var ids []string
+	for _, hb := range heartbeats {
+		m.rows[hb.ClientID] = hb
+		ids = append(ids, hb.ClientID)
+	}
+	m.upserts = append(m.upserts, ids)
+	return nil
+}
+
+func (m *memoryStore) SelectHeartbeat(_ context.Context, clientID string) (localStructs.Heartbeat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hb, ok := m.rows[clientID]
+	if !ok {
+		return hb, fmt.Errorf("client %q: %w", clientID, localPostgres.ErrNotFound)
+	}
+	return hb, nil
+}
+
+// memoryPublisher records the events instead of publishing them to NATS.
+type memoryPublisher struct {
+	mu     sync.Mutex
+	events map[string][]Event
+	err    error
+}
+
+func (m *memoryPublisher) Publish(_ context.Context, subject string, data []byte) (localPublisher.Ack, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return localPublisher.Ack{}, m.err
+	}
+	var event Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		return localPublisher.Ack{}, err
+	}
+	m.events[subject] = append(m.events[subject], event)
+	return localPublisher.Ack{Subject: subject}, nil
+}
+
+func (m *memoryPublisher) published(subject string) []Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.events[subject]
+}
+
+func registry(t *testing.T) (*Registry, *memoryStore, *memoryPublisher, *miniredis.Miniredis) {
+	t.Helper()
+	if testRedis == nil {
+		mr, err := miniredis.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		testRedis = mr
+	}
+	testRedis.FlushAll()
+
+	cfg := localSetup.Default()
+	cfg.Redis.URL = "redis://" + testRedis.Addr()
+	cfg.Clients.StaleAfter.Duration = time.Minute
+	cfg.Clients.OfflineAfter.Duration = 5 * time.Minute
+	cfg.Clients.Retention.Duration = time.Hour
+	cfg.Clients.PersistInterval.Duration = 30 * time.Second
+	store := &memoryStore{rows: map[string]localStructs.Heartbeat{}}
+	publisher := &memoryPublisher{events: map[string][]Event{}}
+	r := &Registry{
+		cfg:       cfg.Clients,
+		redis:     cfg.Redis,
+		store:     func(context.Context) (heartbeatStore, error) { return store, nil },
+		publisher: publisher,
+		logger:    localLogging.Component("clients"),
+	}
+	return r, store, publisher, testRedis
+}
+
+func record(t *testing.T, r *Registry, clientID string, lastSeen time.Time) localStructs.Heartbeat {
+	t.Helper()
+	hb := localStructs.Heartbeat{ClientID: clientID, IP: "10.0.0.1", UserAgent: "test", Protocol: "HTTP/1.1", LastSeen: lastSeen.UnixMilli()}
+	if err := r.Record(context.Background(), hb); err != nil {
+		t.Fatal(err)
+	}
+	return hb
+}
+
+func TestStatus(t *testing.T) {
+	r, _, _, _ := registry(t)
+	// Heartbeats carry milliseconds.
+	now := time.UnixMilli(time.Now().UnixMilli())
+	tests := []struct {
+		age  time.Duration
+		want string
+	}{
+		{-time.Second, StatusOnline},
+		{0, StatusOnline},
+		{time.Minute, StatusOnline},
+		{time.Minute + time.Millisecond, StatusStale},
+		{5 * time.Minute, StatusStale},
+		{5*time.Minute + time.Millisecond, StatusOffline},
+		{48 * time.Hour, StatusOffline},
+	}
+	for _, tt := range tests {
+		if got := r.status(now.Add(-tt.age).UnixMilli(), now); got != tt.want {
+			t.Errorf("status after %s = %s, want %s", tt.age, got, tt.want)
+		}
+	}
+}
+
+func TestSweepPublishesEachTransitionOnce(t *testing.T) {
+	r, _, publisher, mr := registry(t)
+	ctx := context.Background()
+	now := time.Now()
+	stale := record(t, r, "stale", now.Add(-2*time.Minute))
+	record(t, r, "online", now)
+	record(t, r, "expired", now.Add(-2*time.Hour))
+	subject := r.cfg.EventSubject + "." + StatusStale
+
+	from := now.Add(-10 * time.Minute).UnixMilli()
+	cutoff, err := r.sweep(ctx, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cutoff <= from {
+		t.Fatalf("cutoff %d did not move past %d", cutoff, from)
+	}
+	events := publisher.published(subject)
+	if len(events) != 1 || events[0].Client.ClientID != "stale" || events[0].Client.Status != StatusStale || events[0].Client.IP != stale.IP {
+		t.Fatalf("published %+v, want one stale event for stale", events)
+	}
+
+	// Another server sweeping the same range, and the next sweep.
+	if _, err := r.sweep(ctx, from); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.sweep(ctx, cutoff); err != nil {
+		t.Fatal(err)
+	}
+	if events := publisher.published(subject); len(events) != 1 {
+		t.Fatalf("published %d events, want the transition announced once", len(events))
+	}
+
+	if members, err := mr.ZMembers(lastSeenKey); err != nil || strings.Join(members, ",") != "stale,online" {
+		t.Errorf("listed %v, %v; want the client past the retention dropped", members, err)
+	}
+}
+
+func TestSweepKeepsCutoffWhenPublishFails(t *testing.T) {
+	r, _, publisher, mr := registry(t)
+	ctx := context.Background()
+	now := time.Now()
+	record(t, r, "stale", now.Add(-2*time.Minute))
+	subject := r.cfg.EventSubject + "." + StatusStale
+
+	from := now.Add(-10 * time.Minute).UnixMilli()
+	publisher.err = errors.New("nats: connection closed")
+	cutoff, err := r.sweep(ctx, from)
+	if err == nil || cutoff != from {
+		t.Fatalf("sweep() = %d, %v; want the cutoff %d kept and an error", cutoff, err, from)
+	}
+	for _, key := range mr.Keys() {
+		if strings.HasPrefix(key, stalePrefix) {
+			t.Fatalf("claim %s kept after the failed publish", key)
+		}
+	}
+
+	publisher.err = nil
+	if _, err := r.sweep(ctx, cutoff); err != nil {
+		t.Fatal(err)
+	}
+	if events := publisher.published(subject); len(events) != 1 {
+		t.Fatalf("published %d events after the retry, want 1", len(events))
+	}
+}
+
+func TestGet(t *testing.T) {
+	r, store, _, mr := registry(t)
+	ctx := context.Background()
+	now := time.Now()
+	live := record(t, r, "live", now)
+	expired := record(t, r, "expired", now.Add(-10*time.Minute))
+	persisted := record(t, r, "persisted", now.Add(-20*time.Minute))
+	store.rows["persisted"] = persisted
+	mr.Del(recordPrefix + "expired")
+	mr.Del(recordPrefix + "persisted")
+
+	tests := []struct {
+		clientID string
+		want     Client
+	}{
+		{"live", Client{Heartbeat: live, Status: StatusOnline}},
+		// Only the sorted set still knows the client.
+		{"expired", Client{Heartbeat: localStructs.Heartbeat{ClientID: "expired", LastSeen: expired.LastSeen}, Status: StatusOffline}},
+		{"persisted", Client{Heartbeat: persisted, Status: StatusOffline}},
+	}
+	for _, tt := range tests {
+		got, err := r.Get(ctx, tt.clientID)
+		if err != nil || got != tt.want {
+			t.Errorf("Get(%s) = %+v, %v; want %+v", tt.clientID, got, err, tt.want)
+		}
+	}
+	if _, err := r.Get(ctx, "unknown"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(unknown) = %v, want ErrNotFound", err)
+	}
+}
+
+func TestPersistAdvancesCursor(t *testing.T) {
+	r, store, _, mr := registry(t)
+	ctx := context.Background()
+	now := time.Now()
+	record(t, r, "a", now.Add(-3*time.Minute))
+	b := record(t, r, "b", now.Add(-2*time.Minute))
+
+	last, err := r.persist(ctx, 0)
+	if err != nil || last != b.LastSeen {
+		t.Fatalf("persist(0) = %d, %v; want %d", last, err, b.LastSeen)
+	}
+	if len(store.rows) != 2 || store.rows["b"] != b {
+		t.Fatalf("persisted %+v", store.rows)
+	}
+
+	// A client whose record expired moves the cursor without erasing the row.
+	gone := record(t, r, "gone", now.Add(-time.Minute))
+	mr.Del(recordPrefix + "gone")
+	c := record(t, r, "c", now.Add(-90*time.Second))
+	cursor, err := r.persist(ctx, last)
+	if err != nil || cursor != gone.LastSeen {
+		t.Fatalf("persist(%d) = %d, %v; want %d", last, cursor, err, gone.LastSeen)
+	}
+	if _, ok := store.rows["gone"]; ok || store.rows["c"] != c {
+		t.Fatalf("persisted %+v", store.rows)
+	}
+
+	// Postgres down: the cursor stays for the next attempt.
+	store.err = errors.New("postgres: connection refused")
+	record(t, r, "d", now)
+	if got, err := r.persist(ctx, cursor); err == nil || got != cursor {
+		t.Fatalf("persist with postgres down = %d, %v; want %d and an error", got, err, cursor)
+	}
+	store.err = nil
+	if got, err := r.persist(ctx, cursor); err != nil || got != now.UnixMilli() {
+		t.Fatalf("persist after postgres came back = %d, %v; want %d", got, err, now.UnixMilli())
+	}
+}
+
+// A heartbeat another server recorded just below the cursor is persisted
+// on the next pass, the cursor does not move back.
+func TestPersistRereadsBelowCursor(t *testing.T) {
+	r, store, _, _ := registry(t)
+	ctx := context.Background()
+	now := time.Now()
+	a := record(t, r, "a", now)
+	cursor, err := r.persist(ctx, 0)
+	if err != nil || cursor != a.LastSeen {
+		t.Fatalf("persist(0) = %d, %v; want %d", cursor, err, a.LastSeen)
+	}
+
+	late := record(t, r, "late", now.Add(-10*time.Second))
+	record(t, r, "older", now.Add(-time.Minute))
+	got, err := r.persist(ctx, cursor)
+	if err != nil || got != cursor {
+		t.Fatalf("persist(%d) = %d, %v; want the cursor kept", cursor, got, err)
+	}
+	if store.rows["late"] != late {
+		t.Errorf("heartbeat %s below the cursor not persisted", time.Duration(cursor-late.LastSeen)*time.Millisecond)
+	}
+	if _, ok := store.rows["older"]; ok {
+		t.Error("heartbeat older than persist_interval below the cursor persisted")
+	}
+	if last := store.upserts[len(store.upserts)-1]; strings.Join(last, ",") != "late,a" {
+		t.Errorf("last upsert %v, want the overlap only", last)
+	}
+}
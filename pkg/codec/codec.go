@@ -0,0 +1,200 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"sort"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Header carries the content type of a message. Messages without it are
+// JSON, the encoding used before codecs existed.
+const Header = "Content-Type"
+
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeMsgPack  = "application/msgpack"
+	ContentTypeCBOR     = "application/cbor"
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+var (
+	ErrUnknownContentType = errors.New("unknown content type")
+	// ErrUnsupported is returned by the Protobuf codec for values that do
+	// not implement ProtoMarshaler or ProtoUnmarshaler.
+	ErrUnsupported = errors.New("type not supported by codec")
+)
+
+// Codec encodes the messages of the pipeline. Structs are mapped through
+// their json tags whatever the codec.
+type Codec interface {
+	Name() string
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// ProtoMarshaler and ProtoUnmarshaler are implemented by the types the
+// Protobuf codec handles, with hand-written protowire code instead of
+// generated one.
+type ProtoMarshaler interface {
+	AppendProto(b []byte) []byte
+}
+
+type ProtoUnmarshaler interface {
+	UnmarshalProto(b []byte) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                       { return "json" }
+func (jsonCodec) ContentType() string                { return ContentTypeJSON }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string        { return "msgpack" }
+func (msgpackCodec) ContentType() string { return ContentTypeMsgPack }
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	var out bytes.Buffer
+	enc := msgpack.NewEncoder(&out)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	err := enc.Encode(v)
+	return out.Bytes(), err
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// cbor falls back to the json tags on its own.
+type cborCodec struct{}
+
+func (cborCodec) Name() string                       { return "cbor" }
+func (cborCodec) ContentType() string                { return ContentTypeCBOR }
+func (cborCodec) Marshal(v any) ([]byte, error)      { return cbor.Marshal(v) }
+func (cborCodec) Unmarshal(data []byte, v any) error { return cbor.Unmarshal(data, v) }
+
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string        { return "protobuf" }
+func (protobufCodec) ContentType() string { return ContentTypeProtobuf }
+
+func (protobufCodec) Marshal(v any) ([]byte, error) {
+	message, ok := v.(ProtoMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("%w: protobuf cannot encode %T", ErrUnsupported, v)
+	}
+	return message.AppendProto(nil), nil
+}
+
+func (protobufCodec) Unmarshal(data []byte, v any) error {
+	message, ok := v.(ProtoUnmarshaler)
+	if !ok {
+		return fmt.Errorf("%w: protobuf cannot decode into %T", ErrUnsupported, v)
+	}
+	return message.UnmarshalProto(data)
+}
+
+var (
+	JSON     Codec = jsonCodec{}
+	MsgPack  Codec = msgpackCodec{}
+	CBOR     Codec = cborCodec{}
+	Protobuf Codec = protobufCodec{}
+)
+
+var (
+	mu            sync.RWMutex
+	byName        = map[string]Codec{}
+	byContentType = map[string]Codec{}
+)
+
+func init() {
+	for _, c := range []Codec{JSON, MsgPack, CBOR, Protobuf} {
+		Register(c)
+	}
+}
+
+// Register makes c available by name and content type, replacing a codec
+// registered before under either.
+func Register(c Codec) {
+	mu.Lock()
+	defer mu.Unlock()
+	byName[c.Name()] = c
+	byContentType[c.ContentType()] = c
+}
+
+// Names returns the names of the registered codecs, sorted.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ByName returns the codec registered as name.
+func ByName(name string) (Codec, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	if c, ok := byName[name]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("codec %q: %w", name, ErrUnknownContentType)
+}
+
+// ForContentType returns the codec of contentType, ignoring its parameters.
+// An empty content type is JSON.
+func ForContentType(contentType string) (Codec, error) {
+	if contentType == "" {
+		return JSON, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q: %v", ErrUnknownContentType, contentType, err)
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	if c, ok := byContentType[mediaType]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownContentType, contentType)
+}
+
+// Decode unmarshals data into v with the codec named by the headers of the
+// message.
+func Decode(header nats.Header, data []byte, v any) error {
+	c, err := ForContentType(header.Get(Header))
+	if err != nil {
+		return err
+	}
+	return c.Unmarshal(data, v)
+}
+
+// NewMsg returns a message to subject holding v encoded by c, with its
+// content type set.
+func NewMsg(c Codec, subject string, v any) (*nats.Msg, error) {
+	data, err := c.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	msg.Header.Set(Header, c.ContentType())
+	return msg, nil
+}
@@ -0,0 +1,175 @@
+package codec_test
+
+import (
+	"errors"
+	"testing"
+
+	localStructs "ganesh.provengo.io/internal/structs"
+	"ganesh.provengo.io/pkg/codec"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var user = localStructs.DataLogin{
+	UUID:      "6f1c5a3e-2b7d-4c1e-9a8f-0d3b5e7c9a21",
+	Username:  "nicolas",
+	Password:  "XkLmPqRsTuVw",
+	Timestamp: 1700000000000,
+	Sequence:  4000,
+}
+
+var codecs = []codec.Codec{codec.JSON, codec.MsgPack, codec.CBOR, codec.Protobuf}
+
+func TestRoundTrip(t *testing.T) {
+	values := []localStructs.DataLogin{
+		user,
+		{},
+		{Username: "ünïcødé 名前", UUID: "x", Timestamp: -1, Sequence: 1 << 62},
+	}
+	for _, c := range codecs {
+		for _, want := range values {
+			data, err := c.Marshal(want)
+			if err != nil {
+				t.Fatalf("%s: marshal: %v", c.Name(), err)
+			}
+			var got localStructs.DataLogin
+			if err := c.Unmarshal(data, &got); err != nil {
+				t.Fatalf("%s: unmarshal: %v", c.Name(), err)
+			}
+			if got != want {
+				t.Errorf("%s: got %+v, want %+v", c.Name(), got, want)
+			}
+		}
+	}
+}
+
+// A DataLogin published by a newer producer, with fields this consumer does
+// not know, still decodes.
+func TestUnknownFieldsAreSkipped(t *testing.T) {
+	for _, c := range []codec.Codec{codec.JSON, codec.MsgPack, codec.CBOR} {
+		data, err := c.Marshal(map[string]any{
+			"username": user.Username, "password": user.Password, "uuid": user.UUID,
+			"email": "n@example.com", "tags": []int{1, 2},
+			"timestamp": user.Timestamp, "sequence": user.Sequence,
+		})
+		if err != nil {
+			t.Fatalf("%s: marshal: %v", c.Name(), err)
+		}
+		var got localStructs.DataLogin
+		if err := c.Unmarshal(data, &got); err != nil {
+			t.Fatalf("%s: unmarshal: %v", c.Name(), err)
+		}
+		if got != user {
+			t.Errorf("%s: got %+v, want %+v", c.Name(), got, user)
+		}
+	}
+
+	// Unknown protobuf fields of every wire type, between and after the
+	// known ones.
+	data := protowire.AppendTag(nil, 9, protowire.VarintType)
+	data = protowire.AppendVarint(data, 42)
+	data = user.AppendProto(data)
+	data = protowire.AppendTag(data, 10, protowire.BytesType)
+	data = protowire.AppendString(data, "n@example.com")
+	data = protowire.AppendTag(data, 11, protowire.Fixed32Type)
+	data = protowire.AppendFixed32(data, 7)
+	data = protowire.AppendTag(data, 12, protowire.Fixed64Type)
+	data = protowire.AppendFixed64(data, 7)
+	var got localStructs.DataLogin
+	if err := codec.Protobuf.Unmarshal(data, &got); err != nil {
+		t.Fatalf("protobuf: unmarshal: %v", err)
+	}
+	if got != user {
+		t.Errorf("protobuf: got %+v, want %+v", got, user)
+	}
+}
+
+func TestProtobufRejectsTruncatedInput(t *testing.T) {
+	data := user.AppendProto(nil)
+	for _, n := range []int{1, 2, len(data) - 1} {
+		var got localStructs.DataLogin
+		if err := codec.Protobuf.Unmarshal(data[:n], &got); err == nil {
+			t.Errorf("%d of %d bytes decoded as %+v", n, len(data), got)
+		}
+	}
+}
+
+func TestProtobufUnsupportedType(t *testing.T) {
+	if _, err := codec.Protobuf.Marshal(map[string]any{"uuid": "u"}); !errors.Is(err, codec.ErrUnsupported) {
+		t.Errorf("Marshal of a map = %v, want ErrUnsupported", err)
+	}
+	var v map[string]any
+	if err := codec.Protobuf.Unmarshal(nil, &v); !errors.Is(err, codec.ErrUnsupported) {
+		t.Errorf("Unmarshal into a map = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestForContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        codec.Codec
+	}{
+		{"", codec.JSON},
+		{"application/json; charset=utf-8", codec.JSON},
+		{codec.ContentTypeMsgPack, codec.MsgPack},
+		{codec.ContentTypeCBOR, codec.CBOR},
+		{codec.ContentTypeProtobuf, codec.Protobuf},
+	}
+	for _, tt := range tests {
+		got, err := codec.ForContentType(tt.contentType)
+		if err != nil || got != tt.want {
+			t.Errorf("ForContentType(%q) = %v, %v", tt.contentType, got, err)
+		}
+	}
+	if _, err := codec.ForContentType("text/xml"); !errors.Is(err, codec.ErrUnknownContentType) {
+		t.Errorf("ForContentType(text/xml) = %v, want ErrUnknownContentType", err)
+	}
+}
+
+func TestNewMsgDecode(t *testing.T) {
+	for _, c := range codecs {
+		msg, err := codec.NewMsg(c, "subject", user)
+		if err != nil {
+			t.Fatalf("%s: %v", c.Name(), err)
+		}
+		var got localStructs.DataLogin
+		if err := codec.Decode(msg.Header, msg.Data, &got); err != nil || got != user {
+			t.Errorf("%s: decoded %+v, %v", c.Name(), got, err)
+		}
+	}
+	// Messages published before codecs carry no content type.
+	var got localStructs.DataLogin
+	if err := codec.Decode(nats.Header{}, []byte(`{"uuid":"u"}`), &got); err != nil || got.UUID != "u" {
+		t.Errorf("headerless JSON: decoded %+v, %v", got, err)
+	}
+}
+
+// The size of a DataLogin with each codec is reported as bytes/msg.
+func BenchmarkMarshal(b *testing.B) {
+	for _, c := range codecs {
+		b.Run(c.Name(), func(b *testing.B) {
+			b.ReportAllocs()
+			var data []byte
+			for range b.N {
+				data, _ = c.Marshal(user)
+			}
+			b.ReportMetric(float64(len(data)), "bytes/msg")
+		})
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	for _, c := range codecs {
+		data, err := c.Marshal(user)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(c.Name(), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				var decoded localStructs.DataLogin
+				_ = c.Unmarshal(data, &decoded)
+			}
+		})
+	}
+}
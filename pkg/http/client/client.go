@@ -1,21 +1,22 @@
 package http_client
 
 import (
-	"bytes"
 	"crypto/tls"
 	"encoding/json"
-	"fmt"
 	localStructs "ganesh.provengo.io/internal/structs"
 	"github.com/google/uuid"
-	"io/ioutil"
-	"log"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
-	"sort"
 	"sync"
 	"time"
 )
 
+// StatusQuery is the outcome of one request. TotalTime runs from Intended,
+// the time the request should have started, to the end of the answer;
+// ServiceTime from the time it actually started. Both are equal in closed
+// mode, where a request starts when the previous one ends.
 type StatusQuery struct {
 	Worker         int
 	QueryID        int
@@ -23,22 +24,35 @@ type StatusQuery struct {
 	StatusCode     int
 	ConnectionTime time.Duration
 	TotalTime      time.Duration
+	ServiceTime    time.Duration
+	Intended       time.Time
 	TimesStamp     time.Time
 	TotalBytes     int
 	Signature      string
+	// Name is the scenario request that was sent
+	Name string
 }
 
-type PostData struct {
-	Signature   string
-	Destination string
-	Data        []byte
+// Credentials sign every request when ClientID is set.
+type Credentials struct {
+	ClientID string
+	Secret   string
 }
 
-func httpWorker(goId int, method string, url string, data PostData, executionTime time.Duration, responseChannel chan StatusQuery, wg *sync.WaitGroup, startSignal *sync.WaitGroup) {
-	defer wg.Done()
-
-	startSignal.Wait()
+// sampleUser is the body posted by the load tests, a new user for every
+// request so that the server validation and the consumer dedupe accept it.
+func sampleUser(data templateData) []byte {
+	userBytes, _ := json.Marshal(localStructs.DataLogin{
+		Username:  "teste",
+		Password:  "teste",
+		UUID:      data.UUID,
+		Timestamp: data.Timestamp,
+		Sequence:  data.Sequence,
+	})
+	return userBytes
+}
 
+func newHTTPClient(maxConns int) *http.Client {
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: true,
 	}
@@ -50,196 +64,126 @@ func httpWorker(goId int, method string, url string, data PostData, executionTim
 		}).DialContext,
 		TLSHandshakeTimeout: 5 * time.Second,
 		TLSClientConfig:     tlsConfig,
-		MaxIdleConns:        100,
-		MaxIdleConnsPerHost: 100,
+		MaxIdleConns:        maxConns,
+		MaxIdleConnsPerHost: maxConns,
 		MaxConnsPerHost:     1000,
 		IdleConnTimeout:     5 * time.Second,
 	}
 
-	client := &http.Client{
+	return &http.Client{
 		Transport: transport,
 		Timeout:   5 * time.Second,
 	}
+}
+
+// send runs one request and reads the body of successful answers. The
+// status code is 0 when no answer was received.
+func send(client *http.Client, req *http.Request) (statusCode int, bodyLength int, connectionTime time.Duration) {
+	startTime := time.Now()
+	resp, err := client.Do(req)
+	connectionTime = time.Since(startTime)
+	if err != nil {
+		slog.Error("request failed", "method", req.Method, "url", req.URL.String(), "error", err)
+		return 0, 0, connectionTime
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		body, _ := io.ReadAll(resp.Body)
+		bodyLength = len(body)
+	} else {
+		_, _ = io.Copy(io.Discard, resp.Body)
+	}
+	return resp.StatusCode, bodyLength, connectionTime
+}
+
+// httpWorker sends the requests of scenario back to back, pausing for their
+// think time, until executionTime elapsed.
+func httpWorker(goId int, scenario *Scenario, credentials Credentials, executionTime time.Duration, responseChannel chan StatusQuery, wg *sync.WaitGroup, startSignal *sync.WaitGroup) {
+	defer wg.Done()
+
+	startSignal.Wait()
+
+	client := newHTTPClient(100)
 
 	executionStart := time.Now()
-	resp, err := client.Head(url)
 	for {
 		startTime := time.Now()
-		bodyLength := 0
-
-		switch method {
-		case "GET":
-			resp, err = client.Get(url)
-		case "POST":
-			resp, err = client.Post(url, "application/json", bytes.NewBufferString(string(data.Data)))
-		default:
-			return
-		}
-
-		connectionTime := time.Since(startTime)
+		req, name, think, err := scenario.next(credentials)
 		if err != nil {
-			log.Println("Error:", err)
-		} else {
-			if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
-				body, _ := ioutil.ReadAll(resp.Body)
-				bodyLength = len(body)
-				_ = resp.Body.Close()
-			}
+			slog.Error("invalid request", "scenario", scenario.Name, "request", name, "error", err)
+			return
 		}
+		statusCode, bodyLength, connectionTime := send(client, req)
 		totalTime := time.Since(startTime)
 
 		responseChannel <- StatusQuery{
 			Worker:         goId,
 			QueryID:        0,
 			Sequence:       0,
-			StatusCode:     resp.StatusCode,
+			StatusCode:     statusCode,
 			ConnectionTime: connectionTime,
 			TotalTime:      totalTime,
+			ServiceTime:    totalTime,
 			TotalBytes:     bodyLength,
 			Signature:      uuid.New().String(),
+			Intended:       startTime,
 			TimesStamp:     time.Now(),
+			Name:           name,
 		}
-		if time.Since(executionStart) >= executionTime {
+		if time.Since(executionStart)+think >= executionTime {
 			break
 		}
+		time.Sleep(think)
 	}
 }
 
-func LogStatus(responseChannel chan StatusQuery, returnChannel chan []StatusQuery, wg *sync.WaitGroup, startSignal *sync.WaitGroup) {
+// LogStatus feeds the results of the workers to recorder until
+// responseChannel is closed, then hands it back on returnChannel.
+func LogStatus(responseChannel chan StatusQuery, returnChannel chan *Recorder, recorder *Recorder, startSignal *sync.WaitGroup) {
 
 	startSignal.Wait()
-	var returnData []StatusQuery
 
 	for metric := range responseChannel {
-		returnData = append(returnData, metric)
-	}
-
-	returnChannel <- returnData
-
-}
-
-func calculateAverageAndP95(values []float64) (float64, float64, float64) {
-	if len(values) == 0 {
-		return 0, 0, 0
+		recorder.Record(metric)
 	}
 
-	sum := 0.0
-	for _, v := range values {
-		sum += v
-	}
-	average := sum / float64(len(values))
-
-	sort.Float64s(values)
-
-	p95Index := int(0.95 * float64(len(values)-1))
-	p95 := values[p95Index]
-
-	p99Index := int(0.99 * float64(len(values)-1))
-	p99 := values[p99Index]
+	returnChannel <- recorder
 
-	return average, p95, p99
 }
 
-func AccessMetrics(data []StatusQuery) {
-	var totalDuration []float64
-	var connectionTime []float64
-	var totalAccess int
-	var totalAccessStatusCode200 int
-	var totalAccessStatusCode300 int
-	var totalAccessStatusCode400 int
-	var totalAccessStatusCode500 int
-	minTime := time.Now()
-	maxTime := time.Now()
-
-	for _, _dt := range data {
-		totalDuration = append(totalDuration, _dt.TotalTime.Seconds())
-		connectionTime = append(connectionTime, _dt.ConnectionTime.Seconds())
-		totalAccess++
-
-		if _dt.StatusCode >= 300 && _dt.StatusCode <= 399 {
-			totalAccessStatusCode300++
-		}
-
-		if _dt.StatusCode >= 400 && _dt.StatusCode <= 499 {
-			totalAccessStatusCode400++
-		}
-
-		if _dt.StatusCode >= 500 && _dt.StatusCode <= 599 {
-			totalAccessStatusCode500++
-		}
-
-		if _dt.StatusCode >= 200 && _dt.StatusCode <= 299 {
-			totalAccessStatusCode200++
-
-			if minTime == maxTime {
-				maxTime = _dt.TimesStamp
-			}
-
-			if _dt.TimesStamp.UnixMilli() < minTime.UnixMilli() {
-				minTime = _dt.TimesStamp
-			}
-
-			if _dt.TimesStamp.UnixMilli() > maxTime.UnixMilli() {
-				maxTime = _dt.TimesStamp
-			}
-		}
-	}
-	_mean := 0.0
-	_p95 := 0.0
-	_p99 := 0.0
-
-	accessRate := totalAccess / int(maxTime.Sub(minTime).Milliseconds()/1000)
-
-	fmt.Printf("Total Access: %d Access Rate: %d Elapsed Time: %v \n", totalAccess, accessRate, maxTime.Sub(minTime))
-	fmt.Printf("Status Code 200: %d \n", totalAccessStatusCode200)
-	fmt.Printf("Status Code 300: %d \n", totalAccessStatusCode300)
-	fmt.Printf("Status Code 400: %d \n", totalAccessStatusCode400)
-	fmt.Printf("Status Code 500: %d \n", totalAccessStatusCode500)
-
-	_mean, _p95, _p99 = calculateAverageAndP95(connectionTime)
-	fmt.Printf("Total Connection Duration  Average: %f P95: %f p99: %f\n", _mean, _p95, _p99)
-
-	_mean, _p95, _p99 = calculateAverageAndP95(totalDuration)
-	fmt.Printf("Total Access Duration: Average: %f p95: %f p99: %f\n", _mean, _p95, _p99)
-
-	return
+// StartClient runs the closed mode: TotalWorkers send the requests of
+// scenario back to back for totalTime.
+func StartClient(scenario *Scenario, TotalWorkers int, totalTime time.Duration, credentials Credentials) Report {
+	recorder := NewRecorder(time.Now())
+	elapsed := runClosed(scenario, TotalWorkers, totalTime, credentials, recorder)
+	return recorder.Report("closed", scenario.Name, elapsed)
 }
 
-func StartClient(url string, TotalWorkers int, totalTime time.Duration) {
+// runClosed runs the closed mode from the start of recorder, waiting for it
+// when it is ahead, and returns the time the run took.
+func runClosed(scenario *Scenario, TotalWorkers int, totalTime time.Duration, credentials Credentials, recorder *Recorder) time.Duration {
 	wg := sync.WaitGroup{}
 	startSignal := sync.WaitGroup{}
-	responseChannel := make(chan StatusQuery)
-	returnChannel := make(chan []StatusQuery)
+	responseChannel := make(chan StatusQuery, TotalWorkers)
+	returnChannel := make(chan *Recorder)
 
 	startSignal.Add(1)
 
-	go LogStatus(responseChannel, returnChannel, &wg, &startSignal)
-	userBytes, _ := json.Marshal(localStructs.DataLogin{
-		Username:  "teste",
-		Password:  "teste",
-		UUID:      "teste",
-		Timestamp: 0,
-		Sequence:  1,
-	})
+	go LogStatus(responseChannel, returnChannel, recorder, &startSignal)
 
 	for i := 0; i < TotalWorkers; i++ {
 		wg.Add(1)
-		_localData := PostData{
-			Signature:   uuid.New().String(),
-			Destination: "user",
-			Data:        userBytes,
-		}
-		go httpWorker(i, "POST", url, _localData, totalTime, responseChannel, &wg, &startSignal)
+		go httpWorker(i, scenario, credentials, totalTime, responseChannel, &wg, &startSignal)
 
 	}
 
+	time.Sleep(time.Until(recorder.start))
 	startSignal.Done()
 
 	wg.Wait()
+	elapsed := time.Since(recorder.start)
 	close(responseChannel)
 
-	metric := <-returnChannel
-
-	AccessMetrics(metric)
-
+	<-returnChannel
+	return elapsed
 }
@@ -0,0 +1,54 @@
+package http_client
+
+import (
+	"math"
+)
+
+// Difference compares one metric of two reports. Change is the relative
+// change of Candidate from Baseline in percent.
+type Difference struct {
+	Metric     string
+	Baseline   float64
+	Candidate  float64
+	Change     float64
+	Regression bool
+}
+
+// Compare diffs the rates, the failure ratio and the latency percentiles of
+// candidate against baseline. A metric regresses when it moved the wrong way
+// by more than threshold percent.
+func Compare(baseline Report, candidate Report, threshold float64) []Difference {
+	var diffs []Difference
+	add := func(metric string, base float64, cand float64, higherIsBetter bool) {
+		d := Difference{Metric: metric, Baseline: base, Candidate: cand}
+		switch {
+		case base == cand:
+		case base == 0:
+			d.Change = math.Inf(1)
+		default:
+			d.Change = (cand - base) / math.Abs(base) * 100
+		}
+		if higherIsBetter {
+			d.Regression = d.Change < -threshold
+		} else {
+			d.Regression = d.Change > threshold
+		}
+		diffs = append(diffs, d)
+	}
+
+	failedRatio := func(r Report) float64 {
+		if r.Requests == 0 {
+			return 0
+		}
+		return float64(r.Failed) / float64(r.Requests) * 100
+	}
+
+	add("actual_rate", baseline.ActualRate, candidate.ActualRate, true)
+	add("success_rate", baseline.SuccessRate, candidate.SuccessRate, true)
+	add("failed_percent", failedRatio(baseline), failedRatio(candidate), false)
+	candidateLadder := candidate.Latency.ladder()
+	for i, step := range baseline.Latency.ladder() {
+		add("latency_"+step.Name, step.Value, candidateLadder[i].Value, false)
+	}
+	return diffs
+}
@@ -0,0 +1,62 @@
+package http_client
+
+import (
+	"math"
+	"testing"
+)
+
+func difference(t *testing.T, diffs []Difference, metric string) Difference {
+	t.Helper()
+	for _, d := range diffs {
+		if d.Metric == metric {
+			return d
+		}
+	}
+	t.Fatalf("no %s in %+v", metric, diffs)
+	return Difference{}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name       string
+		metric     string
+		baseline   Report
+		candidate  Report
+		change     float64
+		regression bool
+	}{
+		{"rate up", "actual_rate", Report{ActualRate: 200}, Report{ActualRate: 300}, 50, false},
+		{"rate down", "actual_rate", Report{ActualRate: 200}, Report{ActualRate: 100}, -50, true},
+		{"latency down", "latency_p99", Report{Latency: Percentiles{P99: 200}}, Report{Latency: Percentiles{P99: 100}}, -50, false},
+		{"latency up", "latency_p99", Report{Latency: Percentiles{P99: 200}}, Report{Latency: Percentiles{P99: 300}}, 50, true},
+		{"failures up to the threshold", "failed_percent", Report{Requests: 100, Failed: 4}, Report{Requests: 100, Failed: 5}, 25, false},
+		{"failures from none", "failed_percent", Report{Requests: 100}, Report{Requests: 100, Failed: 1}, math.Inf(1), true},
+		{"rate from zero", "success_rate", Report{}, Report{SuccessRate: 10}, math.Inf(1), false},
+		{"both zero", "latency_max", Report{}, Report{}, 0, false},
+		// The threshold is 25%: reaching it is not a regression.
+		{"latency at the threshold", "latency_p50", Report{Latency: Percentiles{P50: 200}}, Report{Latency: Percentiles{P50: 250}}, 25, false},
+		{"latency past the threshold", "latency_p50", Report{Latency: Percentiles{P50: 200}}, Report{Latency: Percentiles{P50: 251}}, 25.5, true},
+		{"rate at the threshold", "actual_rate", Report{ActualRate: 200}, Report{ActualRate: 150}, -25, false},
+		{"rate past the threshold", "actual_rate", Report{ActualRate: 200}, Report{ActualRate: 149}, -25.5, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := difference(t, Compare(tt.baseline, tt.candidate, 25), tt.metric)
+			if d.Change != tt.change || d.Regression != tt.regression {
+				t.Errorf("%s: change %v, regression %v; want %v, %v", tt.metric, d.Change, d.Regression, tt.change, tt.regression)
+			}
+		})
+	}
+}
+
+func TestCompareListsEveryMetric(t *testing.T) {
+	diffs := Compare(Report{}, Report{}, 5)
+	if len(diffs) != 3+len(Percentiles{}.ladder()) {
+		t.Fatalf("%d metrics compared", len(diffs))
+	}
+	for _, d := range diffs {
+		if d.Regression {
+			t.Errorf("%s regressed between two identical reports", d.Metric)
+		}
+	}
+}
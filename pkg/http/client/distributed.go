@@ -0,0 +1,461 @@
+package http_client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	localSetup "ganesh.provengo.io/internal/setup"
+	localLogging "ganesh.provengo.io/pkg/logging"
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// A distributed run uses these subjects under Distributed.Subject:
+//
+//	hello          the ID of each idle agent, every second
+//	plan.<agent>   request carrying the plan of one agent, answered by a planAck
+//	start.<run>    the start time of a run, or its abort
+//	results.<run>  the closed seconds, then the result, of every agent
+const (
+	helloSubject   = ".hello"
+	planSubject    = ".plan."
+	startSubject   = ".start."
+	resultsSubject = ".results."
+)
+
+// Time an agent has to accept its plan.
+const planTimeout = 5 * time.Second
+
+// Plan is a run, or the share of it one agent performs. Agents load the
+// scenario from their own disk and sign with their own credentials, so no
+// secret goes over NATS.
+type Plan struct {
+	RunID    string        `json:"run_id"`
+	Agent    string        `json:"agent,omitempty"`
+	Mode     string        `json:"mode"`
+	URL      string        `json:"url"`
+	Scenario string        `json:"scenario,omitempty"`
+	Workers  int           `json:"workers"`
+	Duration time.Duration `json:"duration"`
+	Rate     float64       `json:"rate,omitempty"`
+	Stages   []Stage       `json:"stages,omitempty"`
+}
+
+// share returns the part of p agent i of n runs: the workers are split as
+// evenly as possible and the rates divided by n.
+func (p Plan) share(i int, n int) Plan {
+	share := p
+	share.Workers = p.Workers / n
+	if i < p.Workers%n {
+		share.Workers++
+	}
+	share.Rate = p.Rate / float64(n)
+	share.Stages = make([]Stage, len(p.Stages))
+	for j, stage := range p.Stages {
+		share.Stages[j] = Stage{Duration: stage.Duration, Target: stage.Target / float64(n)}
+	}
+	return share
+}
+
+func (p Plan) scenario() (*Scenario, error) {
+	if p.Scenario == "" {
+		return DefaultScenario(p.URL), nil
+	}
+	return LoadScenario(p.Scenario, p.URL)
+}
+
+type planAck struct {
+	Scenario string `json:"scenario,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type startMessage struct {
+	StartAt time.Time `json:"start_at"`
+	Abort   bool      `json:"abort,omitempty"`
+}
+
+// secondMessage is one closed second of the time series of an agent, its
+// histogram compressed and base64 encoded.
+type secondMessage struct {
+	Second    int    `json:"second"`
+	Requests  int64  `json:"requests"`
+	Failed    int64  `json:"failed"`
+	Histogram string `json:"histogram"`
+}
+
+// agentResult holds the totals of the recorder of an agent.
+type agentResult struct {
+	Elapsed       time.Duration            `json:"elapsed"`
+	Requests      int64                    `json:"requests"`
+	Failed        int64                    `json:"failed"`
+	StatusCodes   map[string]int64         `json:"status_codes"`
+	ByRequest     map[string]RequestReport `json:"by_request"`
+	MaxLag        time.Duration            `json:"max_lag"`
+	Latency       string                   `json:"latency"`
+	ServiceTime   string                   `json:"service_time"`
+	Connection    string                   `json:"connection"`
+	StageIntended []int64                  `json:"stage_intended,omitempty"`
+	StageAnswered []int64                  `json:"stage_answered,omitempty"`
+}
+
+type agentMessage struct {
+	Agent  string         `json:"agent"`
+	Second *secondMessage `json:"second,omitempty"`
+	Result *agentResult   `json:"result,omitempty"`
+	Error  string         `json:"error,omitempty"`
+}
+
+func encodeHistogram(h *hdrhistogram.Histogram) (string, error) {
+	encoded, err := h.Encode(hdrhistogram.V2CompressedEncodingCookieBase)
+	return string(encoded), err
+}
+
+// mergeHistogram adds the encoded histogram to h.
+func mergeHistogram(h *hdrhistogram.Histogram, encoded string) error {
+	decoded, err := hdrhistogram.Decode([]byte(encoded))
+	if err != nil {
+		return fmt.Errorf("error decoding histogram: %w", err)
+	}
+	h.Merge(decoded)
+	return nil
+}
+
+// result closes the time series of r and packs its totals.
+func (r *Recorder) result(elapsed time.Duration) (*agentResult, error) {
+	r.closeSeconds(r.last + 1)
+	result := &agentResult{
+		Elapsed:       elapsed,
+		Requests:      r.requests,
+		Failed:        r.failed,
+		StatusCodes:   r.statusCodes,
+		ByRequest:     r.byRequest,
+		MaxLag:        r.maxLag,
+		StageIntended: r.stageIntended,
+		StageAnswered: r.stageAnswered,
+	}
+	var errs [3]error
+	result.Latency, errs[0] = encodeHistogram(r.latency)
+	result.ServiceTime, errs[1] = encodeHistogram(r.service)
+	result.Connection, errs[2] = encodeHistogram(r.connection)
+	return result, errors.Join(errs[:]...)
+}
+
+// mergeSecond adds a second of the series of an agent to r.
+func (r *Recorder) mergeSecond(m secondMessage) error {
+	open := r.second(m.Second)
+	if err := mergeHistogram(open.histogram, m.Histogram); err != nil {
+		return err
+	}
+	open.requests += m.Requests
+	open.failed += m.Failed
+	r.closeSeconds(r.last - r.window)
+	return nil
+}
+
+// merge adds the totals of an agent to r.
+func (r *Recorder) merge(result *agentResult) error {
+	r.requests += result.Requests
+	r.failed += result.Failed
+	r.maxLag = max(r.maxLag, result.MaxLag)
+	for class, count := range result.StatusCodes {
+		r.statusCodes[class] += count
+	}
+	for name, count := range result.ByRequest {
+		total := r.byRequest[name]
+		total.Requests += count.Requests
+		total.Failed += count.Failed
+		r.byRequest[name] = total
+	}
+	for i := range min(len(r.stageIntended), len(result.StageIntended), len(result.StageAnswered)) {
+		r.stageIntended[i] += result.StageIntended[i]
+		r.stageAnswered[i] += result.StageAnswered[i]
+	}
+	return errors.Join(
+		mergeHistogram(r.latency, result.Latency),
+		mergeHistogram(r.service, result.ServiceTime),
+		mergeHistogram(r.connection, result.Connection),
+	)
+}
+
+// RunAgent announces the agent on cfg.Subject and runs the plans it is sent,
+// one at a time, until ctx is done.
+func RunAgent(ctx context.Context, nc *nats.Conn, cfg localSetup.Distributed, credentials Credentials) error {
+	logger := localLogging.Component("agent").With("agent", cfg.AgentID)
+	plans := make(chan *nats.Msg, 16)
+	sub, err := nc.ChanSubscribe(cfg.Subject+planSubject+cfg.AgentID, plans)
+	if err != nil {
+		return fmt.Errorf("error subscribing to plans: %w", err)
+	}
+	defer sub.Unsubscribe()
+
+	logger.Info("waiting for plans", "subject", cfg.Subject)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		if err := nc.Publish(cfg.Subject+helloSubject, []byte(cfg.AgentID)); err != nil {
+			logger.Warn("error announcing agent", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case msg := <-plans:
+			runPlan(ctx, nc, cfg, credentials, msg, logger)
+		}
+	}
+}
+
+func runPlan(ctx context.Context, nc *nats.Conn, cfg localSetup.Distributed, credentials Credentials, msg *nats.Msg, logger *slog.Logger) {
+	plan := Plan{}
+	var scenario *Scenario
+	err := json.Unmarshal(msg.Data, &plan)
+	if err == nil {
+		scenario, err = plan.scenario()
+	}
+
+	// Subscribe to the start before accepting, the coordinator sends it as
+	// soon as every agent accepted.
+	var starts *nats.Subscription
+	if err == nil {
+		starts, err = nc.SubscribeSync(cfg.Subject + startSubject + plan.RunID)
+	}
+	ack := planAck{}
+	if err != nil {
+		ack.Error = err.Error()
+	} else {
+		ack.Scenario = scenario.Name
+		defer starts.Unsubscribe()
+	}
+	payload, _ := json.Marshal(ack)
+	if rerr := msg.Respond(payload); rerr != nil {
+		logger.Warn("error answering plan", "error", rerr)
+		return
+	}
+	if err != nil {
+		logger.Error("plan refused", "error", err)
+		return
+	}
+
+	logger = logger.With("run", plan.RunID)
+	waitCtx, cancel := context.WithTimeout(ctx, cfg.JoinTimeout.Duration)
+	defer cancel()
+	startMsg, err := starts.NextMsgWithContext(waitCtx)
+	if err != nil {
+		logger.Error("no start for the run", "error", err)
+		return
+	}
+	start := startMessage{}
+	if err := json.Unmarshal(startMsg.Data, &start); err != nil || start.Abort {
+		logger.Warn("run aborted", "error", err)
+		return
+	}
+	if late := time.Since(start.StartAt); late > time.Second {
+		logger.Warn("start time already passed, are the clocks synchronized?", "late", late)
+	}
+
+	results := cfg.Subject + resultsSubject + plan.RunID
+	publish := func(m agentMessage) {
+		m.Agent = cfg.AgentID
+		payload, err := json.Marshal(m)
+		if err == nil {
+			err = nc.Publish(results, payload)
+		}
+		if err != nil {
+			logger.Warn("error sending results", "error", err)
+		}
+	}
+
+	recorder := NewRecorder(start.StartAt)
+	recorder.onSecond = func(second int, open *openSecond) {
+		encoded, err := encodeHistogram(open.histogram)
+		if err != nil {
+			logger.Warn("error encoding histogram", "second", second, "error", err)
+			return
+		}
+		publish(agentMessage{Second: &secondMessage{Second: second, Requests: open.requests, Failed: open.failed, Histogram: encoded}})
+	}
+
+	logger.Info("run starting", "start_at", start.StartAt, "mode", plan.Mode, "scenario", scenario.Name, "workers", plan.Workers, "rate", plan.Rate)
+	var elapsed time.Duration
+	if plan.Mode == "open" {
+		elapsed = runOpen(scenario, OpenLoad{Rate: plan.Rate, Stages: plan.Stages, Duration: plan.Duration, Workers: plan.Workers}, credentials, recorder)
+	} else {
+		elapsed = runClosed(scenario, plan.Workers, plan.Duration, credentials, recorder)
+	}
+
+	result, err := recorder.result(elapsed)
+	if err != nil {
+		publish(agentMessage{Error: err.Error()})
+	} else {
+		publish(agentMessage{Result: result})
+	}
+	if err := nc.Flush(); err != nil {
+		logger.Warn("error sending results", "error", err)
+	}
+	report := recorder.Report(plan.Mode, scenario.Name, elapsed)
+	logger.Info("run done", "requests", report.Requests, "failed", report.Failed, "actual_rate", report.ActualRate)
+}
+
+// Coordinate waits for cfg.Agents agents, has them run their share of run
+// from the same timestamp and merges what they send back into one report.
+// The report holds the results that arrived when an error is returned.
+func Coordinate(nc *nats.Conn, cfg localSetup.Distributed, run Plan) (Report, error) {
+	logger := localLogging.Component("coordinator")
+	if run.Workers < cfg.Agents {
+		return Report{}, fmt.Errorf("%d workers cannot be spread over %d agents", run.Workers, cfg.Agents)
+	}
+
+	agents, err := join(nc, cfg, logger)
+	if err != nil {
+		return Report{}, err
+	}
+
+	run.RunID = nuid.Next()
+	logger = logger.With("run", run.RunID)
+	messages := make(chan *nats.Msg, 64*1024)
+	sub, err := nc.ChanSubscribe(cfg.Subject+resultsSubject+run.RunID, messages)
+	if err != nil {
+		return Report{}, fmt.Errorf("error subscribing to results: %w", err)
+	}
+	defer sub.Unsubscribe()
+
+	name, err := sendPlans(nc, cfg, run, agents)
+	start := startMessage{StartAt: time.Now().Add(cfg.StartDelay.Duration), Abort: err != nil}
+	payload, _ := json.Marshal(start)
+	if perr := nc.Publish(cfg.Subject+startSubject+run.RunID, payload); perr != nil && err == nil {
+		err = fmt.Errorf("error starting run: %w", perr)
+	}
+	if err != nil {
+		return Report{}, err
+	}
+	logger.Info("run starting", "start_at", start.StartAt, "agents", agents)
+
+	recorder := NewRecorder(start.StartAt)
+	recorder.window = mergeWindow
+	planned := run.Duration
+	if run.Mode == "open" {
+		plan := newProfile(OpenLoad{Rate: run.Rate, Stages: run.Stages, Duration: run.Duration})
+		recorder.withPlan(plan)
+		planned = plan.duration
+	}
+	deadline := time.NewTimer(time.Until(start.StartAt.Add(planned + cfg.JoinTimeout.Duration)))
+	defer deadline.Stop()
+
+	pending := map[string]bool{}
+	for _, agent := range agents {
+		pending[agent] = true
+	}
+	var elapsed time.Duration
+	var errs []error
+	for len(pending) > 0 {
+		var msg *nats.Msg
+		select {
+		case msg = <-messages:
+		case <-deadline.C:
+			missing := make([]string, 0, len(pending))
+			for agent := range pending {
+				missing = append(missing, agent)
+			}
+			slices.Sort(missing)
+			errs = append(errs, fmt.Errorf("no result from %s", strings.Join(missing, ", ")))
+			pending = nil
+			continue
+		}
+
+		m := agentMessage{}
+		if err := json.Unmarshal(msg.Data, &m); err != nil {
+			logger.Warn("invalid agent message", "error", err)
+			continue
+		}
+		if !pending[m.Agent] {
+			continue
+		}
+		switch {
+		case m.Second != nil:
+			if err := recorder.mergeSecond(*m.Second); err != nil {
+				logger.Warn("error merging second", "agent", m.Agent, "second", m.Second.Second, "error", err)
+			}
+		case m.Result != nil:
+			if err := recorder.merge(m.Result); err != nil {
+				errs = append(errs, fmt.Errorf("agent %s: %w", m.Agent, err))
+			}
+			elapsed = max(elapsed, m.Result.Elapsed)
+			delete(pending, m.Agent)
+			logger.Info("agent done", "agent", m.Agent, "requests", m.Result.Requests, "failed", m.Result.Failed)
+		case m.Error != "":
+			errs = append(errs, fmt.Errorf("agent %s: %s", m.Agent, m.Error))
+			delete(pending, m.Agent)
+		}
+	}
+
+	report := recorder.Report(run.Mode, name, elapsed)
+	report.Agents = agents
+	return report, errors.Join(errs...)
+}
+
+// join waits for cfg.Agents distinct agents to announce themselves.
+func join(nc *nats.Conn, cfg localSetup.Distributed, logger *slog.Logger) ([]string, error) {
+	hellos := make(chan *nats.Msg, 256)
+	sub, err := nc.ChanSubscribe(cfg.Subject+helloSubject, hellos)
+	if err != nil {
+		return nil, fmt.Errorf("error subscribing to agents: %w", err)
+	}
+	defer sub.Unsubscribe()
+
+	logger.Info("waiting for agents", "agents", cfg.Agents, "subject", cfg.Subject)
+	timeout := time.NewTimer(cfg.JoinTimeout.Duration)
+	defer timeout.Stop()
+	agents := []string{}
+	for len(agents) < cfg.Agents {
+		select {
+		case msg := <-hellos:
+			agent := string(msg.Data)
+			if agent != "" && !slices.Contains(agents, agent) {
+				agents = append(agents, agent)
+				logger.Info("agent joined", "agent", agent, "agents", len(agents))
+			}
+		case <-timeout.C:
+			return nil, fmt.Errorf("%d of %d agents joined within %s", len(agents), cfg.Agents, cfg.JoinTimeout.Duration)
+		}
+	}
+	slices.Sort(agents)
+	return agents, nil
+}
+
+// sendPlans hands each agent its share of run and returns the name of the
+// scenario the agents loaded.
+func sendPlans(nc *nats.Conn, cfg localSetup.Distributed, run Plan, agents []string) (string, error) {
+	var name string
+	var errs []error
+	for i, agent := range agents {
+		plan := run.share(i, len(agents))
+		plan.Agent = agent
+		payload, err := json.Marshal(plan)
+		if err != nil {
+			return "", err
+		}
+		msg, err := nc.Request(cfg.Subject+planSubject+agent, payload, planTimeout)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("agent %s: %w", agent, err))
+			continue
+		}
+		ack := planAck{}
+		if err := json.Unmarshal(msg.Data, &ack); err != nil {
+			errs = append(errs, fmt.Errorf("agent %s: %w", agent, err))
+			continue
+		}
+		if ack.Error != "" {
+			errs = append(errs, fmt.Errorf("agent %s: %s", agent, ack.Error))
+			continue
+		}
+		name = ack.Scenario
+	}
+	return name, errors.Join(errs...)
+}
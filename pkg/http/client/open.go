@@ -0,0 +1,173 @@
+package http_client
+
+import (
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+// Stage ramps the arrival rate linearly from the rate reached by the
+// previous stage to Target requests per second over Duration.
+type Stage struct {
+	Duration time.Duration `json:"duration"`
+	Target   float64       `json:"target"`
+}
+
+// OpenLoad describes an open model run: requests start at Rate per second,
+// following Stages when set, whatever the latency of the server. Workers
+// bounds the requests in flight, a request that finds them all busy waits
+// and its wait counts in its latency.
+type OpenLoad struct {
+	Rate     float64
+	Stages   []Stage
+	Duration time.Duration
+	Workers  int
+}
+
+type segment struct {
+	start    time.Duration
+	duration time.Duration
+	from     float64
+	to       float64
+	// arrivals is the number of requests scheduled before the segment
+	arrivals float64
+}
+
+// profile is the arrival rate over time, a sequence of linear segments.
+type profile struct {
+	segments []segment
+	duration time.Duration
+}
+
+func newProfile(load OpenLoad) profile {
+	stages := load.Stages
+	if len(stages) == 0 {
+		stages = []Stage{{Duration: load.Duration, Target: load.Rate}}
+	}
+
+	p := profile{}
+	rate := load.Rate
+	arrivals := 0.0
+	for _, stage := range stages {
+		p.segments = append(p.segments, segment{start: p.duration, duration: stage.Duration, from: rate, to: stage.Target, arrivals: arrivals})
+		arrivals += (rate + stage.Target) / 2 * stage.Duration.Seconds()
+		p.duration += stage.Duration
+		rate = stage.Target
+	}
+	return p
+}
+
+// at returns the intended start of the n-th request, counted from 0, as an
+// offset from the start of the run. It solves arrivals(t) = n on the segment
+// holding the n-th arrival, where arrivals(t) = from*t + (to-from)/(2d)*t².
+// ok is false once n is past the end of the run.
+func (p profile) at(n int) (offset time.Duration, ok bool) {
+	for _, s := range p.segments {
+		d := s.duration.Seconds()
+		k := float64(n) - s.arrivals
+		if k >= (s.from+s.to)/2*d {
+			continue
+		}
+
+		a := (s.to - s.from) / (2 * d)
+		var t float64
+		if math.Abs(a) < 1e-12 {
+			if s.from <= 0 {
+				continue
+			}
+			t = k / s.from
+		} else {
+			t = (-s.from + math.Sqrt(s.from*s.from+4*a*k)) / (2 * a)
+		}
+		return s.start + time.Duration(t*float64(time.Second)), true
+	}
+	return 0, false
+}
+
+// StartOpenClient sends the requests of scenario following the arrival rate
+// of load, their think time does not apply. The report measures latencies
+// from the intended start of each request, which includes the time it
+// waited for a free worker.
+func StartOpenClient(scenario *Scenario, load OpenLoad, credentials Credentials) Report {
+	recorder := NewRecorder(time.Now())
+	elapsed := runOpen(scenario, load, credentials, recorder)
+	return recorder.Report("open", scenario.Name, elapsed)
+}
+
+// runOpen runs the open mode from the start of recorder, which may be
+// ahead, and returns the time the run took.
+func runOpen(scenario *Scenario, load OpenLoad, credentials Credentials, recorder *Recorder) time.Duration {
+	plan := newProfile(load)
+	client := newHTTPClient(load.Workers)
+	due := make(chan time.Time, load.Workers)
+	responseChannel := make(chan StatusQuery, load.Workers)
+	returnChannel := make(chan *Recorder)
+
+	start := recorder.start
+	startSignal := sync.WaitGroup{}
+	go LogStatus(responseChannel, returnChannel, recorder.withPlan(plan), &startSignal)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < load.Workers; i++ {
+		wg.Add(1)
+		go func(goId int) {
+			defer wg.Done()
+			for intended := range due {
+				started := time.Now()
+				req, name, _, err := scenario.next(credentials)
+				if err != nil {
+					slog.Error("invalid request", "scenario", scenario.Name, "request", name, "error", err)
+					responseChannel <- StatusQuery{Worker: goId, Intended: intended, TimesStamp: started, TotalTime: time.Since(intended), Name: name}
+					continue
+				}
+				statusCode, bodyLength, connectionTime := send(client, req)
+				done := time.Now()
+				responseChannel <- StatusQuery{
+					Worker:         goId,
+					StatusCode:     statusCode,
+					ConnectionTime: connectionTime,
+					TotalTime:      done.Sub(intended),
+					ServiceTime:    done.Sub(started),
+					TotalBytes:     bodyLength,
+					Intended:       intended,
+					TimesStamp:     started,
+					Name:           name,
+				}
+			}
+		}(i)
+	}
+
+	// The schedule does not depend on the answers: when every worker is
+	// busy the scheduler blocks, but the requests keep the start time they
+	// were meant to have.
+	scheduled := 0
+	for ; ; scheduled++ {
+		offset, ok := plan.at(scheduled)
+		if !ok {
+			break
+		}
+		intended := start.Add(offset)
+		if wait := time.Until(intended); wait > 0 {
+			time.Sleep(wait)
+		}
+		due <- intended
+	}
+	close(due)
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(responseChannel)
+
+	<-returnChannel
+	return elapsed
+}
+
+// stageOf returns the index of the segment holding offset, -1 after the end.
+func (p profile) stageOf(offset time.Duration) int {
+	for i, s := range p.segments {
+		if offset < s.start+s.duration {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,116 @@
+package http_client
+
+import (
+	"testing"
+	"time"
+)
+
+// schedule returns every intended start of load.
+func schedule(t *testing.T, load OpenLoad) []time.Duration {
+	t.Helper()
+	p := newProfile(load)
+	var offsets []time.Duration
+	for n := 0; ; n++ {
+		offset, ok := p.at(n)
+		if !ok {
+			return offsets
+		}
+		if n > 1_000_000 {
+			t.Fatal("the schedule does not end")
+		}
+		offsets = append(offsets, offset)
+	}
+}
+
+func TestProfileSchedule(t *testing.T) {
+	tests := []struct {
+		name string
+		load OpenLoad
+		// arrivals expected before each boundary
+		until    []time.Duration
+		arrivals []int
+	}{
+		{
+			name:  "flat rate",
+			load:  OpenLoad{Rate: 100, Duration: 2 * time.Second},
+			until: []time.Duration{time.Second, 2 * time.Second}, arrivals: []int{100, 200},
+		},
+		{
+			name:  "ramp up from 0",
+			load:  OpenLoad{Stages: []Stage{{Duration: 2 * time.Second, Target: 100}}},
+			until: []time.Duration{time.Second, 2 * time.Second}, arrivals: []int{25, 100},
+		},
+		{
+			name:  "ramp down to 0",
+			load:  OpenLoad{Rate: 100, Stages: []Stage{{Duration: 2 * time.Second, Target: 0}}},
+			until: []time.Duration{time.Second, 2 * time.Second}, arrivals: []int{75, 100},
+		},
+		{
+			name: "several stages",
+			load: OpenLoad{Rate: 0, Stages: []Stage{
+				{Duration: time.Second, Target: 100},
+				{Duration: 2 * time.Second, Target: 100},
+				{Duration: time.Second, Target: 300},
+				{Duration: time.Second, Target: 0},
+			}},
+			until:    []time.Duration{time.Second, 3 * time.Second, 4 * time.Second, 5 * time.Second},
+			arrivals: []int{50, 250, 450, 600},
+		},
+		{
+			name:  "idle stage",
+			load:  OpenLoad{Stages: []Stage{{Duration: time.Second, Target: 0}, {Duration: time.Second, Target: 0}}},
+			until: []time.Duration{2 * time.Second}, arrivals: []int{0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			offsets := schedule(t, tt.load)
+			if want := tt.arrivals[len(tt.arrivals)-1]; len(offsets) != want {
+				t.Fatalf("%d arrivals, want %d", len(offsets), want)
+			}
+			for i, offset := range offsets {
+				if offset < 0 || offset >= tt.until[len(tt.until)-1] {
+					t.Fatalf("arrival %d at %s, outside the run", i, offset)
+				}
+				if i > 0 && offset <= offsets[i-1] {
+					t.Fatalf("arrival %d at %s, not after %s", i, offset, offsets[i-1])
+				}
+			}
+			for i, until := range tt.until {
+				got := 0
+				for _, offset := range offsets {
+					if offset < until {
+						got++
+					}
+				}
+				// A boundary may fall on the instant of an arrival.
+				if got != tt.arrivals[i] && got != tt.arrivals[i]-1 {
+					t.Errorf("%d arrivals before %s, want %d", got, until, tt.arrivals[i])
+				}
+			}
+		})
+	}
+}
+
+func TestProfileFlatRateIsEvenlySpaced(t *testing.T) {
+	offsets := schedule(t, OpenLoad{Rate: 50, Duration: time.Second})
+	for i, offset := range offsets {
+		if want := time.Duration(i) * 20 * time.Millisecond; offset != want {
+			t.Fatalf("arrival %d at %s, want %s", i, offset, want)
+		}
+	}
+}
+
+func TestProfileStageOf(t *testing.T) {
+	p := newProfile(OpenLoad{Stages: []Stage{{Duration: time.Second, Target: 10}, {Duration: 2 * time.Second, Target: 10}}})
+	for _, tt := range []struct {
+		offset time.Duration
+		want   int
+	}{
+		{0, 0}, {999 * time.Millisecond, 0}, {time.Second, 1}, {3*time.Second - 1, 1}, {3 * time.Second, -1},
+	} {
+		if got := p.stageOf(tt.offset); got != tt.want {
+			t.Errorf("stageOf(%s) = %d, want %d", tt.offset, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,444 @@
+package http_client
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// Histograms record microseconds, from 1µs to one hour with 3 significant
+// digits, whatever the number of samples.
+const (
+	lowestLatency  = 1
+	highestLatency = int64(time.Hour / time.Microsecond)
+	latencyDigits  = 3
+)
+
+// Results older than this, by completion time, close their second of the
+// time series. Requests complete almost in order, a late one is counted in
+// the last open second.
+const seriesWindow = 2
+
+// The coordinator of a distributed run gets the seconds of every agent over
+// NATS, with more delay between them.
+const mergeWindow = 10
+
+var statusClasses = []string{"2xx", "3xx", "4xx", "5xx", "error"}
+
+// Percentiles is a latency distribution in milliseconds.
+type Percentiles struct {
+	Min   float64 `json:"min"`
+	Mean  float64 `json:"mean"`
+	P50   float64 `json:"p50"`
+	P75   float64 `json:"p75"`
+	P90   float64 `json:"p90"`
+	P95   float64 `json:"p95"`
+	P99   float64 `json:"p99"`
+	P999  float64 `json:"p99_9"`
+	P9999 float64 `json:"p99_99"`
+	Max   float64 `json:"max"`
+}
+
+// ladder lists the percentiles of a report in order, for printing and
+// comparing.
+func (p Percentiles) ladder() []struct {
+	Name  string
+	Value float64
+} {
+	return []struct {
+		Name  string
+		Value float64
+	}{
+		{"p50", p.P50}, {"p75", p.P75}, {"p90", p.P90}, {"p95", p.P95}, {"p99", p.P99},
+		{"p99.9", p.P999}, {"p99.99", p.P9999}, {"max", p.Max},
+	}
+}
+
+func percentiles(h *hdrhistogram.Histogram) Percentiles {
+	ms := func(v int64) float64 { return float64(v) / 1000 }
+	if h.TotalCount() == 0 {
+		return Percentiles{}
+	}
+	return Percentiles{
+		Min:   ms(h.Min()),
+		Mean:  h.Mean() / 1000,
+		P50:   ms(h.ValueAtPercentile(50)),
+		P75:   ms(h.ValueAtPercentile(75)),
+		P90:   ms(h.ValueAtPercentile(90)),
+		P95:   ms(h.ValueAtPercentile(95)),
+		P99:   ms(h.ValueAtPercentile(99)),
+		P999:  ms(h.ValueAtPercentile(99.9)),
+		P9999: ms(h.ValueAtPercentile(99.99)),
+		Max:   ms(h.Max()),
+	}
+}
+
+// Second is one point of the time series, by completion time.
+type Second struct {
+	Second   int     `json:"second"`
+	Requests int64   `json:"requests"`
+	Failed   int64   `json:"failed"`
+	P50      float64 `json:"p50"`
+	P99      float64 `json:"p99"`
+	Max      float64 `json:"max"`
+}
+
+// RequestReport counts the requests of one kind of a scenario.
+type RequestReport struct {
+	Requests int64 `json:"requests"`
+	Failed   int64 `json:"failed"`
+}
+
+type StageReport struct {
+	Duration     string  `json:"duration"`
+	From         float64 `json:"from"`
+	To           float64 `json:"to"`
+	IntendedRate float64 `json:"intended_rate"`
+	ActualRate   float64 `json:"actual_rate"`
+}
+
+// Report is the outcome of a load test. Rates are per second and latencies
+// in milliseconds. Latency runs from the intended start of each request, it
+// equals ServiceTime in closed mode. Failed counts the answers other than
+// 2xx and the requests that got no answer. URL is the target of the default
+// scenario, or the name of the scenario file.
+type Report struct {
+	Mode         string           `json:"mode"`
+	URL          string           `json:"url"`
+	StartedAt    time.Time        `json:"started_at"`
+	Elapsed      float64          `json:"elapsed_seconds"`
+	Planned      float64          `json:"planned_seconds,omitempty"`
+	Requests     int64            `json:"requests"`
+	Failed       int64            `json:"failed"`
+	StatusCodes  map[string]int64 `json:"status_codes"`
+	IntendedRate float64          `json:"intended_rate,omitempty"`
+	ActualRate   float64          `json:"actual_rate"`
+	SuccessRate  float64          `json:"success_rate"`
+	MaxStartLag  float64          `json:"max_start_lag,omitempty"`
+	Latency      Percentiles      `json:"latency"`
+	ServiceTime  Percentiles      `json:"service_time"`
+	Connection   Percentiles      `json:"connection"`
+	Stages       []StageReport    `json:"stages,omitempty"`
+	// ByRequest splits the requests by scenario request name
+	ByRequest map[string]RequestReport `json:"by_request,omitempty"`
+	// Agents ran a distributed test, their results are merged
+	Agents []string `json:"agents,omitempty"`
+	Series []Second `json:"series"`
+}
+
+type openSecond struct {
+	requests  int64
+	failed    int64
+	histogram *hdrhistogram.Histogram
+}
+
+// Recorder aggregates the results of a run in constant memory: every
+// distribution is an HDR histogram and the time series only keeps the last
+// seconds open.
+type Recorder struct {
+	start       time.Time
+	plan        *profile
+	latency     *hdrhistogram.Histogram
+	service     *hdrhistogram.Histogram
+	connection  *hdrhistogram.Histogram
+	statusCodes map[string]int64
+	requests    int64
+	failed      int64
+	maxLag      time.Duration
+	byRequest   map[string]RequestReport
+
+	open   map[int]*openSecond
+	spare  []*hdrhistogram.Histogram
+	series []Second
+	last   int
+	window int
+	// onSecond, when set, gets each second of the series as it closes,
+	// before its histogram is reused.
+	onSecond func(second int, open *openSecond)
+
+	stageIntended []int64
+	stageAnswered []int64
+}
+
+func newHistogram() *hdrhistogram.Histogram {
+	return hdrhistogram.New(lowestLatency, highestLatency, latencyDigits)
+}
+
+func NewRecorder(start time.Time) *Recorder {
+	return &Recorder{
+		start:       start,
+		latency:     newHistogram(),
+		service:     newHistogram(),
+		connection:  newHistogram(),
+		statusCodes: map[string]int64{},
+		byRequest:   map[string]RequestReport{},
+		open:        map[int]*openSecond{},
+		window:      seriesWindow,
+	}
+}
+
+// withPlan makes the recorder count the requests of each stage of plan.
+func (r *Recorder) withPlan(plan profile) *Recorder {
+	r.plan = &plan
+	r.stageIntended = make([]int64, len(plan.segments))
+	r.stageAnswered = make([]int64, len(plan.segments))
+	return r
+}
+
+func micros(d time.Duration) int64 {
+	return min(max(d.Microseconds(), lowestLatency), highestLatency)
+}
+
+func (r *Recorder) Record(q StatusQuery) {
+	r.requests++
+	_ = r.latency.RecordValue(micros(q.TotalTime))
+	_ = r.service.RecordValue(micros(q.ServiceTime))
+	_ = r.connection.RecordValue(micros(q.ConnectionTime))
+	r.maxLag = max(r.maxLag, q.TimesStamp.Sub(q.Intended))
+
+	class := "error"
+	if q.StatusCode != 0 {
+		class = fmt.Sprintf("%dxx", q.StatusCode/100)
+	}
+	r.statusCodes[class]++
+	failed := class != "2xx"
+	if failed {
+		r.failed++
+	}
+	byRequest := r.byRequest[q.Name]
+	byRequest.Requests++
+	if failed {
+		byRequest.Failed++
+	}
+	r.byRequest[q.Name] = byRequest
+
+	done := q.Intended.Add(q.TotalTime)
+	if r.plan != nil {
+		if i := r.plan.stageOf(q.Intended.Sub(r.start)); i >= 0 {
+			r.stageIntended[i]++
+		}
+		if i := r.plan.stageOf(done.Sub(r.start)); i >= 0 && q.StatusCode != 0 {
+			r.stageAnswered[i]++
+		}
+	}
+
+	open := r.second(int(done.Sub(r.start) / time.Second))
+	open.requests++
+	if failed {
+		open.failed++
+	}
+	_ = open.histogram.RecordValue(micros(q.TotalTime))
+	r.closeSeconds(r.last - r.window)
+}
+
+// second returns the open second of the series counting the completions at
+// second, or the oldest one open when it is already closed.
+func (r *Recorder) second(second int) *openSecond {
+	second = max(second, r.last-r.window)
+	r.last = max(r.last, second)
+	open, ok := r.open[second]
+	if !ok {
+		open = &openSecond{histogram: r.histogram()}
+		r.open[second] = open
+	}
+	return open
+}
+
+func (r *Recorder) histogram() *hdrhistogram.Histogram {
+	if n := len(r.spare); n > 0 {
+		h := r.spare[n-1]
+		r.spare = r.spare[:n-1]
+		return h
+	}
+	return newHistogram()
+}
+
+// closeSeconds moves the open seconds before until to the series.
+func (r *Recorder) closeSeconds(until int) {
+	for second, open := range r.open {
+		if second >= until {
+			continue
+		}
+		if r.onSecond != nil {
+			r.onSecond(second, open)
+		}
+		p := percentiles(open.histogram)
+		r.series = append(r.series, Second{Second: second, Requests: open.requests, Failed: open.failed, P50: p.P50, P99: p.P99, Max: p.Max})
+		open.histogram.Reset()
+		r.spare = append(r.spare, open.histogram)
+		delete(r.open, second)
+	}
+}
+
+// Report closes the time series and summarizes the run.
+func (r *Recorder) Report(mode string, scenario string, elapsed time.Duration) Report {
+	r.closeSeconds(r.last + 1)
+	series := make([]Second, 0, r.last+1)
+	bySecond := make(map[int]Second, len(r.series))
+	for _, s := range r.series {
+		bySecond[s.Second] = s
+	}
+	// Seconds without any completion are reported as such.
+	for second := 0; second <= r.last && len(r.series) > 0; second++ {
+		s, ok := bySecond[second]
+		if !ok {
+			s = Second{Second: second}
+		}
+		series = append(series, s)
+	}
+
+	report := Report{
+		Mode:        mode,
+		URL:         scenario,
+		StartedAt:   r.start,
+		Elapsed:     elapsed.Seconds(),
+		Requests:    r.requests,
+		Failed:      r.failed,
+		StatusCodes: map[string]int64{},
+		Latency:     percentiles(r.latency),
+		ServiceTime: percentiles(r.service),
+		Connection:  percentiles(r.connection),
+		ByRequest:   r.byRequest,
+		Series:      series,
+	}
+	for _, class := range statusClasses {
+		report.StatusCodes[class] = r.statusCodes[class]
+	}
+	if elapsed > 0 {
+		report.ActualRate = float64(r.requests-r.statusCodes["error"]) / elapsed.Seconds()
+		report.SuccessRate = float64(r.statusCodes["2xx"]) / elapsed.Seconds()
+	}
+
+	if r.plan != nil {
+		report.Planned = r.plan.duration.Seconds()
+		report.IntendedRate = float64(r.requests) / r.plan.duration.Seconds()
+		report.MaxStartLag = float64(r.maxLag.Microseconds()) / 1000
+		for i, s := range r.plan.segments {
+			report.Stages = append(report.Stages, StageReport{
+				Duration:     s.duration.String(),
+				From:         s.from,
+				To:           s.to,
+				IntendedRate: float64(r.stageIntended[i]) / s.duration.Seconds(),
+				ActualRate:   float64(r.stageAnswered[i]) / s.duration.Seconds(),
+			})
+		}
+	}
+	return report
+}
+
+// Print writes the report in the text format of the earlier runs kept in
+// tests/results.
+func (r Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "Total Access: %d Access Rate: %.1f Elapsed Time: %v\n", r.Requests, r.ActualRate, time.Duration(r.Elapsed*float64(time.Second)).Round(time.Millisecond))
+	if len(r.Agents) > 0 {
+		fmt.Fprintf(w, "Agents: %d (%s)\n", len(r.Agents), strings.Join(r.Agents, ", "))
+	}
+	if r.Mode == "open" {
+		fmt.Fprintf(w, "Intended Rate: %.1f/s Actual Rate: %.1f/s Success Rate: %.1f/s Max Start Lag: %.3fms\n", r.IntendedRate, r.ActualRate, r.SuccessRate, r.MaxStartLag)
+	}
+	for _, class := range statusClasses {
+		fmt.Fprintf(w, "Status Code %s: %d\n", class, r.StatusCodes[class])
+	}
+	for i, s := range r.Stages {
+		fmt.Fprintf(w, "Stage %d %s %.0f/s -> %.0f/s: Intended Rate: %.1f/s Actual Rate: %.1f/s\n", i+1, s.Duration, s.From, s.To, s.IntendedRate, s.ActualRate)
+	}
+
+	if len(r.ByRequest) > 1 {
+		names := make([]string, 0, len(r.ByRequest))
+		for name := range r.ByRequest {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "Request %s: %d Failed: %d\n", name, r.ByRequest[name].Requests, r.ByRequest[name].Failed)
+		}
+	}
+
+	printLadder := func(name string, p Percentiles) {
+		fmt.Fprintf(w, "%s (ms): mean %.3f", name, p.Mean)
+		for _, step := range p.ladder() {
+			fmt.Fprintf(w, " %s %.3f", step.Name, step.Value)
+		}
+		fmt.Fprintln(w)
+	}
+	if r.Mode == "open" {
+		printLadder("Latency from Intended Start", r.Latency)
+	}
+	printLadder("Service Time", r.ServiceTime)
+	printLadder("Connection Time", r.Connection)
+}
+
+// Write stores the report in dir as <name>.json, the time series as
+// <name>.csv and the percentile ladders as <name>-percentiles.csv, and
+// returns the paths written.
+func (r Report) Write(dir string, name string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	base := filepath.Join(dir, name)
+
+	payload, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(base+".json", append(payload, '\n'), 0o644); err != nil {
+		return nil, err
+	}
+
+	series := [][]string{{"second", "requests", "failed", "p50_ms", "p99_ms", "max_ms"}}
+	for _, s := range r.Series {
+		series = append(series, []string{strconv.Itoa(s.Second), strconv.FormatInt(s.Requests, 10), strconv.FormatInt(s.Failed, 10),
+			formatMs(s.P50), formatMs(s.P99), formatMs(s.Max)})
+	}
+	if err := writeCSV(base+".csv", series); err != nil {
+		return nil, err
+	}
+
+	ladder := [][]string{{"percentile", "latency_ms", "service_time_ms", "connection_ms"}}
+	service, connection := r.ServiceTime.ladder(), r.Connection.ladder()
+	for i, step := range r.Latency.ladder() {
+		ladder = append(ladder, []string{step.Name, formatMs(step.Value), formatMs(service[i].Value), formatMs(connection[i].Value)})
+	}
+	if err := writeCSV(base+"-percentiles.csv", ladder); err != nil {
+		return nil, err
+	}
+	return []string{base + ".json", base + ".csv", base + "-percentiles.csv"}, nil
+}
+
+func formatMs(v float64) string {
+	return strconv.FormatFloat(v, 'f', 3, 64)
+}
+
+func writeCSV(path string, rows [][]string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(file)
+	if err := w.WriteAll(rows); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func ReadReport(path string) (Report, error) {
+	report := Report{}
+	payload, err := os.ReadFile(path)
+	if err != nil {
+		return report, err
+	}
+	if err := json.Unmarshal(payload, &report); err != nil {
+		return report, fmt.Errorf("%s: %w", path, err)
+	}
+	return report, nil
+}
@@ -0,0 +1,85 @@
+package http_client
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRecorderReportsShortRuns(t *testing.T) {
+	start := time.Now()
+	query := func(status int, after, took time.Duration) StatusQuery {
+		intended := start.Add(after)
+		return StatusQuery{StatusCode: status, Intended: intended, TimesStamp: intended, TotalTime: took, ServiceTime: took, ConnectionTime: took / 2, Name: "send-user"}
+	}
+
+	tests := []struct {
+		name    string
+		queries []StatusQuery
+		elapsed time.Duration
+		rate    float64
+		success float64
+		failed  int64
+		seconds int
+	}{
+		{name: "no request, no time"},
+		{name: "requests in no time", queries: []StatusQuery{query(200, 0, time.Millisecond)}, seconds: 1},
+		{
+			name: "sub-second run",
+			queries: []StatusQuery{
+				query(200, 0, 10*time.Millisecond),
+				query(200, 100*time.Millisecond, 20*time.Millisecond),
+				query(500, 200*time.Millisecond, 30*time.Millisecond),
+				query(0, 300*time.Millisecond, 40*time.Millisecond),
+			},
+			elapsed: 400 * time.Millisecond, rate: 3 / 0.4, success: 2 / 0.4, failed: 2, seconds: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := NewRecorder(start)
+			for _, q := range tt.queries {
+				recorder.Record(q)
+			}
+			report := recorder.Report("closed", "test", tt.elapsed)
+
+			if report.Requests != int64(len(tt.queries)) || report.Failed != tt.failed {
+				t.Errorf("requests %d, failed %d; want %d, %d", report.Requests, report.Failed, len(tt.queries), tt.failed)
+			}
+			for _, v := range []float64{report.ActualRate, report.SuccessRate, report.Latency.Mean, report.ServiceTime.Max} {
+				if math.IsNaN(v) || math.IsInf(v, 0) {
+					t.Fatalf("non finite value in %+v", report)
+				}
+			}
+			if math.Abs(report.ActualRate-tt.rate) > 1e-9 || math.Abs(report.SuccessRate-tt.success) > 1e-9 {
+				t.Errorf("actual rate %f, success rate %f; want %f, %f", report.ActualRate, report.SuccessRate, tt.rate, tt.success)
+			}
+			if len(report.Series) != tt.seconds {
+				t.Fatalf("series %+v, want %d seconds", report.Series, tt.seconds)
+			}
+			if tt.seconds > 0 && report.Series[0].Requests != int64(len(tt.queries)) {
+				t.Errorf("second 0 counts %d requests, want %d", report.Series[0].Requests, len(tt.queries))
+			}
+		})
+	}
+}
+
+func TestRecorderPercentiles(t *testing.T) {
+	start := time.Now()
+	recorder := NewRecorder(start)
+	for i := 1; i <= 1000; i++ {
+		recorder.Record(StatusQuery{StatusCode: 200, Intended: start, TimesStamp: start, TotalTime: time.Duration(i) * time.Millisecond})
+	}
+	latency := recorder.Report("closed", "test", 2*time.Second).Latency
+	// HDR histograms keep 3 significant digits.
+	for _, tt := range []struct {
+		name      string
+		got, want float64
+	}{
+		{"min", latency.Min, 1}, {"p50", latency.P50, 500}, {"p99", latency.P99, 990}, {"max", latency.Max, 1000},
+	} {
+		if math.Abs(tt.got-tt.want) > tt.want/1000 {
+			t.Errorf("%s = %.3fms, want %.0fms", tt.name, tt.got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package http_client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	localSetup "ganesh.provengo.io/internal/setup"
+	"ganesh.provengo.io/pkg/http/signing"
+	fkrV4 "github.com/go-faker/faker/v4"
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+// Longest line read from a replay file.
+const maxReplayLine = 4 << 20
+
+// ScenarioRequest is one kind of request of a scenario. Path, header values
+// and Body are templates, see templateFuncs. With Replay, bodies are read in
+// turn from a JSONL file instead, one per line, starting over at the end;
+// ReplayField sends one field of each line rather than the whole line.
+type ScenarioRequest struct {
+	Name         string              `yaml:"name" json:"name"`
+	Weight       int                 `yaml:"weight" json:"weight"`
+	Method       string              `yaml:"method" json:"method"`
+	Path         string              `yaml:"path" json:"path"`
+	Headers      map[string]string   `yaml:"headers" json:"headers"`
+	Body         string              `yaml:"body" json:"body"`
+	Replay       string              `yaml:"replay" json:"replay"`
+	ReplayField  string              `yaml:"replay_field" json:"replay_field"`
+	ThinkTime    localSetup.Duration `yaml:"think_time" json:"think_time"`
+	ThinkTimeMax localSetup.Duration `yaml:"think_time_max" json:"think_time_max"`
+}
+
+// ScenarioFile is the content of a YAML or JSON scenario. BaseURL defaults
+// to the scheme and host of http_client.url.
+type ScenarioFile struct {
+	Name     string            `yaml:"name" json:"name"`
+	BaseURL  string            `yaml:"base_url" json:"base_url"`
+	Requests []ScenarioRequest `yaml:"requests" json:"requests"`
+}
+
+// templateData holds the values shared by the path, headers and body of one
+// request, so /keep-alive/{{.UUID}} and a body using {{.UUID}} agree.
+type templateData struct {
+	UUID      string
+	Sequence  int64
+	Timestamp int64
+}
+
+var templateFuncs = template.FuncMap{
+	"uuid":       func() string { return uuid.New().String() },
+	"now_ms":     func() int64 { return time.Now().UnixMilli() },
+	"int":        func(min int, max int) int { return min + rand.IntN(max-min+1) },
+	"username":   func() string { return fkrV4.Username() },
+	"password":   func() string { return fkrV4.Password() },
+	"email":      func() string { return fkrV4.Email() },
+	"name":       func() string { return fkrV4.Name() },
+	"first_name": func() string { return fkrV4.FirstName() },
+	"last_name":  func() string { return fkrV4.LastName() },
+	"phone":      func() string { return fkrV4.Phonenumber() },
+	"ipv4":       func() string { return fkrV4.IPv4() },
+	"word":       func() string { return fkrV4.Word() },
+	"sentence":   func() string { return fkrV4.Sentence() },
+	// json quotes a value for a JSON body: "name":{{json name}}
+	"json": func(v any) (string, error) {
+		payload, err := json.Marshal(v)
+		return string(payload), err
+	},
+}
+
+type scenarioEntry struct {
+	ScenarioRequest
+	path    *template.Template
+	body    *template.Template
+	headers map[string]*template.Template
+	// static builds the body of a request sent to its Path as is
+	static func(data templateData) []byte
+	replay *replaySource
+}
+
+// Scenario picks requests at random according to their weight.
+type Scenario struct {
+	Name        string
+	baseURL     string
+	entries     []scenarioEntry
+	totalWeight int
+	sequence    atomic.Int64
+}
+
+// DefaultScenario posts the sample user to target, the behaviour of the
+// client without a scenario file.
+func DefaultScenario(target string) *Scenario {
+	return &Scenario{
+		Name:        target,
+		entries:     []scenarioEntry{{ScenarioRequest: ScenarioRequest{Name: "send-user", Weight: 1, Method: "POST", Path: target}, static: sampleUser}},
+		totalWeight: 1,
+	}
+}
+
+// LoadScenario reads a scenario from a .json, .yaml or .yml file. Replay
+// files are resolved relative to the scenario.
+func LoadScenario(path string, defaultURL string) (*Scenario, error) {
+	payload, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading scenario: %w", err)
+	}
+	file := ScenarioFile{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(payload, &file)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(payload, &file)
+	default:
+		return nil, fmt.Errorf("scenario %s: unsupported extension, use .json, .yaml or .yml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing scenario %s: %w", path, err)
+	}
+
+	if file.BaseURL == "" {
+		parsed, err := url.Parse(defaultURL)
+		if err != nil {
+			return nil, fmt.Errorf("scenario %s: invalid http_client.url: %w", path, err)
+		}
+		file.BaseURL = parsed.Scheme + "://" + parsed.Host
+	}
+	if file.Name == "" {
+		file.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+
+	scenario := &Scenario{Name: file.Name, baseURL: strings.TrimSuffix(file.BaseURL, "/")}
+	if len(file.Requests) == 0 {
+		return nil, fmt.Errorf("scenario %s: no requests", path)
+	}
+	var errs []error
+	for i, request := range file.Requests {
+		entry, err := compileRequest(request, filepath.Dir(path))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("requests[%d]: %w", i, err))
+			continue
+		}
+		if entry.Name == "" {
+			entry.Name = fmt.Sprintf("%s %s", entry.Method, entry.ScenarioRequest.Path)
+		}
+		scenario.entries = append(scenario.entries, entry)
+		scenario.totalWeight += entry.Weight
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid scenario %s: %w", path, errors.Join(errs...))
+	}
+	return scenario, nil
+}
+
+func compileRequest(request ScenarioRequest, dir string) (scenarioEntry, error) {
+	entry := scenarioEntry{ScenarioRequest: request, headers: map[string]*template.Template{}}
+	entry.Method = strings.ToUpper(request.Method)
+	if entry.Method == "" {
+		entry.Method = http.MethodGet
+	}
+	if entry.Weight == 0 {
+		entry.Weight = 1
+	}
+
+	var errs []error
+	if entry.Weight < 0 {
+		errs = append(errs, errors.New("weight must be positive"))
+	}
+	if !strings.HasPrefix(request.Path, "/") {
+		errs = append(errs, fmt.Errorf("path %q must start with /", request.Path))
+	}
+	if request.ThinkTime.Duration < 0 || (request.ThinkTimeMax.Duration != 0 && request.ThinkTimeMax.Duration < request.ThinkTime.Duration) {
+		errs = append(errs, errors.New("think_time must not be negative nor above think_time_max"))
+	}
+	if request.Body != "" && request.Replay != "" {
+		errs = append(errs, errors.New("body and replay are exclusive"))
+	}
+
+	var err error
+	if entry.path, err = template.New("path").Funcs(templateFuncs).Parse(request.Path); err != nil {
+		errs = append(errs, err)
+	}
+	if request.Body != "" {
+		if entry.body, err = template.New("body").Funcs(templateFuncs).Parse(request.Body); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for name, value := range request.Headers {
+		if entry.headers[name], err = template.New(name).Funcs(templateFuncs).Parse(value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if request.Replay != "" {
+		replay := request.Replay
+		if !filepath.IsAbs(replay) {
+			replay = filepath.Join(dir, replay)
+		}
+		if entry.replay, err = newReplaySource(replay, request.ReplayField); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return entry, errors.Join(errs...)
+}
+
+func (s *Scenario) pick() *scenarioEntry {
+	n := rand.IntN(s.totalWeight)
+	for i := range s.entries {
+		if n < s.entries[i].Weight {
+			return &s.entries[i]
+		}
+		n -= s.entries[i].Weight
+	}
+	return &s.entries[len(s.entries)-1]
+}
+
+func render(t *template.Template, data templateData) (string, error) {
+	var out bytes.Buffer
+	if err := t.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// next builds the next request of the scenario and returns the name of its
+// kind and the time to think after it.
+func (s *Scenario) next(credentials Credentials) (*http.Request, string, time.Duration, error) {
+	entry := s.pick()
+	data := templateData{UUID: uuid.New().String(), Sequence: s.sequence.Add(1), Timestamp: time.Now().UnixMilli()}
+
+	target := entry.ScenarioRequest.Path
+	var body []byte
+	if entry.static == nil {
+		path, err := render(entry.path, data)
+		if err != nil {
+			return nil, entry.Name, 0, err
+		}
+		target = s.baseURL + path
+
+		switch {
+		case entry.replay != nil:
+			if body, err = entry.replay.next(); err != nil {
+				return nil, entry.Name, 0, err
+			}
+		case entry.body != nil:
+			rendered, err := render(entry.body, data)
+			if err != nil {
+				return nil, entry.Name, 0, err
+			}
+			body = []byte(rendered)
+		}
+	} else {
+		body = entry.static(data)
+	}
+
+	req, err := http.NewRequest(entry.Method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, entry.Name, 0, err
+	}
+	if len(body) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range entry.headers {
+		rendered, err := render(value, data)
+		if err != nil {
+			return nil, entry.Name, 0, err
+		}
+		req.Header.Set(name, rendered)
+	}
+	if credentials.ClientID != "" {
+		signing.Sign(req, body, credentials.ClientID, credentials.Secret)
+	}
+
+	think := entry.ThinkTime.Duration
+	if spread := entry.ThinkTimeMax.Duration - think; spread > 0 {
+		think += rand.N(spread)
+	}
+	return req, entry.Name, think, nil
+}
+
+// replaySource hands out the lines of a JSONL file in order, from the start
+// again after the last one, to any number of workers.
+type replaySource struct {
+	mu      sync.Mutex
+	path    string
+	field   string
+	file    *os.File
+	scanner *bufio.Scanner
+	line    int
+}
+
+func newReplaySource(path string, field string) (*replaySource, error) {
+	r := &replaySource{path: path, field: field}
+	if err := r.rewind(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *replaySource) rewind() error {
+	if r.file != nil {
+		_ = r.file.Close()
+	}
+	file, err := os.Open(r.path)
+	if err != nil {
+		return fmt.Errorf("error opening replay file: %w", err)
+	}
+	r.file = file
+	r.scanner = bufio.NewScanner(file)
+	r.scanner.Buffer(make([]byte, 0, 64*1024), maxReplayLine)
+	r.line = 0
+	return nil
+}
+
+func (r *replaySource) next() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for rewound := false; ; {
+		for r.scanner.Scan() {
+			r.line++
+			line := bytes.TrimSpace(r.scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			return r.extract(line)
+		}
+		if err := r.scanner.Err(); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", r.path, r.line+1, err)
+		}
+		if rewound {
+			return nil, fmt.Errorf("%s: no lines to replay", r.path)
+		}
+		if err := r.rewind(); err != nil {
+			return nil, err
+		}
+		rewound = true
+	}
+}
+
+// extract returns the body to send for line: the line itself, or its field
+// when replay_field is set, as is for a string and as JSON otherwise.
+func (r *replaySource) extract(line []byte) ([]byte, error) {
+	if r.field == "" {
+		return append([]byte(nil), line...), nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return nil, fmt.Errorf("%s:%d: %w", r.path, r.line, err)
+	}
+	raw, ok := fields[r.field]
+	if !ok {
+		return nil, fmt.Errorf("%s:%d: no field %q", r.path, r.line, r.field)
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return []byte(text), nil
+	}
+	return raw, nil
+}
@@ -1,22 +1,26 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"ganesh.provengo.io/api"
-	localStructs "ganesh.provengo.io/internal/structs"
+	localSetup "ganesh.provengo.io/internal/setup"
+	localClients "ganesh.provengo.io/pkg/clients"
+	"ganesh.provengo.io/pkg/health"
+	"ganesh.provengo.io/pkg/http/signing"
 	"ganesh.provengo.io/pkg/ipaddr"
+	localLogging "ganesh.provengo.io/pkg/logging"
+	localMetrics "ganesh.provengo.io/pkg/metrics"
+	localPostgres "ganesh.provengo.io/pkg/postgres"
+	localPublisher "ganesh.provengo.io/pkg/publisher"
+	localRedis "ganesh.provengo.io/pkg/redis"
+	localTracing "ganesh.provengo.io/pkg/tracing"
 	"github.com/gin-gonic/gin"
-	"log"
-	"sync"
+	"log/slog"
+	"net/http"
 )
 
-func validatePort(port int) error {
-	if port >= 1024 && port <= 64000 {
-		return nil
-	}
-	return fmt.Errorf("invalid port %d", port)
-}
-
 func aliveAndKicking(port int, isSSL bool) {
 	_port := fmt.Sprintf(":%d", port)
 	_ipaddr := ipaddr.DetectLocalIP()
@@ -26,47 +30,130 @@ func aliveAndKicking(port int, isSSL bool) {
 		_httpProto = "https://"
 	}
 	for _i := range _ipaddr {
-		fmt.Printf("Listening on: %s%s%s\n", _httpProto, _ipaddr[_i], _port)
+		slog.Info("listening", "url", fmt.Sprintf("%s%s%s", _httpProto, _ipaddr[_i], _port))
 	}
 }
 
-func customerConsumer(channel chan localStructs.DataLogin, wg *sync.WaitGroup) {
-	defer wg.Done()
-	for msg := range channel {
-		fmt.Println(msg)
-	}
+func readinessChecks(cfg *localSetup.Config, publisher *localPublisher.Publisher) *health.Checker {
+	checker := health.NewChecker(cfg.HTTPServer.ReadyTimeout.Duration)
+	checker.Add("nats", publisher.Ping)
+	checker.Add("redis", func(ctx context.Context) error {
+		conn, err := localRedis.RedisConnection(ctx, cfg.Redis)
+		if err != nil {
+			return err
+		}
+		return conn.Ping(ctx)
+	})
+	checker.Add("postgres", func(ctx context.Context) error {
+		conn, err := localPostgres.PostgresConnection(ctx, cfg.Postgres)
+		if err != nil {
+			return err
+		}
+		return conn.Ping(ctx)
+	})
+	return checker
 }
 
-func Run(port int, isSSL bool) {
-	if validatePort(port) != nil {
-		log.Fatalf("invalid port %d", port)
-		return
+// Run serves the API until ctx is cancelled, then stops accepting
+// connections, waits for the requests in progress and closes the publisher.
+// It returns an error when the listener could not be started.
+func Run(ctx context.Context, cfg *localSetup.Config) error {
+	port := cfg.HTTPServer.Port
+	isSSL := cfg.HTTPServer.SSL
+	if err := localSetup.ValidatePort(port); err != nil {
+		return fmt.Errorf("invalid port %d: %w", port, err)
+	}
+
+	publisher, err := localPublisher.New(cfg.Nats, "http")
+	if err != nil {
+		return err
 	}
+	defer publisher.Close()
 
-	wg := &sync.WaitGroup{}
-	customerChannel := make(chan localStructs.DataLogin)
+	checker := readinessChecks(cfg, publisher)
 
-	wg.Add(1)
-	go customerConsumer(customerChannel, wg)
+	metricsServer, err := localMetrics.Serve(cfg.Metrics.Port, cfg.Metrics.LogLevelEndpoint)
+	if err != nil {
+		return err
+	}
 
-	defer func() {
-		wg.Done()
-		close(customerChannel)
+	registry := localClients.New(cfg.Clients, cfg.Redis, cfg.Postgres, publisher)
+	registryCtx, stopRegistry := context.WithCancel(context.Background())
+	defer stopRegistry()
+	registryDone := make(chan struct{})
+	go func() {
+		defer close(registryDone)
+		registry.Run(registryCtx)
 	}()
 
 	gin.SetMode(gin.ReleaseMode)
-	r := gin.Default()
+	r := gin.New()
+	r.Use(gin.Recovery())
+	r.Use(localLogging.GinMiddleware())
+	r.Use(localMetrics.GinMiddleware())
+	r.Use(localTracing.GinMiddleware())
 	r.GET("/ping", api.Ping())
-	r.GET("/keep-alive/:id", api.KeepAlive())
+	r.GET("/livez", health.Live())
+	r.GET("/readyz", health.Ready(checker))
 	r.GET("/", api.Default())
-	r.POST("/send-user", api.SendUser(customerChannel))
-	_port := fmt.Sprintf(":%d", port)
+	r.GET("/clients", api.Clients(registry))
+	r.GET("/clients/:id", api.Client(registry))
 
-	aliveAndKicking(port, isSSL)
+	signed := r.Group("/")
+	if cfg.HTTPServer.Signing.Enabled {
+		limits := map[string]int64{"/send-users": max(api.BulkMaxBody(cfg.HTTPServer.Bulk), signing.MaxBody)}
+		signed.Use(signing.Middleware(cfg.HTTPServer.Signing, signing.RedisCache(cfg.Redis), limits))
+	}
+	signed.GET("/keep-alive/:id", api.KeepAlive(registry))
+	signed.POST("/send-user", api.SendUser(publisher, cfg.QueueName))
+	signed.POST("/send-users", api.SendUsers(publisher, cfg.QueueName, cfg.HTTPServer.Bulk))
 
-	if isSSL {
-		_ = r.RunTLS(_port, "./assets/certs/server.crt", "./assets/certs/server.key")
-	} else {
-		_ = r.Run(_port)
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           r,
+		ReadHeaderTimeout: cfg.HTTPServer.ReadHeaderTimeout.Duration,
+		ReadTimeout:       cfg.HTTPServer.ReadTimeout.Duration,
+		WriteTimeout:      cfg.HTTPServer.WriteTimeout.Duration,
+		IdleTimeout:       cfg.HTTPServer.IdleTimeout.Duration,
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		aliveAndKicking(port, isSSL)
+		if isSSL {
+			served <- server.ListenAndServeTLS(cfg.HTTPServer.CertFile, cfg.HTTPServer.KeyFile)
+		} else {
+			served <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-served:
+		return fmt.Errorf("error serving HTTP: %w", err)
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down HTTP server", "deadline", cfg.HTTPServer.ShutdownTimeout.Duration)
+	checker.SetDraining()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.HTTPServer.ShutdownTimeout.Duration)
+	defer cancel()
+
+	// Shutdown closes the listeners, then waits for the active connections
+	// to finish their request and go idle.
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		slog.Warn("connections still open after the shutdown deadline, closing them", "error", err)
+		_ = server.Close()
+	}
+	if metricsServer != nil {
+		_ = metricsServer.Shutdown(shutdownCtx)
+	}
+	// The last heartbeats are persisted before the publisher is closed.
+	stopRegistry()
+	<-registryDone
+	if _err := <-served; _err != nil && !errors.Is(_err, http.ErrServerClosed) {
+		return fmt.Errorf("error serving HTTP: %w", _err)
 	}
+	slog.Info("HTTP server stopped")
+	return nil
 }
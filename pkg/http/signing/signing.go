@@ -0,0 +1,176 @@
+package signing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"ganesh.provengo.io/internal/encrypt"
+	localSetup "ganesh.provengo.io/internal/setup"
+	localLogging "ganesh.provengo.io/pkg/logging"
+	localMetrics "ganesh.provengo.io/pkg/metrics"
+	localRedis "ganesh.provengo.io/pkg/redis"
+	"github.com/gin-gonic/gin"
+	"github.com/nats-io/nuid"
+)
+
+const (
+	HeaderClientID  = "X-Client-Id"
+	HeaderTimestamp = "X-Timestamp"
+	HeaderNonce     = "X-Nonce"
+	HeaderSignature = "X-Signature"
+
+	// ClientIDKey holds the verified client ID in the Gin context.
+	ClientIDKey = "signing.client_id"
+)
+
+// MaxBody is the largest body a signed request may carry unless its route
+// has its own limit, the body is read in memory to be hashed.
+const MaxBody = 1 << 20
+
+const replayPrefix = "ganesh:signature:"
+
+// Canonical returns the string a client signs: the method, the path, the
+// timestamp in unix milliseconds, the nonce and the hex SHA-256 of the body,
+// one per line.
+func Canonical(method string, path string, timestamp int64, nonce string, body []byte) string {
+	return strings.Join([]string{
+		strings.ToUpper(method),
+		path,
+		strconv.FormatInt(timestamp, 10),
+		nonce,
+		encrypt.CalculateChecksum(body, "SHA256"),
+	}, "\n")
+}
+
+// Sign sets the signature headers of req for body, which must be the body
+// req sends.
+func Sign(req *http.Request, body []byte, clientID string, secret string) {
+	timestamp := time.Now().UnixMilli()
+	nonce := nuid.Next()
+	req.Header.Set(HeaderClientID, clientID)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderSignature, encrypt.SignHMAC([]byte(Canonical(req.Method, req.URL.EscapedPath(), timestamp, nonce, body)), secret))
+}
+
+// ReplayCache remembers signatures for ttl. Seen reports whether signature
+// was already recorded, recording it otherwise.
+type ReplayCache interface {
+	Seen(ctx context.Context, signature string, ttl time.Duration) (bool, error)
+}
+
+type redisCache struct {
+	cfg localSetup.Redis
+}
+
+// RedisCache keeps the seen signatures in Redis, so every HTTP server
+// behind a load balancer rejects the replay of a request another one served.
+func RedisCache(cfg localSetup.Redis) ReplayCache {
+	return redisCache{cfg: cfg}
+}
+
+func (r redisCache) Seen(ctx context.Context, signature string, ttl time.Duration) (bool, error) {
+	conn, err := localRedis.RedisConnection(ctx, r.cfg)
+	if err != nil {
+		return false, err
+	}
+	stored, err := conn.SetNX(ctx, localRedis.RedisData{Key: replayPrefix + signature, Value: 1, TTL: ttl})
+	if err != nil {
+		return false, err
+	}
+	return !stored, nil
+}
+
+var errInvalid = errors.New("invalid signature")
+
+// verify checks the headers and body of c against the secret of the client
+// and returns the client ID.
+func verify(c *gin.Context, cfg localSetup.Signing, body []byte) (string, string, error) {
+	clientID := c.GetHeader(HeaderClientID)
+	signature := c.GetHeader(HeaderSignature)
+	nonce := c.GetHeader(HeaderNonce)
+	if clientID == "" || signature == "" || nonce == "" || c.GetHeader(HeaderTimestamp) == "" {
+		return clientID, "missing", fmt.Errorf("%s, %s, %s and %s are required", HeaderClientID, HeaderTimestamp, HeaderNonce, HeaderSignature)
+	}
+
+	timestamp, err := strconv.ParseInt(c.GetHeader(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return clientID, "timestamp", fmt.Errorf("%s: %w", HeaderTimestamp, err)
+	}
+	skew := time.Since(time.UnixMilli(timestamp))
+	if skew > cfg.ClockSkew.Duration || skew < -cfg.ClockSkew.Duration {
+		return clientID, "timestamp", fmt.Errorf("%s is %s away from the server clock", HeaderTimestamp, skew.Round(time.Millisecond))
+	}
+
+	// An unknown client is reported like a wrong signature, so the error
+	// does not tell which client IDs exist.
+	secret, ok := cfg.Clients[clientID]
+	if !ok {
+		return clientID, "client", errInvalid
+	}
+	canonical := Canonical(c.Request.Method, c.Request.URL.EscapedPath(), timestamp, nonce, body)
+	if !encrypt.VerifyHMAC([]byte(canonical), secret, signature) {
+		return clientID, "signature", errInvalid
+	}
+	return clientID, "", nil
+}
+
+// Middleware rejects requests that are not signed by a configured client
+// with 401, and the replay of a signature already seen with 409. The body is
+// buffered to be hashed and handed back to the next handlers. Bodies above
+// MaxBody, or the limit of their route in limits keyed by route pattern,
+// answer 413.
+func Middleware(cfg localSetup.Signing, cache ReplayCache, limits map[string]int64) gin.HandlerFunc {
+	logger := localLogging.Component("signing")
+	// A signature is only accepted within the clock skew on either side of
+	// the server clock, it does not need to be remembered for longer.
+	ttl := 2 * cfg.ClockSkew.Duration
+
+	reject := func(c *gin.Context, status int, clientID string, reason string, err error) {
+		localMetrics.MessagesFailed.WithLabelValues("http", "signature").Inc()
+		logger.Warn("request rejected", "client_id", clientID, "reason", reason, "path", c.Request.URL.Path, "error", err)
+		c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+	}
+
+	return func(c *gin.Context) {
+		limit, ok := limits[c.FullPath()]
+		if !ok {
+			limit = MaxBody
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, limit))
+		if err != nil {
+			reject(c, http.StatusRequestEntityTooLarge, c.GetHeader(HeaderClientID), "body", err)
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		clientID, reason, err := verify(c, cfg, body)
+		if err != nil {
+			reject(c, http.StatusUnauthorized, clientID, reason, err)
+			return
+		}
+
+		seen, err := cache.Seen(c.Request.Context(), clientID+":"+c.GetHeader(HeaderSignature), ttl)
+		if err != nil {
+			// Without the cache a replay cannot be told apart, refuse the
+			// request and let the client retry.
+			c.Header("Retry-After", "1")
+			reject(c, http.StatusServiceUnavailable, clientID, "replay_cache", err)
+			return
+		}
+		if seen {
+			reject(c, http.StatusConflict, clientID, "replay", errors.New("signature already used"))
+			return
+		}
+
+		c.Set(ClientIDKey, clientID)
+		c.Next()
+	}
+}
@@ -0,0 +1,148 @@
+package signing
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ganesh.provengo.io/internal/encrypt"
+	localSetup "ganesh.provengo.io/internal/setup"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	clientID = "loadtest"
+	secret   = "s3cr3t"
+)
+
+// memoryCache is a ReplayCache without expiry.
+type memoryCache struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func (m *memoryCache) Seen(_ context.Context, signature string, _ time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.seen[signature] {
+		return true, nil
+	}
+	m.seen[signature] = true
+	return false, nil
+}
+
+// server echoes the body of the signed routes /send-user and /send-users,
+// the latter accepting up to 64 bytes, the former up to MaxBody.
+func server() http.Handler {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	cfg := localSetup.Signing{
+		Enabled:   true,
+		Clients:   map[string]string{clientID: secret},
+		ClockSkew: localSetup.Duration{Duration: time.Minute},
+	}
+	signed := r.Group("/")
+	signed.Use(Middleware(cfg, &memoryCache{seen: map[string]bool{}}, map[string]int64{"/send-users": 64}))
+	echo := func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		c.String(http.StatusOK, "%s:%s", c.GetString(ClientIDKey), body)
+	}
+	signed.POST("/send-user", echo)
+	signed.POST("/send-users", echo)
+	return r
+}
+
+func signedRequest(path string, body string, timestamp time.Time, nonce string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	ms := timestamp.UnixMilli()
+	req.Header.Set(HeaderClientID, clientID)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(ms, 10))
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderSignature, encrypt.SignHMAC([]byte(Canonical(http.MethodPost, path, ms, nonce, []byte(body))), secret))
+	return req
+}
+
+func serve(h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCanonical(t *testing.T) {
+	got := Canonical("post", "/send-user", 1700000000000, "n1", []byte("test"))
+	want := "POST\n/send-user\n1700000000000\nn1\n9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	if got != want {
+		t.Fatalf("Canonical() = %q, want %q", got, want)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	now := time.Now()
+	tampered := signedRequest("/send-user", `{"username":"a"}`, now, "n-tampered")
+	tampered.Body = io.NopCloser(strings.NewReader(`{"username":"b"}`))
+	unknown := signedRequest("/send-user", "{}", now, "n-unknown")
+	unknown.Header.Set(HeaderClientID, "stranger")
+	unsigned := httptest.NewRequest(http.MethodPost, "/send-user", strings.NewReader("{}"))
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"valid", signedRequest("/send-user", `{"username":"a"}`, now, "n-valid"), http.StatusOK},
+		{"tampered body", tampered, http.StatusUnauthorized},
+		{"signed for another path", func() *http.Request {
+			req := signedRequest("/send-users", "{}", now, "n-path")
+			req.URL.Path = "/send-user"
+			return req
+		}(), http.StatusUnauthorized},
+		{"stale timestamp", signedRequest("/send-user", "{}", now.Add(-2*time.Minute), "n-stale"), http.StatusUnauthorized},
+		{"future timestamp", signedRequest("/send-user", "{}", now.Add(2*time.Minute), "n-future"), http.StatusUnauthorized},
+		{"unknown client", unknown, http.StatusUnauthorized},
+		{"unsigned", unsigned, http.StatusUnauthorized},
+		{"route limit", signedRequest("/send-users", strings.Repeat("x", 65), now, "n-bulk"), http.StatusRequestEntityTooLarge},
+		{"within route limit", signedRequest("/send-users", strings.Repeat("x", 64), now, "n-bulk-ok"), http.StatusOK},
+		{"default limit", signedRequest("/send-user", strings.Repeat("x", MaxBody+1), now, "n-big"), http.StatusRequestEntityTooLarge},
+	}
+	h := server()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(h, tt.req)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+}
+
+func TestMiddlewareHandsBodyOver(t *testing.T) {
+	rec := serve(server(), signedRequest("/send-user", `{"username":"a"}`, time.Now(), "n1"))
+	if rec.Code != http.StatusOK || rec.Body.String() != clientID+`:{"username":"a"}` {
+		t.Fatalf("got %d %q", rec.Code, rec.Body)
+	}
+}
+
+func TestMiddlewareRejectsReplay(t *testing.T) {
+	h := server()
+	req := signedRequest("/send-user", "{}", time.Now(), "n1")
+	body := []byte("{}")
+	if rec := serve(h, req); rec.Code != http.StatusOK {
+		t.Fatalf("first request: status %d", rec.Code)
+	}
+	replay := httptest.NewRequest(http.MethodPost, "/send-user", bytes.NewReader(body))
+	replay.Header = req.Header.Clone()
+	if rec := serve(h, replay); rec.Code != http.StatusConflict {
+		t.Fatalf("replay: status %d, want %d", rec.Code, http.StatusConflict)
+	}
+	// A new nonce makes a new signature for the same body.
+	if rec := serve(h, signedRequest("/send-user", "{}", time.Now(), "n2")); rec.Code != http.StatusOK {
+		t.Fatalf("new nonce: status %d", rec.Code)
+	}
+}
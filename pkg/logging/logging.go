@@ -0,0 +1,158 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	localSetup "ganesh.provengo.io/internal/setup"
+	localStructs "ganesh.provengo.io/internal/structs"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	UUIDKey     = "uuid"
+	SequenceKey = "sequence"
+	Redacted    = "[REDACTED]"
+)
+
+// Attribute keys whose values never reach the output, whatever their case or
+// the group they are in.
+var sensitiveKeys = []string{"password", "passwd", "secret", "token", "authorization", "signature", "master_key"}
+
+// level is shared by every logger of the process so the admin endpoint can
+// change it at runtime.
+var level = new(slog.LevelVar)
+
+// Init installs the default logger of a binary. The standard log package is
+// routed through it too, so legacy log.Printf calls keep the same format.
+func Init(cfg localSetup.Logging, service string) *slog.Logger {
+	return InitWriter(os.Stderr, cfg, service)
+}
+
+func InitWriter(w io.Writer, cfg localSetup.Logging, service string) *slog.Logger {
+	if err := SetLevel(cfg.Level); err != nil {
+		level.Set(slog.LevelInfo)
+	}
+
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+	var handler slog.Handler
+	if cfg.Format == "json" {
+		handler = slog.NewJSONHandler(w, opts)
+	} else {
+		handler = slog.NewTextHandler(w, opts)
+	}
+
+	logger := slog.New(handler).With("service", service)
+	slog.SetDefault(logger)
+	return logger
+}
+
+// Component returns the logger of a part of the binary, like a worker pool.
+func Component(name string) *slog.Logger {
+	return slog.Default().With("component", name)
+}
+
+// Message adds the correlation fields of a message to logger.
+func Message(logger *slog.Logger, data localStructs.DataLogin) *slog.Logger {
+	return logger.With(UUIDKey, data.UUID, SequenceKey, data.Sequence)
+}
+
+// Fatal logs at error level and exits, like log.Fatal.
+func Fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+func redact(_ []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return slog.String(a.Key, Redacted)
+		}
+	}
+	return a
+}
+
+func Level() slog.Level {
+	return level.Level()
+}
+
+func SetLevel(name string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(name)); err != nil {
+		return fmt.Errorf("invalid log level %q", name)
+	}
+	level.Set(l)
+	return nil
+}
+
+type levelBody struct {
+	Level string `json:"level"`
+}
+
+// LevelHandler reports the current level on GET and changes it on PUT or
+// POST, with the level in a JSON body ({"level":"debug"}) or in ?level=.
+func LevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			body := levelBody{Level: r.URL.Query().Get("level")}
+			if body.Level == "" {
+				if err := json.NewDecoder(io.LimitReader(r.Body, 1024)).Decode(&body); err != nil {
+					http.Error(w, "expected {\"level\":\"debug|info|warn|error\"}", http.StatusBadRequest)
+					return
+				}
+			}
+			previous := Level()
+			if err := SetLevel(body.Level); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			slog.Warn("log level changed", "from", previous.String(), "to", Level().String(), "remote_addr", r.RemoteAddr)
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(levelBody{Level: strings.ToLower(Level().String())})
+	})
+}
+
+// GinMiddleware replaces the Gin access log. Requests are logged at debug
+// level, server errors at error level and 503, which clients retry, at warn.
+func GinMiddleware() gin.HandlerFunc {
+	logger := Component("http")
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		lvl := slog.LevelDebug
+		switch {
+		case status == http.StatusServiceUnavailable:
+			lvl = slog.LevelWarn
+		case status >= http.StatusInternalServerError:
+			lvl = slog.LevelError
+		}
+		if !logger.Enabled(c.Request.Context(), lvl) {
+			return
+		}
+		logger.LogAttrs(c.Request.Context(), lvl, "request",
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", status),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("client_ip", c.ClientIP()),
+			slog.String("errors", c.Errors.ByType(gin.ErrorTypePrivate).String()),
+		)
+	}
+}
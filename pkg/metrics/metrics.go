@@ -0,0 +1,221 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	localLogging "ganesh.provengo.io/pkg/logging"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "ganesh"
+
+var (
+	MessagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_received_total",
+		Help:      "Messages received from NATS or HTTP.",
+	}, []string{"component"})
+
+	MessagesDecoded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_decoded_total",
+		Help:      "Messages successfully decoded.",
+	}, []string{"component"})
+
+	MessagesFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_failed_total",
+		Help:      "Messages that failed, by stage (decode, invalid, redis, postgres, publish).",
+	}, []string{"component", "stage"})
+
+	MessagesUpcast = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_upcast_total",
+		Help:      "Messages decoded from an older schema version, by schema and version.",
+	}, []string{"schema", "version"})
+
+	MessagesDuplicate = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_duplicate_total",
+		Help:      "Messages skipped because their UUID was processed already, by where it was detected (redis, in_flight, postgres).",
+	}, []string{"stage"})
+
+	MessagesWritten = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_written_total",
+		Help:      "Messages written to each sink.",
+	}, []string{"sink"})
+
+	MessagesPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_published_total",
+		Help:      "Messages published to NATS.",
+	}, []string{"component"})
+
+	PublishLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "publish_duration_seconds",
+		Help:      "Time spent publishing a message to NATS.",
+		Buckets:   prometheus.ExponentialBuckets(0.00005, 2, 16),
+	}, []string{"component"})
+
+	EndToEndLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "end_to_end_latency_seconds",
+		Help:      "Time between DataLogin.Timestamp and the message being stored in every sink.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+	})
+
+	SinkWriteLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "sink_write_duration_seconds",
+		Help:      "Duration of a write call (a whole batch) to each sink.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 16),
+	}, []string{"sink"})
+
+	ChannelSaturated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "channel_saturated_total",
+		Help:      "Messages that found their pipeline channel full, before the backpressure policy applied.",
+	}, []string{"queue"})
+
+	MessagesDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_dropped_total",
+		Help:      "Messages evicted from a full pipeline channel by the drop-oldest policy.",
+	}, []string{"queue"})
+
+	SlowConsumers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "nats_slow_consumer_total",
+		Help:      "Slow consumer events reported by NATS, after which the subscription drops messages.",
+	}, []string{"component"})
+
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests served by Gin.",
+	}, []string{"method", "route", "status"})
+
+	httpLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 16),
+	}, []string{"method", "route"})
+
+	httpInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "http_requests_in_flight",
+		Help:      "HTTP requests being served.",
+	})
+)
+
+// ObserveEndToEnd records the latency of a message from its millisecond
+// DataLogin.Timestamp.
+func ObserveEndToEnd(timestamp int64) {
+	if timestamp <= 0 {
+		return
+	}
+	EndToEndLatency.Observe(time.Since(time.UnixMilli(timestamp)).Seconds())
+}
+
+// RegisterChannelDepth exposes len() of a queue as a gauge.
+func RegisterChannelDepth(queue string, depth func() int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "channel_depth",
+		Help:        "Messages waiting in a pipeline channel.",
+		ConstLabels: prometheus.Labels{"queue": queue},
+	}, func() float64 {
+		return float64(depth())
+	})
+}
+
+// RegisterChannelSpilled exposes the messages a queue holds on disk as a
+// gauge.
+func RegisterChannelSpilled(queue string, spilled func() int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "channel_spilled",
+		Help:        "Messages of a pipeline channel spilled to disk.",
+		ConstLabels: prometheus.Labels{"queue": queue},
+	}, func() float64 {
+		return float64(spilled())
+	})
+}
+
+// RegisterNatsDropped exposes the messages dropped by the subscriptions of a
+// component, as reported by dropped.
+func RegisterNatsDropped(component string, dropped func() int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "nats_dropped_messages",
+		Help:        "Messages dropped by the NATS client of slow subscriptions.",
+		ConstLabels: prometheus.Labels{"component": component},
+	}, func() float64 {
+		return float64(dropped())
+	})
+}
+
+func GinMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		httpInFlight.Inc()
+		c.Next()
+		httpInFlight.Dec()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		httpLatency.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Serve exposes /metrics on its own port in the background, along with the
+// /log-level admin endpoint when logLevel is set. A port of 0 disables it.
+// The port is bound before Serve returns, so a port already in use, often
+// by another binary on the same host, fails the startup.
+func Serve(port int, logLevel bool) (*http.Server, error) {
+	if port == 0 {
+		return nil, nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	if logLevel {
+		mux.Handle("/log-level", localLogging.LevelHandler())
+	}
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("error serving metrics: %w", err)
+	}
+	go func() {
+		slog.Info("serving metrics", "addr", server.Addr)
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("error serving metrics", "error", err)
+		}
+	}()
+	return server, nil
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func freePort(t *testing.T) (int, net.Listener) {
+	t.Helper()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listener.Addr().(*net.TCPAddr).Port, listener
+}
+
+func TestServeFailsOnPortInUse(t *testing.T) {
+	port, listener := freePort(t)
+	defer listener.Close()
+	if server, err := Serve(port, false); err == nil {
+		server.Close()
+		t.Fatalf("Serve on port %d in use succeeded", port)
+	}
+}
+
+func TestServeLogLevelIsOptIn(t *testing.T) {
+	for _, logLevel := range []bool{false, true} {
+		port, listener := freePort(t)
+		listener.Close()
+		server, err := Serve(port, logLevel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Shutdown(context.Background())
+
+		logLevelStatus := http.StatusNotFound
+		if logLevel {
+			logLevelStatus = http.StatusOK
+		}
+		for path, want := range map[string]int{"/metrics": http.StatusOK, "/log-level": logLevelStatus} {
+			resp, err := http.Get(fmt.Sprintf("http://localhost:%d%s", port, path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != want {
+				t.Errorf("log level %v: GET %s = %d, want %d", logLevel, path, resp.StatusCode, want)
+			}
+		}
+	}
+	if server, err := Serve(0, true); server != nil || err != nil {
+		t.Errorf("Serve(0) = %v, %v; want it disabled", server, err)
+	}
+}
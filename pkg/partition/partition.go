@@ -0,0 +1,202 @@
+package partition
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+)
+
+// Policy decides what Push does when the partition of a value is full.
+type Policy string
+
+const (
+	// Block waits for room, slowing the pusher down.
+	Block Policy = "block"
+	// DropOldest evicts the oldest value of the partition to OnDrop.
+	DropOldest Policy = "drop-oldest"
+	// SpillToDisk writes the value to a file read back in order once the
+	// partition has room again.
+	SpillToDisk Policy = "spill-to-disk"
+)
+
+// Policies lists the accepted policies.
+var Policies = []Policy{Block, DropOldest, SpillToDisk}
+
+// Options of a queue. Key, OnFull and OnDrop may be nil.
+type Options[T any] struct {
+	// Partitions is the number of channels of an ordered queue.
+	Partitions int
+	// Size is the buffer of each partition.
+	Size int
+	// Key orders the queue, nil for a single shared partition.
+	Key    func(T) string
+	Policy Policy
+	// OnFull is called by every Push finding its partition full, before
+	// the policy applies.
+	OnFull func(partition int)
+	// OnDrop receives the values evicted by DropOldest.
+	OnDrop func(T)
+	// Spill configures SpillToDisk.
+	Spill Spill[T]
+}
+
+// Queue spreads values over partitions, each a buffered channel. Without a
+// key there is a single partition shared by every reader. With a key, values
+// are hashed onto the partitions so that all the values of one key go
+// through the same channel in the order they were pushed; reading each
+// partition from a single goroutine keeps that order while the keys are
+// processed in parallel. Every policy keeps the order of a partition, minus
+// the values DropOldest evicts.
+type Queue[T any] struct {
+	partitions []chan T
+	spills     []*spill[T]
+	opts       Options[T]
+}
+
+// New returns a queue of opts.Partitions channels buffered to opts.Size.
+func New[T any](opts Options[T]) (*Queue[T], error) {
+	if opts.Key == nil || opts.Partitions < 1 {
+		opts.Partitions = 1
+	}
+	if opts.Policy == "" {
+		opts.Policy = Block
+	}
+	q := &Queue[T]{partitions: make([]chan T, opts.Partitions), opts: opts}
+	for i := range q.partitions {
+		q.partitions[i] = make(chan T, opts.Size)
+	}
+
+	switch opts.Policy {
+	case Block, DropOldest:
+	case SpillToDisk:
+		if opts.Spill.Detach == nil || opts.Spill.Attach == nil {
+			return nil, fmt.Errorf("partition: %s requires Spill.Detach and Spill.Attach", opts.Policy)
+		}
+		if err := os.MkdirAll(opts.Spill.Dir, 0o700); err != nil {
+			return nil, fmt.Errorf("partition: spill directory: %w", err)
+		}
+		q.spills = make([]*spill[T], len(q.partitions))
+		for i, ch := range q.partitions {
+			s, err := newSpill(opts.Spill, i, ch)
+			if err != nil {
+				for _, opened := range q.spills[:i] {
+					opened.remove()
+				}
+				return nil, err
+			}
+			q.spills[i] = s
+		}
+	default:
+		return nil, fmt.Errorf("partition: unknown policy %q", opts.Policy)
+	}
+	return q, nil
+}
+
+// Ordered reports whether the queue keeps the order of each key.
+func (q *Queue[T]) Ordered() bool {
+	return q.opts.Key != nil
+}
+
+func (q *Queue[T]) Partitions() int {
+	return len(q.partitions)
+}
+
+// Of returns the partition of v.
+func (q *Queue[T]) Of(v T) int {
+	if q.opts.Key == nil {
+		return 0
+	}
+	return Hash(q.opts.Key(v), len(q.partitions))
+}
+
+// Push sends v to its partition, applying the policy when it is full.
+func (q *Queue[T]) Push(v T) {
+	i := q.Of(v)
+	if q.spills != nil {
+		if q.spills[i].push(v) && q.opts.OnFull != nil {
+			q.opts.OnFull(i)
+		}
+		return
+	}
+
+	ch := q.partitions[i]
+	select {
+	case ch <- v:
+		return
+	default:
+	}
+	if q.opts.OnFull != nil {
+		q.opts.OnFull(i)
+	}
+	if q.opts.Policy == Block {
+		ch <- v
+		return
+	}
+	for {
+		select {
+		case ch <- v:
+			return
+		default:
+		}
+		select {
+		case old := <-ch:
+			if q.opts.OnDrop != nil {
+				q.opts.OnDrop(old)
+			}
+		default:
+		}
+	}
+}
+
+// Partition returns the channel of reader i. Readers share the single
+// partition of an unordered queue, reader i of an ordered one reads
+// partition i and must be the only one to do so.
+func (q *Queue[T]) Partition(i int) <-chan T {
+	return q.partitions[i%len(q.partitions)]
+}
+
+// Len returns the values waiting in the channels of every partition.
+func (q *Queue[T]) Len() int {
+	total := 0
+	for _, p := range q.partitions {
+		total += len(p)
+	}
+	return total
+}
+
+// Cap returns the buffer of every partition together.
+func (q *Queue[T]) Cap() int {
+	return len(q.partitions) * q.opts.Size
+}
+
+// Spilled returns the values waiting on disk, or in memory when they could
+// not be written.
+func (q *Queue[T]) Spilled() int {
+	total := 0
+	for _, s := range q.spills {
+		total += s.len()
+	}
+	return total
+}
+
+// Close closes every partition once the values spilled to it are read back,
+// the readers drain them and stop. Push must not be called anymore.
+func (q *Queue[T]) Close() {
+	if q.spills != nil {
+		for _, s := range q.spills {
+			s.close()
+		}
+		return
+	}
+	for _, p := range q.partitions {
+		close(p)
+	}
+}
+
+// Hash maps key onto one of n partitions with FNV-1a, stable across
+// processes and restarts.
+func Hash(key string, n int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
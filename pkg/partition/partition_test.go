@@ -0,0 +1,181 @@
+package partition
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type event struct {
+	key      string
+	sequence int
+}
+
+func eventKey(e event) string { return e.key }
+
+// load pushes events sequences of keys keys from producers goroutines, each
+// owning a share of the keys and interleaving them at random, while one
+// reader per partition drains the queue with random pauses. It returns what
+// each reader saw, in order.
+func load(t *testing.T, q *Queue[event], keys, events, producers int) [][]event {
+	t.Helper()
+	var produced sync.WaitGroup
+	for p := range producers {
+		produced.Add(1)
+		go func() {
+			defer produced.Done()
+			random := rand.New(rand.NewSource(int64(p)))
+			next := map[string]int{}
+			var owned []string
+			for k := p; k < keys; k += producers {
+				name := fmt.Sprintf("user-%d", k)
+				owned = append(owned, name)
+				next[name] = 1
+			}
+			for len(owned) > 0 {
+				i := random.Intn(len(owned))
+				name := owned[i]
+				q.Push(event{key: name, sequence: next[name]})
+				if next[name]++; next[name] > events {
+					owned = append(owned[:i], owned[i+1:]...)
+				}
+			}
+		}()
+	}
+
+	seen := make([][]event, q.Partitions())
+	var readers sync.WaitGroup
+	for r := range q.Partitions() {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			random := rand.New(rand.NewSource(int64(1000 + r)))
+			for e := range q.Partition(r) {
+				if random.Intn(8) == 0 {
+					time.Sleep(time.Duration(random.Intn(100)) * time.Microsecond)
+				}
+				seen[r] = append(seen[r], e)
+			}
+		}()
+	}
+
+	produced.Wait()
+	q.Close()
+	readers.Wait()
+	return seen
+}
+
+// checkOrder fails on an event of a key read by a reader other than the one
+// of its partition, or before an event pushed earlier. With gaps, sequences
+// may be missing but must still increase.
+func checkOrder(t *testing.T, q *Queue[event], seen [][]event, gaps bool) map[string]int {
+	t.Helper()
+	last := map[string]int{}
+	for r, events := range seen {
+		for _, e := range events {
+			if p := q.Of(e); p != r {
+				t.Fatalf("%s read by reader %d, its partition is %d", e.key, r, p)
+			}
+			if e.sequence <= last[e.key] || (!gaps && e.sequence != last[e.key]+1) {
+				t.Fatalf("%s: sequence %d after %d", e.key, e.sequence, last[e.key])
+			}
+			last[e.key] = e.sequence
+		}
+	}
+	return last
+}
+
+func TestOrderedQueueKeepsOrderPerKey(t *testing.T) {
+	const keys, events = 200, 100
+	q, err := New(Options[event]{Partitions: 8, Size: 4, Key: eventKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := checkOrder(t, q, load(t, q, keys, events, 8), false)
+	if len(last) != keys {
+		t.Fatalf("got %d keys, want %d", len(last), keys)
+	}
+	for key, sequence := range last {
+		if sequence != events {
+			t.Errorf("%s: last sequence %d, want %d", key, sequence, events)
+		}
+	}
+}
+
+func TestUnorderedQueueSharesOnePartition(t *testing.T) {
+	q, err := New(Options[event]{Partitions: 8, Size: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Ordered() || q.Partitions() != 1 || q.Of(event{key: "user-1"}) != 0 {
+		t.Fatalf("unordered queue: ordered %v, %d partitions", q.Ordered(), q.Partitions())
+	}
+}
+
+func TestHashIsStable(t *testing.T) {
+	// FNV-1a of "user-1" is 0xf5537974, the partitions must not change
+	// across releases or the order of the keys in flight breaks on upgrade.
+	if got := Hash("user-1", 1000); got != 0xf5537974%1000 {
+		t.Fatalf("Hash(user-1, 1000) = %d", got)
+	}
+}
+
+func TestDropOldestEvictsOldest(t *testing.T) {
+	var dropped []int
+	var full []int
+	q, err := New(Options[event]{
+		Partitions: 2,
+		Size:       2,
+		Key:        eventKey,
+		Policy:     DropOldest,
+		OnFull:     func(partition int) { full = append(full, partition) },
+		OnDrop:     func(e event) { dropped = append(dropped, e.sequence) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		q.Push(event{key: "k", sequence: i})
+	}
+	q.Close()
+	var kept []int
+	for e := range q.Partition(q.Of(event{key: "k"})) {
+		kept = append(kept, e.sequence)
+	}
+	if fmt.Sprint(dropped) != "[1 2 3]" || fmt.Sprint(kept) != "[4 5]" || len(full) != 3 {
+		t.Fatalf("dropped %v, kept %v, %d full pushes; want [1 2 3], [4 5], 3", dropped, kept, len(full))
+	}
+	for range q.Partition(1 - q.Of(event{key: "k"})) {
+		t.Fatal("the other partition received an event")
+	}
+}
+
+func TestDropOldestKeepsOrderUnderLoad(t *testing.T) {
+	const keys, events = 200, 100
+	var dropped atomic.Int64
+	q, err := New(Options[event]{
+		Partitions: 4,
+		Size:       2,
+		Key:        eventKey,
+		Policy:     DropOldest,
+		OnDrop:     func(event) { dropped.Add(1) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := load(t, q, keys, events, 8)
+	checkOrder(t, q, seen, true)
+	delivered := 0
+	for _, events := range seen {
+		delivered += len(events)
+	}
+	if int64(delivered)+dropped.Load() != keys*events {
+		t.Fatalf("delivered %d and dropped %d of %d events", delivered, dropped.Load(), keys*events)
+	}
+	if dropped.Load() == 0 {
+		t.Fatal("nothing was dropped, the test does not cover the policy")
+	}
+}
@@ -0,0 +1,223 @@
+package partition
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Spill configures SpillToDisk. A value is split by Detach into the bytes
+// written to disk and what must stay in memory, like callbacks; Attach
+// rebuilds it when it is read back.
+type Spill[T any] struct {
+	// Dir holds one file per partition, named <Name>-<pid>-<partition>.spill
+	// and removed on Close. Nothing bounds the backlog of a partition, its
+	// file stays under the backlog plus the larger of the backlog and
+	// compactAfter.
+	Dir  string
+	Name string
+
+	Detach func(v T) (data []byte, rest T)
+	Attach func(data []byte, rest T) (T, error)
+	// OnError receives the values that could not be read back, and the
+	// write errors, for which the value is kept in memory instead. v is the
+	// zero value for write errors.
+	OnError func(v T, err error)
+}
+
+// compactAfter is the size of the read head of a spill file past which the
+// file is compacted, once the head is also at least half of the file.
+var compactAfter int64 = 4 << 20
+
+type record[T any] struct {
+	rest T
+	// offset is -1 for the records kept in memory, whose data is set
+	// because they could not be written to disk.
+	offset int64
+	size   int
+	data   []byte
+}
+
+// spill feeds a partition from a file once it is full. As long as records
+// are waiting, or one is on its way to the channel, new values go to the
+// file too so that the partition keeps its order. Records are appended at
+// end and read from head; the file is truncated when every record was read
+// and compacted while a backlog remains, see compactAfter.
+type spill[T any] struct {
+	cfg  Spill[T]
+	ch   chan T
+	path string
+
+	mu        sync.Mutex
+	file      *os.File
+	head      int64
+	end       int64
+	records   []record[T]
+	inTransit bool
+	closing   bool
+	wake      chan struct{}
+}
+
+func newSpill[T any](cfg Spill[T], partition int, ch chan T) (*spill[T], error) {
+	path := filepath.Join(cfg.Dir, fmt.Sprintf("%s-%d-%d.spill", cfg.Name, os.Getpid(), partition))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("partition: spill file: %w", err)
+	}
+	s := &spill[T]{cfg: cfg, ch: ch, path: path, file: file, wake: make(chan struct{}, 1)}
+	go s.feed()
+	return s, nil
+}
+
+func (s *spill[T]) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// push sends v to the channel when nothing is spilled and there is room,
+// and spills it otherwise. It reports whether v was spilled.
+func (s *spill[T]) push(v T) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.records) == 0 && !s.inTransit {
+		select {
+		case s.ch <- v:
+			return false
+		default:
+		}
+	}
+
+	data, rest := s.cfg.Detach(v)
+	rec := record[T]{rest: rest, offset: -1, size: len(data)}
+	frame := binary.AppendUvarint(nil, uint64(len(data)))
+	frame = append(frame, data...)
+	if _, err := s.file.WriteAt(frame, s.end); err != nil {
+		rec.data = data
+		if s.cfg.OnError != nil {
+			var zero T
+			s.cfg.OnError(zero, fmt.Errorf("partition: writing %s, kept in memory: %w", s.path, err))
+		}
+	} else {
+		rec.offset = s.end + int64(len(frame)-len(data))
+		s.end += int64(len(frame))
+	}
+	s.records = append(s.records, rec)
+	s.signal()
+	return true
+}
+
+// next takes the oldest record, reading its bytes back. The file is
+// truncated once every record was read, or compacted.
+func (s *spill[T]) next() (record[T], bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.records) == 0 {
+		if s.closing {
+			return record[T]{}, false
+		}
+		s.mu.Unlock()
+		<-s.wake
+		s.mu.Lock()
+	}
+
+	rec := s.records[0]
+	s.records = s.records[1:]
+	s.inTransit = true
+	if rec.data == nil {
+		rec.data = make([]byte, rec.size)
+		if _, err := s.file.ReadAt(rec.data, rec.offset); err != nil {
+			rec.data = nil
+		}
+	}
+	if rec.offset >= 0 {
+		s.head = rec.offset + int64(rec.size)
+	}
+	if len(s.records) == 0 {
+		s.records = nil
+		s.head, s.end = 0, 0
+		_ = s.file.Truncate(0)
+	} else if s.head >= compactAfter && 2*s.head >= s.end {
+		s.compact()
+	}
+	return rec, true
+}
+
+// compact moves the unread part of the file to its start. It is only called
+// when that part is no longer than the read one, so the copy never
+// overwrites unread records and a failure leaves the file readable.
+func (s *spill[T]) compact() {
+	buf := make([]byte, 1<<20)
+	for from := s.head; from < s.end; {
+		n, err := s.file.ReadAt(buf[:min(int64(len(buf)), s.end-from)], from)
+		if err == nil {
+			_, err = s.file.WriteAt(buf[:n], from-s.head)
+		}
+		if err != nil {
+			// The file keeps its layout, compaction is tried again later.
+			if s.cfg.OnError != nil {
+				var zero T
+				s.cfg.OnError(zero, fmt.Errorf("partition: compacting %s: %w", s.path, err))
+			}
+			return
+		}
+		from += int64(n)
+	}
+	for i := range s.records {
+		if s.records[i].offset >= 0 {
+			s.records[i].offset -= s.head
+		}
+	}
+	s.end -= s.head
+	s.head = 0
+	_ = s.file.Truncate(s.end)
+}
+
+func (s *spill[T]) feed() {
+	for {
+		rec, ok := s.next()
+		if !ok {
+			s.remove()
+			close(s.ch)
+			return
+		}
+		var v T
+		var err error
+		if rec.data == nil {
+			err = fmt.Errorf("partition: reading back %s failed", s.path)
+		} else {
+			v, err = s.cfg.Attach(rec.data, rec.rest)
+		}
+		if err != nil {
+			if s.cfg.OnError != nil {
+				s.cfg.OnError(rec.rest, err)
+			}
+		} else {
+			s.ch <- v
+		}
+		s.mu.Lock()
+		s.inTransit = false
+		s.mu.Unlock()
+	}
+}
+
+func (s *spill[T]) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.records)
+}
+
+func (s *spill[T]) close() {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+	s.signal()
+}
+
+func (s *spill[T]) remove() {
+	_ = s.file.Close()
+	_ = os.Remove(s.path)
+}
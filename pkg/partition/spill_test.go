@@ -0,0 +1,192 @@
+package partition
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// spillOptions spills events to dir, the key staying in memory like the
+// delivery of a consumer job and the sequence going to disk, padded to pad
+// bytes.
+func spillOptions(dir string, partitions, size, pad int) Options[event] {
+	return Options[event]{
+		Partitions: partitions,
+		Size:       size,
+		Key:        eventKey,
+		Policy:     SpillToDisk,
+		Spill: Spill[event]{
+			Dir:  dir,
+			Name: "test",
+			Detach: func(e event) ([]byte, event) {
+				return fmt.Appendf(nil, "%d %s", e.sequence, strings.Repeat("x", pad)), event{key: e.key}
+			},
+			Attach: func(data []byte, e event) (event, error) {
+				_, err := fmt.Sscanf(string(data), "%d", &e.sequence)
+				return e, err
+			},
+		},
+	}
+}
+
+func spillFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "test-*.spill"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestSpillKeepsOrderPerKey(t *testing.T) {
+	const keys, events = 100, 100
+	dir := t.TempDir()
+	var full atomic.Int64
+	opts := spillOptions(dir, 4, 2, 0)
+	opts.OnFull = func(int) { full.Add(1) }
+	q, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := spillFiles(t, dir); len(files) != 4 {
+		t.Fatalf("%d spill files, want one per partition", len(files))
+	}
+
+	last := checkOrder(t, q, load(t, q, keys, events, 8), false)
+	for key := range keys {
+		name := fmt.Sprintf("user-%d", key)
+		if last[name] != events {
+			t.Fatalf("%s: last sequence %d, want %d", name, last[name], events)
+		}
+	}
+	if full.Load() == 0 {
+		t.Fatal("nothing was spilled, the test does not cover the spill")
+	}
+	if files := spillFiles(t, dir); len(files) != 0 {
+		t.Errorf("spill files left after Close: %v", files)
+	}
+}
+
+func TestSpillReadsBackInOrder(t *testing.T) {
+	q, err := New(spillOptions(t.TempDir(), 1, 1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without a reader the first event fills the channel and the next ones
+	// all go to disk.
+	for i := 1; i <= 50; i++ {
+		q.Push(event{key: "k", sequence: i})
+	}
+	// One record may be on its way to the channel already.
+	if spilled := q.Spilled(); spilled < 48 || q.Len() != 1 {
+		t.Fatalf("spilled %d, in channel %d; want 48 or 49 and 1", spilled, q.Len())
+	}
+	q.Close()
+	next := 1
+	for e := range q.Partition(0) {
+		if e.key != "k" || e.sequence != next {
+			t.Fatalf("got %+v, want sequence %d", e, next)
+		}
+		next++
+	}
+	if next != 51 {
+		t.Fatalf("read %d events, want 50", next-1)
+	}
+}
+
+func TestSpillCompactsTheFile(t *testing.T) {
+	defer func(saved int64) { compactAfter = saved }(compactAfter)
+	compactAfter = 64 << 10
+
+	const pad, total = 1000, 400
+	dir := t.TempDir()
+	q, err := New(spillOptions(dir, 1, 1, pad))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := spillFiles(t, dir)[0]
+	size := func() int64 {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+
+	// The reader stays behind: the backlog never drains, the file would
+	// only grow without compaction.
+	pushed, read := 0, 0
+	var largest int64
+	for pushed < total {
+		for range 10 {
+			pushed++
+			q.Push(event{key: "k", sequence: pushed})
+		}
+		for range 8 {
+			e := <-q.Partition(0)
+			if read++; e.sequence != read {
+				t.Fatalf("got sequence %d, want %d", e.sequence, read)
+			}
+		}
+		largest = max(largest, size())
+	}
+	backlog := int64(q.Spilled()) * (pad + 8)
+	if limit := backlog + max(backlog, compactAfter) + 2*(pad+8); largest > limit {
+		t.Errorf("spill file reached %d bytes for a backlog of %d, limit %d", largest, backlog, limit)
+	}
+	if all := int64(total) * (pad + 8); largest >= all {
+		t.Errorf("spill file reached %d bytes, it was never compacted", largest)
+	}
+
+	q.Close()
+	for e := range q.Partition(0) {
+		if read++; e.sequence != read {
+			t.Fatalf("after compaction: got sequence %d, want %d", e.sequence, read)
+		}
+	}
+	if read != total {
+		t.Fatalf("read %d events, want %d", read, total)
+	}
+}
+
+func TestSpillReportsUnreadableRecords(t *testing.T) {
+	opts := spillOptions(t.TempDir(), 1, 1, 0)
+	var failed []event
+	opts.Spill.Attach = func(data []byte, e event) (event, error) {
+		if bytes.HasPrefix(data, []byte("2 ")) {
+			return e, errors.New("corrupt")
+		}
+		_, err := fmt.Sscanf(string(data), "%d", &e.sequence)
+		return e, err
+	}
+	opts.Spill.OnError = func(e event, err error) { failed = append(failed, e) }
+	q, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		q.Push(event{key: "k", sequence: i})
+	}
+	q.Close()
+	var got []int
+	for e := range q.Partition(0) {
+		got = append(got, e.sequence)
+	}
+	if len(got) != 2 || got[0] != 1 || got[1] != 3 || len(failed) != 1 || failed[0].key != "k" {
+		t.Fatalf("read %v, failed %+v; want [1 3] and the in-memory part of 2", got, failed)
+	}
+}
+
+func TestSpillRequiresCallbacks(t *testing.T) {
+	if _, err := New(Options[event]{Policy: SpillToDisk, Spill: Spill[event]{Dir: t.TempDir()}}); err == nil {
+		t.Fatal("spill-to-disk without Detach and Attach accepted")
+	}
+	if _, err := New(Options[event]{Policy: "retry"}); err == nil {
+		t.Fatal("unknown policy accepted")
+	}
+}
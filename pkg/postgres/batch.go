@@ -0,0 +1,260 @@
+package db_postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	localStructs "ganesh.provengo.io/internal/structs"
+	localLogging "ganesh.provengo.io/pkg/logging"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+type BatchConfig struct {
+	Size         int
+	Interval     time.Duration
+	MaxRetries   int
+	RetryBackoff time.Duration
+
+	// OnFlush, when set, is called after every write with its duration
+	OnFlush func(rows int, elapsed time.Duration)
+	// Logger reports the COPY fallbacks, the postgres component when nil
+	Logger *slog.Logger
+}
+
+// BatchRow is a row waiting to be copied. Result is called exactly once with
+// the outcome of that row, ErrDuplicate when its UUID was already stored.
+type BatchRow struct {
+	Data   localStructs.DataLogin
+	Result func(err error)
+}
+
+// BatchWriter accumulates rows and writes them to the users table with COPY
+// when Size rows are pending or Interval elapsed since the last flush.
+type BatchWriter struct {
+	pg   *Postgres
+	cfg  BatchConfig
+	mu   sync.Mutex
+	rows []BatchRow
+	// flushing serializes the flushes of the ticker and of Add, so that the
+	// batches commit in the order their rows were added.
+	flushing sync.Mutex
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+var usersColumns = []string{"uuid", "username", "password", "hash"}
+
+func (pg *Postgres) NewBatchWriter(ctx context.Context, cfg BatchConfig) *BatchWriter {
+	if cfg.Size < 1 {
+		cfg.Size = 1
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = localLogging.Component("postgres")
+	}
+	w := &BatchWriter{
+		pg:   pg,
+		cfg:  cfg,
+		rows: make([]BatchRow, 0, cfg.Size),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go w.loop(ctx)
+	return w
+}
+
+func (w *BatchWriter) loop(ctx context.Context) {
+	defer close(w.done)
+	ticker := time.NewTicker(w.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.flushPending(ctx, 0)
+		}
+	}
+}
+
+// take returns the pending rows when there are at least min of them.
+func (w *BatchWriter) take(min int) []BatchRow {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.rows) == 0 || len(w.rows) < min {
+		return nil
+	}
+	batch := w.rows
+	w.rows = make([]BatchRow, 0, w.cfg.Size)
+	return batch
+}
+
+// flushPending writes the pending rows when there are at least min of them,
+// after the flush in progress if any.
+func (w *BatchWriter) flushPending(ctx context.Context, min int) {
+	w.flushing.Lock()
+	defer w.flushing.Unlock()
+	if batch := w.take(min); len(batch) > 0 {
+		w.flush(ctx, batch)
+	}
+}
+
+// Add queues a row. When the batch is full the caller flushes it, which
+// slows producers down while Postgres is behind.
+func (w *BatchWriter) Add(ctx context.Context, row BatchRow) {
+	w.mu.Lock()
+	w.rows = append(w.rows, row)
+	w.mu.Unlock()
+
+	w.flushPending(ctx, w.cfg.Size)
+}
+
+// Close stops the timer and flushes what is still pending.
+func (w *BatchWriter) Close(ctx context.Context) {
+	close(w.stop)
+	<-w.done
+	w.flushPending(ctx, 0)
+}
+
+func (w *BatchWriter) flush(ctx context.Context, batch []BatchRow) {
+	start := time.Now()
+	var inserted []bool
+	err := w.retry(ctx, func() (err error) {
+		inserted, err = w.pg.CopyUserPasswords(ctx, batch)
+		return err
+	})
+	if w.cfg.OnFlush != nil {
+		w.cfg.OnFlush(len(batch), time.Since(start))
+	}
+	if err == nil {
+		for i, row := range batch {
+			if inserted[i] {
+				row.Result(nil)
+			} else {
+				row.Result(fmt.Errorf("uuid %s: %w", row.Data.UUID, ErrDuplicate))
+			}
+		}
+		return
+	}
+
+	if len(batch) == 1 || !isRowError(err) {
+		for _, row := range batch {
+			row.Result(err)
+		}
+		return
+	}
+
+	// COPY is all or nothing, insert row by row to find the offending ones
+	w.cfg.Logger.Warn("copy failed, falling back to single inserts", "rows", len(batch), "error", err)
+	for _, row := range batch {
+		row.Result(w.retry(ctx, func() error {
+			return w.pg.InsertUserPassword(ctx, row.Data)
+		}))
+	}
+}
+
+func (w *BatchWriter) retry(ctx context.Context, fn func() error) error {
+	backoff := w.cfg.RetryBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil || !IsTransient(err) || attempt >= w.cfg.MaxRetries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// CopyUserPasswords copies the rows into a temporary table and moves them to
+// users with ON CONFLICT DO NOTHING, so a UUID already stored, or repeated in
+// the batch, is skipped instead of failing the whole COPY. It reports which
+// rows were inserted, the first one wins within the batch.
+func (pg *Postgres) CopyUserPasswords(ctx context.Context, rows []BatchRow) ([]bool, error) {
+	tx, err := pg.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to begin copy: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if _, err := tx.Exec(ctx, `CREATE TEMP TABLE users_staging (LIKE users INCLUDING DEFAULTS) ON COMMIT DROP`); err != nil {
+		return nil, fmt.Errorf("unable to create staging table: %w", err)
+	}
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"users_staging"}, usersColumns, pgx.CopyFromSlice(len(rows), func(i int) ([]any, error) {
+		data := rows[i].Data
+		return []any{data.UUID, data.Username, data.Password, ""}, nil
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("unable to copy rows: %w", err)
+	}
+
+	result, err := tx.Query(ctx, `INSERT INTO users (uuid, username, password, hash)
+		SELECT DISTINCT ON (uuid) uuid, username, password, hash FROM users_staging
+		ON CONFLICT (uuid) DO NOTHING RETURNING uuid`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to insert copied rows: %w", err)
+	}
+	stored, err := pgx.CollectRows(result, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("unable to insert copied rows: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("unable to commit copy: %w", err)
+	}
+
+	fresh := make(map[string]bool, len(stored))
+	for _, uuid := range stored {
+		fresh[uuid] = true
+	}
+	inserted := make([]bool, len(rows))
+	for i, row := range rows {
+		inserted[i] = fresh[row.Data.UUID]
+		delete(fresh, row.Data.UUID)
+	}
+	return inserted, nil
+}
+
+// IsTransient reports errors worth retrying: lost connections, timeouts,
+// serialization failures and a server that is starting or shutting down.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if pgconn.SafeToRetry(err) || pgconn.Timeout(err) {
+		return true
+	}
+
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return true
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "40001", "40P01", "53300", "55P03", "57P01", "57P02", "57P03":
+			return true
+		}
+		return strings.HasPrefix(pgErr.Code, "08")
+	}
+	return false
+}
+
+// isRowError reports errors caused by the content of some row, like
+// duplicated keys or invalid values, rather than by the server.
+func isRowError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23")
+}
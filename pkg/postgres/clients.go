@@ -0,0 +1,50 @@
+package db_postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	localStructs "ganesh.provengo.io/internal/structs"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when a selected row does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrDuplicate is reported for users whose UUID is already stored. The
+	// row is left as it is, callers count it rather than fail.
+	ErrDuplicate = errors.New("duplicate uuid")
+)
+
+// UpsertHeartbeats stores the last heartbeat of each client. Several HTTP
+// servers persist the same clients, the newest heartbeat wins.
+func (pg *Postgres) UpsertHeartbeats(ctx context.Context, heartbeats []localStructs.Heartbeat) error {
+	query := `INSERT INTO client_heartbeats (client_id, ip, user_agent, protocol, last_seen) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (client_id) DO UPDATE SET ip = excluded.ip, user_agent = excluded.user_agent, protocol = excluded.protocol, last_seen = excluded.last_seen
+		WHERE client_heartbeats.last_seen < excluded.last_seen`
+
+	batch := &pgx.Batch{}
+	for _, hb := range heartbeats {
+		batch.Queue(query, hb.ClientID, hb.IP, hb.UserAgent, hb.Protocol, time.UnixMilli(hb.LastSeen))
+	}
+	if err := pg.db.SendBatch(ctx, batch).Close(); err != nil {
+		return fmt.Errorf("unable to upsert heartbeats: %w", err)
+	}
+	return nil
+}
+
+func (pg *Postgres) SelectHeartbeat(ctx context.Context, clientID string) (localStructs.Heartbeat, error) {
+	query := `SELECT client_id, ip, user_agent, protocol, last_seen FROM client_heartbeats WHERE client_id = $1`
+	hb := localStructs.Heartbeat{}
+	var lastSeen time.Time
+	err := pg.db.QueryRow(ctx, query, clientID).Scan(&hb.ClientID, &hb.IP, &hb.UserAgent, &hb.Protocol, &lastSeen)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return hb, fmt.Errorf("client %q: %w", clientID, ErrNotFound)
+	}
+	if err != nil {
+		return hb, fmt.Errorf("unable to select heartbeat: %w", err)
+	}
+	hb.LastSeen = lastSeen.UnixMilli()
+	return hb, nil
+}
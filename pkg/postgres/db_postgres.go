@@ -8,7 +8,7 @@ import (
 	localStructs "ganesh.provengo.io/internal/structs"
 	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"log"
+	"log/slog"
 	"sync"
 )
 
@@ -146,16 +146,16 @@ var (
 	pgOnce     sync.Once
 )
 
-func PostgresConnection(ctx context.Context, connString string) (*Postgres, error) {
+func PostgresConnection(ctx context.Context, cfg localSetup.Postgres) (*Postgres, error) {
 	var err error
 	pgOnce.Do(func() {
-		config, _err := pgxpool.ParseConfig(connString)
+		config, _err := pgxpool.ParseConfig(cfg.URL)
 		if _err != nil {
 			err = fmt.Errorf("error parsing connection string: %w", _err)
 			return
 		}
-		config.MinConns = localSetup.PostgresMin
-		config.MaxConns = localSetup.PostgresMax
+		config.MinConns = cfg.MinConns
+		config.MaxConns = cfg.MaxConns
 
 		db, _err := pgxpool.NewWithConfig(ctx, config)
 		if _err != nil {
@@ -167,9 +167,22 @@ func PostgresConnection(ctx context.Context, connString string) (*Postgres, erro
 	if err != nil {
 		return nil, err
 	}
+	if pgInstance == nil {
+		return nil, fmt.Errorf("postgres connection is not available")
+	}
 	return pgInstance, nil
 }
 
+// CloseConnection closes the shared pool when it was created, without
+// creating one. PostgresConnection fails afterwards.
+func CloseConnection() {
+	// Marks the pool as created if it was not, so nothing dials it anymore.
+	pgOnce.Do(func() {})
+	if pgInstance != nil {
+		pgInstance.Close()
+	}
+}
+
 func (pg *Postgres) Ping(ctx context.Context) error {
 	return pg.db.Ping(ctx)
 }
@@ -178,12 +191,17 @@ func (pg *Postgres) Close() {
 	pg.db.Close()
 }
 
+// InsertUserPassword inserts the user unless its UUID is already stored, in
+// which case it returns ErrDuplicate.
 func (pg *Postgres) InsertUserPassword(ctx context.Context, data localStructs.DataLogin) error {
-	queryInsert := `INSERT INTO users (uuid, username, password, hash) VALUES ($1, $2, $3, $4)`
-	_, err := pg.db.Exec(ctx, queryInsert, data.UUID, data.Username, data.Password, "")
+	queryInsert := `INSERT INTO users (uuid, username, password, hash) VALUES ($1, $2, $3, $4) ON CONFLICT (uuid) DO NOTHING`
+	res, err := pg.db.Exec(ctx, queryInsert, data.UUID, data.Username, data.Password, "")
 	if err != nil {
 		return fmt.Errorf("unable to insert row: %w", err)
 	}
+	if res.RowsAffected() == 0 {
+		return fmt.Errorf("uuid %s: %w", data.UUID, ErrDuplicate)
+	}
 	return nil
 }
 
@@ -246,7 +264,7 @@ func (pg *Postgres) InsertBeacon(ctx context.Context, data DefineBeacon) {
 
 	_, err := pg.db.Exec(ctx, query, data.Beacon, data.Nanoid, data.Ipaddr, data.Headers)
 	if err != nil {
-		log.Printf("unable to insert row: %v", err)
+		slog.Error("unable to insert row", "error", err)
 	}
 }
 
@@ -255,7 +273,7 @@ func (pg *Postgres) InsertLog(ctx context.Context, data StringLog) {
 
 	_, err := pg.db.Exec(ctx, query, data.Type, data.From, data.Values)
 	if err != nil {
-		log.Printf("unable to insert row: %v", err)
+		slog.Error("unable to insert row", "error", err)
 	}
 }
 
@@ -263,7 +281,7 @@ func (pg *Postgres) InsertAccessLog(ctx context.Context, transactionId string, d
 	query := `INSERT INTO provengo_access_log VALUES (default, $1, $2, $3, now())`
 	_, err := pg.db.Exec(ctx, query, transactionId, data, method)
 	if err != nil {
-		log.Printf("unable to insert row: %v", err)
+		slog.Error("unable to insert row", "error", err)
 	}
 }
 
@@ -272,13 +290,13 @@ func (pg *Postgres) InsertSession(ctx context.Context, data SessionInsert) {
 
 	dataInsert, _err := json.Marshal(data.Values)
 	if _err != nil {
-		log.Printf("unable to convert payload: %v", _err)
+		slog.Error("unable to convert payload", "error", _err)
 		dataInsert = []byte("{}")
 	}
 
 	_, err := pg.db.Exec(ctx, query, data.LinkId, data.ApplicationId, dataInsert)
 	if err != nil {
-		log.Printf("unable to insert row: %v", err)
+		slog.Error("unable to insert row", "error", err)
 	}
 }
 
@@ -286,7 +304,7 @@ func (pg *Postgres) UpdateSessionValues(ctx context.Context, session string, dat
 	query := `UPDATE provengo_sessions SET values = $1 WHERE application_id = $2`
 	dataUpdate, _err := json.Marshal(data)
 	if _err != nil {
-		log.Printf("unable to convert payload: %v", _err)
+		slog.Error("unable to convert payload", "error", _err)
 		return fmt.Errorf("error converting payload: %w", _err)
 	}
 	_, err := pg.db.Exec(ctx, query, dataUpdate, session)
@@ -301,7 +319,7 @@ func (pg *Postgres) LogoutSession(ctx context.Context, session string) {
 
 	_, err := pg.db.Exec(ctx, query, session)
 	if err != nil {
-		log.Printf("error logoff session %s", err)
+		slog.Error("error logoff session", "error", err)
 	}
 
 }
@@ -361,7 +379,7 @@ func (pg *Postgres) UpdateSessionState(ctx context.Context, sessionID string) {
 	query := `UPDATE provengo_sessions SET state=200, valid_at= now() + interval '5 minutes' WHERE session_link = $1 and state=202`
 	_, err := pg.db.Exec(ctx, query, sessionID)
 	if err != nil {
-		log.Printf("unable to insert row: %v", err)
+		slog.Error("unable to insert row", "error", err)
 	}
 }
 
@@ -514,7 +532,7 @@ func (pg *Postgres) SelectUserLink(ctx context.Context, link string) ([]UserLink
 	queryUpdate := `UPDATE provengo_userlink SET state=300, valid_at = now() + interval '1 day' WHERE link = $1`
 	_, err = pg.db.Exec(ctx, queryUpdate, link)
 	if err != nil {
-		log.Printf("unable update  row: %v", err)
+		slog.Error("unable update row", "error", err)
 	}
 	return DataReturn, nil
 }
@@ -588,7 +606,7 @@ func (pg *Postgres) UpdateInsertProbe(ctx context.Context, data DefineProbe) err
 		queryInsert := `INSERT INTO provengo_probe values (default, $1, $2, $3, $4, $5, $6, now(), now());`
 		res, err := pg.db.Exec(ctx, queryInsert, data.DomainID, data.Probe, data.Description, data.Configuration, data.Status, data.Identity)
 		if err != nil {
-			log.Printf("unable to insert probe: %v", err)
+			slog.Error("unable to insert probe", "error", err)
 			return fmt.Errorf("unable to insert probe: %w", err)
 		}
 		affectedRows := res.RowsAffected()
@@ -615,7 +633,7 @@ func (pg *Postgres) InsertCollector(ctx context.Context, data DefineCollector) e
 	res, err := pg.db.Exec(ctx, queryInsert, data.HostName, data.HostID, data.IpAddr, data.ProbeId, data.Values, data.RemoteTS, data.LocalTS)
 
 	if err != nil {
-		log.Printf("unable to insert probe: %v", err)
+		slog.Error("unable to insert probe", "error", err)
 		return fmt.Errorf("unable to insert probe: %w", err)
 	}
 	affectedRows := res.RowsAffected()
@@ -697,6 +715,6 @@ func (pg *Postgres) ExpireActivity(ctx context.Context, Activity string) {
 	_, err := pg.db.Exec(ctx, query)
 
 	if err != nil {
-		log.Printf("unable to get rows: %v", err)
+		slog.Error("unable to get rows", "error", err)
 	}
 }
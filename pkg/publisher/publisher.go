@@ -0,0 +1,308 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	localSetup "ganesh.provengo.io/internal/setup"
+	"ganesh.provengo.io/pkg/codec"
+	localLogging "ganesh.provengo.io/pkg/logging"
+	localMetrics "ganesh.provengo.io/pkg/metrics"
+	"ganesh.provengo.io/pkg/schema"
+	localTracing "ganesh.provengo.io/pkg/tracing"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrUnavailable is returned when no pooled connection can reach the broker.
+// Callers should report it as a temporary failure.
+var ErrUnavailable = errors.New("nats broker unavailable")
+
+// Ack describes a published message. Stream and Sequence are only set when
+// the publish was acknowledged by JetStream.
+type Ack struct {
+	MessageID string `json:"message_id"`
+	Subject   string `json:"subject"`
+	Stream    string `json:"stream,omitempty"`
+	Sequence  uint64 `json:"sequence,omitempty"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+}
+
+type conn struct {
+	nc *nats.Conn
+	js jetstream.JetStream
+}
+
+// Publisher spreads publishes over a pool of NATS connections. Connections
+// reconnect forever in the background, so the publisher can be created while
+// the broker is down and starts working as soon as it is back.
+type Publisher struct {
+	cfg       localSetup.NatsPublisher
+	codec     codec.Codec
+	component string
+	conns     []conn
+	next      uint32
+	logger    *slog.Logger
+}
+
+func New(cfg localSetup.Nats, component string) (*Publisher, error) {
+	encoder, err := codec.ByName(cfg.Publisher.Codec)
+	if err != nil {
+		return nil, err
+	}
+	p := &Publisher{
+		cfg:       cfg.Publisher,
+		codec:     encoder,
+		component: component,
+		logger:    localLogging.Component("publisher"),
+	}
+
+	for i := 0; i < cfg.Publisher.Connections; i++ {
+		logger := p.logger.With("connection", i)
+		nc, err := nats.Connect(cfg.URL,
+			nats.Name(fmt.Sprintf("ganesh-%s-publisher-%d", component, i)),
+			nats.RetryOnFailedConnect(true),
+			nats.MaxReconnects(-1),
+			nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+				logger.Warn("NATS publisher disconnected", "error", err)
+			}),
+			nats.ReconnectHandler(func(nc *nats.Conn) {
+				logger.Info("NATS publisher reconnected", "url", nc.ConnectedUrlRedacted())
+			}),
+		)
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("error connecting to NATS: %w", err)
+		}
+
+		c := conn{nc: nc}
+		if cfg.Publisher.JetStream {
+			if c.js, err = jetstream.New(nc); err != nil {
+				nc.Close()
+				p.Close()
+				return nil, fmt.Errorf("error creating jetstream context: %w", err)
+			}
+		}
+		p.conns = append(p.conns, c)
+	}
+	return p, nil
+}
+
+// pick returns the next connected connection of the pool, round robin.
+func (p *Publisher) pick() (conn, bool) {
+	start := atomic.AddUint32(&p.next, 1)
+	for i := 0; i < len(p.conns); i++ {
+		c := p.conns[(int(start)+i)%len(p.conns)]
+		if c.nc.IsConnected() {
+			return c, true
+		}
+	}
+	return conn{}, false
+}
+
+// Connected reports whether at least one connection reaches the broker.
+func (p *Publisher) Connected() bool {
+	_, ok := p.pick()
+	return ok
+}
+
+// Ping round-trips to the broker on one of the pooled connections.
+func (p *Publisher) Ping(ctx context.Context) error {
+	c, ok := p.pick()
+	if !ok {
+		return ErrUnavailable
+	}
+	if _, has := ctx.Deadline(); !has {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.cfg.AckTimeout.Duration)
+		defer cancel()
+	}
+	return c.nc.FlushWithContext(ctx)
+}
+
+// Publish sends data to subject with a new message ID, which JetStream also
+// uses to drop duplicated publishes. The trace context of ctx is propagated
+// in the message headers.
+func (p *Publisher) Publish(ctx context.Context, subject string, data []byte) (Ack, error) {
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	return p.PublishMsg(ctx, msg)
+}
+
+// NewMsg returns a message to subject holding v, encoded by the codec of
+// nats.publisher.codec, with the schema of v in its headers.
+func (p *Publisher) NewMsg(subject string, v any) (*nats.Msg, error) {
+	msg, err := codec.NewMsg(p.codec, subject, v)
+	if err != nil {
+		return nil, err
+	}
+	schema.Stamp(msg.Header, v)
+	return msg, nil
+}
+
+// PublishMsg sends msg, with a new message ID unless it already has one.
+func (p *Publisher) PublishMsg(ctx context.Context, msg *nats.Msg) (Ack, error) {
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	if msg.Header.Get(jetstream.MsgIDHeader) == "" {
+		msg.Header.Set(jetstream.MsgIDHeader, nuid.Next())
+	}
+	ack := Ack{MessageID: msg.Header.Get(jetstream.MsgIDHeader), Subject: msg.Subject}
+
+	ctx, span := localTracing.StartPublish(ctx, msg)
+	start := time.Now()
+	err := p.publish(ctx, msg, &ack)
+	localTracing.End(span, err)
+	if err != nil {
+		localMetrics.MessagesFailed.WithLabelValues(p.component, "publish").Inc()
+		return ack, err
+	}
+	localMetrics.PublishLatency.WithLabelValues(p.component).Observe(time.Since(start).Seconds())
+	localMetrics.MessagesPublished.WithLabelValues(p.component).Inc()
+	return ack, nil
+}
+
+func (p *Publisher) publish(ctx context.Context, msg *nats.Msg, ack *Ack) error {
+	c, ok := p.pick()
+	if !ok {
+		return ErrUnavailable
+	}
+
+	if c.js == nil {
+		if err := c.nc.PublishMsg(msg); err != nil {
+			return fmt.Errorf("%w: %v", ErrUnavailable, err)
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.AckTimeout.Duration)
+	defer cancel()
+	pubAck, err := c.js.PublishMsg(ctx, msg)
+	if err != nil {
+		// No stream listening on the subject is a broker side problem too,
+		// the message was not persisted and the client should retry.
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	ack.Stream = pubAck.Stream
+	ack.Sequence = pubAck.Sequence
+	ack.Duplicate = pubAck.Duplicate
+	return nil
+}
+
+// Result is the outcome of one message of PublishMany.
+type Result struct {
+	Ack Ack
+	Err error
+}
+
+// PublishMany publishes msgs on a single connection and waits until the
+// broker has them all: a flush for core NATS, every ack for JetStream. Each
+// message gets a message ID unless it already has one.
+func (p *Publisher) PublishMany(ctx context.Context, msgs []*nats.Msg) []Result {
+	results := make([]Result, len(msgs))
+	spans := make([]trace.Span, len(msgs))
+	for i, msg := range msgs {
+		if msg.Header == nil {
+			msg.Header = nats.Header{}
+		}
+		if msg.Header.Get(jetstream.MsgIDHeader) == "" {
+			msg.Header.Set(jetstream.MsgIDHeader, nuid.Next())
+		}
+		results[i].Ack = Ack{MessageID: msg.Header.Get(jetstream.MsgIDHeader), Subject: msg.Subject}
+		_, spans[i] = localTracing.StartPublish(ctx, msg)
+	}
+
+	start := time.Now()
+	p.publishMany(ctx, msgs, results)
+	elapsed := time.Since(start)
+
+	for i := range results {
+		localTracing.End(spans[i], results[i].Err)
+		if results[i].Err != nil {
+			localMetrics.MessagesFailed.WithLabelValues(p.component, "publish").Inc()
+			continue
+		}
+		localMetrics.MessagesPublished.WithLabelValues(p.component).Inc()
+	}
+	if len(msgs) > 0 {
+		localMetrics.PublishLatency.WithLabelValues(p.component).Observe(elapsed.Seconds() / float64(len(msgs)))
+	}
+	return results
+}
+
+func (p *Publisher) publishMany(ctx context.Context, msgs []*nats.Msg, results []Result) {
+	fail := func(from int, err error) {
+		for i := from; i < len(results); i++ {
+			if results[i].Err == nil {
+				results[i].Err = err
+			}
+		}
+	}
+
+	c, ok := p.pick()
+	if !ok {
+		fail(0, ErrUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.AckTimeout.Duration)
+	defer cancel()
+
+	if c.js == nil {
+		for i, msg := range msgs {
+			if err := c.nc.PublishMsg(msg); err != nil {
+				fail(i, fmt.Errorf("%w: %v", ErrUnavailable, err))
+				return
+			}
+		}
+		if err := c.nc.FlushWithContext(ctx); err != nil {
+			fail(0, fmt.Errorf("%w: %v", ErrUnavailable, err))
+		}
+		return
+	}
+
+	futures := make([]jetstream.PubAckFuture, len(msgs))
+	for i, msg := range msgs {
+		future, err := c.js.PublishMsgAsync(msg)
+		if err != nil {
+			results[i].Err = fmt.Errorf("%w: %v", ErrUnavailable, err)
+			continue
+		}
+		futures[i] = future
+	}
+
+	for i, future := range futures {
+		if future == nil {
+			continue
+		}
+		select {
+		case pubAck := <-future.Ok():
+			results[i].Ack.Stream = pubAck.Stream
+			results[i].Ack.Sequence = pubAck.Sequence
+			results[i].Ack.Duplicate = pubAck.Duplicate
+		case err := <-future.Err():
+			results[i].Err = fmt.Errorf("%w: %v", ErrUnavailable, err)
+		case <-ctx.Done():
+			results[i].Err = fmt.Errorf("%w: %v", ErrUnavailable, ctx.Err())
+		}
+	}
+}
+
+// Close flushes and closes every connection of the pool.
+func (p *Publisher) Close() {
+	for _, c := range p.conns {
+		if c.nc.IsConnected() {
+			if err := c.nc.FlushTimeout(time.Second); err != nil {
+				p.logger.Warn("error flushing NATS publisher", "error", err)
+			}
+		}
+		c.nc.Close()
+	}
+}
@@ -2,20 +2,27 @@ package db_redis
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	localSetup "ganesh.provengo.io/internal/setup"
 	"github.com/redis/go-redis/v9"
+	"log/slog"
 	"sync"
 	"time"
 )
 
 var (
-	rdInstance *redis.Client
-	rdOnce     sync.Once
+	rdInstance  *redis.Client
+	rdPipelines chan struct{}
+	rdChunkSize int
+	rdMu        sync.Mutex
 )
 
 type RedisService struct {
-	client *redis.Client
-	ctx    context.Context
+	client    *redis.Client
+	ctx       context.Context
+	pipelines chan struct{}
+	chunkSize int
 }
 
 type RedisData struct {
@@ -25,35 +32,55 @@ type RedisData struct {
 }
 
 func init() {
-	msg := fmt.Sprintf("init redis client %v", time.Now())
-	fmt.Println(msg)
+	slog.Debug("init redis client", "at", time.Now())
 }
 
-func RedisConnection(ctx context.Context) (*RedisService, error) {
+// RedisConnection returns a service on the shared client, creating it on
+// first use. A failed attempt is not cached, the next call tries again.
+func RedisConnection(ctx context.Context, cfg localSetup.Redis) (*RedisService, error) {
+	rdMu.Lock()
+	defer rdMu.Unlock()
 
-	rdOnce.Do(func() {
-		client := redis.NewClient(&redis.Options{
-			Addr:           "localhost:6379",
-			Password:       "",
-			DB:             0,
-			PoolSize:       16,
-			MinIdleConns:   8,
-			MaxActiveConns: 16,
-		})
+	if rdInstance == nil {
+		options, err := redis.ParseURL(cfg.URL)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing redis url: %w", err)
+		}
+		options.PoolSize = cfg.PoolSize
+		options.MinIdleConns = cfg.MinIdleConns
+		options.MaxActiveConns = cfg.PoolSize
 
-		err := client.Ping(ctx).Err()
+		client := redis.NewClient(options)
+
+		err = client.Ping(ctx).Err()
 		if err != nil {
-			return
+			_ = client.Close()
+			return nil, fmt.Errorf("error pinging redis: %w", err)
 		}
 		rdInstance = client
-	})
+		rdPipelines = make(chan struct{}, cfg.MaxPipelines)
+		rdChunkSize = cfg.PipelineSize
+	}
 
 	return &RedisService{
-		client: rdInstance,
-		ctx:    ctx,
+		client:    rdInstance,
+		ctx:       ctx,
+		pipelines: rdPipelines,
+		chunkSize: rdChunkSize,
 	}, nil
 }
 
+// CloseConnection closes the shared client when it was created, without
+// dialing one. The next RedisConnection creates a new client.
+func CloseConnection() {
+	rdMu.Lock()
+	defer rdMu.Unlock()
+	if rdInstance != nil {
+		_ = rdInstance.Close()
+		rdInstance = nil
+	}
+}
+
 func (r *RedisService) Close() {
 	_ = r.client.Close().Error()
 }
@@ -74,6 +101,21 @@ func (r *RedisService) Set(ctx context.Context, data RedisData) error {
 	return nil
 }
 
+// SetNX stores data only when the key does not exist yet and reports
+// whether it did.
+func (r *RedisService) SetNX(ctx context.Context, data RedisData) (bool, error) {
+	stored, err := r.client.SetNX(ctx, data.Key, data.Value, data.TTL).Result()
+	if err != nil {
+		return false, fmt.Errorf("redis setnx err: %v", err)
+	}
+	return stored, nil
+}
+
+// IsMissing reports whether err comes from reading a key that does not exist.
+func IsMissing(err error) bool {
+	return errors.Is(err, redis.Nil)
+}
+
 func (r *RedisService) Del(ctx context.Context, data RedisData) error {
 	err := r.client.Del(ctx, data.Key).Err()
 	if err != nil {
@@ -85,7 +127,7 @@ func (r *RedisService) Del(ctx context.Context, data RedisData) error {
 func (r *RedisService) Get(ctx context.Context, data RedisData) (string, error) {
 	val, err := r.client.Get(ctx, data.Key).Result()
 	if err != nil {
-		return "", fmt.Errorf("redis get err: %v", err)
+		return "", fmt.Errorf("redis get err: %w", err)
 	}
 
 	return val, nil
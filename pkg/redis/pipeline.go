@@ -0,0 +1,102 @@
+package db_redis
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"sync"
+)
+
+// The *Many methods split their input in pipelines of at most chunkSize
+// commands. At most cap(pipelines) pipelines run at the same time across
+// every RedisService, the returned errors are aligned with the input.
+
+func (r *RedisService) pipelined(ctx context.Context, total int, queue func(pipe redis.Pipeliner, i int) redis.Cmder, result func(i int, cmd redis.Cmder)) []error {
+	errs := make([]error, total)
+	chunkSize := r.chunkSize
+	if chunkSize < 1 {
+		chunkSize = total
+	}
+
+	var wg sync.WaitGroup
+	for start := 0; start < total; start += chunkSize {
+		end := start + chunkSize
+		if end > total {
+			end = total
+		}
+
+		select {
+		case r.pipelines <- struct{}{}:
+		case <-ctx.Done():
+			for i := start; i < total; i++ {
+				errs[i] = ctx.Err()
+			}
+			wg.Wait()
+			return errs
+		}
+
+		wg.Add(1)
+		go func(start int, end int) {
+			defer func() {
+				<-r.pipelines
+				wg.Done()
+			}()
+
+			pipe := r.client.Pipeline()
+			cmds := make([]redis.Cmder, 0, end-start)
+			for i := start; i < end; i++ {
+				cmds = append(cmds, queue(pipe, i))
+			}
+
+			_, err := pipe.Exec(ctx)
+			for n, cmd := range cmds {
+				if cmd.Err() != nil {
+					errs[start+n] = cmd.Err()
+					continue
+				}
+				if err != nil && err != redis.Nil {
+					errs[start+n] = err
+					continue
+				}
+				if result != nil {
+					result(start+n, cmd)
+				}
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	return errs
+}
+
+func (r *RedisService) SetMany(ctx context.Context, data []RedisData) []error {
+	errs := r.pipelined(ctx, len(data), func(pipe redis.Pipeliner, i int) redis.Cmder {
+		return pipe.Set(ctx, data[i].Key, data[i].Value, data[i].TTL)
+	}, nil)
+	return wrapErrors(errs, "redis set err")
+}
+
+func (r *RedisService) GetMany(ctx context.Context, data []RedisData) ([]string, []error) {
+	values := make([]string, len(data))
+	errs := r.pipelined(ctx, len(data), func(pipe redis.Pipeliner, i int) redis.Cmder {
+		return pipe.Get(ctx, data[i].Key)
+	}, func(i int, cmd redis.Cmder) {
+		values[i] = cmd.(*redis.StringCmd).Val()
+	})
+	return values, wrapErrors(errs, "redis get err")
+}
+
+func (r *RedisService) DelMany(ctx context.Context, data []RedisData) []error {
+	errs := r.pipelined(ctx, len(data), func(pipe redis.Pipeliner, i int) redis.Cmder {
+		return pipe.Del(ctx, data[i].Key)
+	}, nil)
+	return wrapErrors(errs, "redis del err")
+}
+
+func wrapErrors(errs []error, prefix string) []error {
+	for i, err := range errs {
+		if err != nil {
+			errs[i] = fmt.Errorf("%s: %w", prefix, err)
+		}
+	}
+	return errs
+}
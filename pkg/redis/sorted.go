@@ -0,0 +1,59 @@
+package db_redis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ScoredMember is a member of a sorted set with its score.
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+func (r *RedisService) ZAdd(ctx context.Context, key string, member string, score float64) error {
+	err := r.client.ZAdd(ctx, key, redis.Z{Score: score, Member: member}).Err()
+	if err != nil {
+		return fmt.Errorf("redis zadd err: %v", err)
+	}
+	return nil
+}
+
+// ZRangeByScore returns the members scored within [min, max], lowest first.
+func (r *RedisService) ZRangeByScore(ctx context.Context, key string, min float64, max float64) ([]ScoredMember, error) {
+	values, err := r.client.ZRangeByScoreWithScores(ctx, key, &redis.ZRangeBy{
+		Min: strconv.FormatFloat(min, 'f', -1, 64),
+		Max: strconv.FormatFloat(max, 'f', -1, 64),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis zrangebyscore err: %v", err)
+	}
+	members := make([]ScoredMember, len(values))
+	for i, value := range values {
+		members[i] = ScoredMember{Member: fmt.Sprint(value.Member), Score: value.Score}
+	}
+	return members, nil
+}
+
+func (r *RedisService) ZScore(ctx context.Context, key string, member string) (float64, error) {
+	score, err := r.client.ZScore(ctx, key, member).Result()
+	if err != nil {
+		return 0, fmt.Errorf("redis zscore err: %w", err)
+	}
+	return score, nil
+}
+
+// ZRemRangeByScore removes the members scored within [min, max].
+func (r *RedisService) ZRemRangeByScore(ctx context.Context, key string, min float64, max float64) error {
+	err := r.client.ZRemRangeByScore(ctx, key,
+		strconv.FormatFloat(min, 'f', -1, 64),
+		strconv.FormatFloat(max, 'f', -1, 64),
+	).Err()
+	if err != nil {
+		return fmt.Errorf("redis zremrangebyscore err: %v", err)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package keepalive
 
 import (
+	"ganesh.provengo.io/pkg/http/signing"
 	"github.com/gin-gonic/gin"
 	"time"
 )
@@ -11,6 +12,7 @@ type KeepAlive struct {
 	ClientProtocol   string `json:"client_protocol"`
 	ClientVersion    string `json:"client_version"`
 	ClientID         string `json:"client_id"`
+	ClientUserAgent  string `json:"client_user_agent"`
 	Timestamp        int64  `json:"timestamp"`
 	HeaderID         string `json:"header_id"`
 	RequestID        string `json:"request_id"`
@@ -18,9 +20,16 @@ type KeepAlive struct {
 
 func GetKeepAlive(c *gin.Context) KeepAlive {
 	RequestID := c.Param("id")
+	// Signed requests are identified by their verified client ID, the
+	// others by the ID in the path.
+	ClientID := c.GetString(signing.ClientIDKey)
+	if ClientID == "" {
+		ClientID = RequestID
+	}
 	return KeepAlive{
 		ClientIP:         c.ClientIP(),
-		ClientID:         c.GetHeader("User-Agent"),
+		ClientID:         ClientID,
+		ClientUserAgent:  c.GetHeader("User-Agent"),
 		Timestamp:        time.Now().UnixMilli(),
 		ClientProtocol:   "HTTP/1.1",
 		ClientVersion:    c.Request.Proto,
@@ -0,0 +1,181 @@
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"ganesh.provengo.io/pkg/codec"
+	"github.com/nats-io/nats.go"
+)
+
+// The envelope of a message is its headers: Content-Type names the codec,
+// these two the schema and version of the payload. A message without them
+// is version 1 of the schema the consumer expects, the layout published
+// before versioning.
+const (
+	HeaderName    = "Ganesh-Schema"
+	HeaderVersion = "Ganesh-Schema-Version"
+)
+
+var (
+	ErrUnknownSchema  = errors.New("unknown schema")
+	ErrUnknownVersion = errors.New("unknown schema version")
+	// ErrInvalid wraps the validation errors of a message.
+	ErrInvalid = errors.New("invalid message")
+)
+
+// Versioned is implemented by the payloads that carry a schema, Stamp writes
+// it in the envelope.
+type Versioned interface {
+	Schema() (name string, version int)
+}
+
+// Stamp sets the schema headers of v, when it is Versioned.
+func Stamp(header nats.Header, v any) {
+	if versioned, ok := v.(Versioned); ok {
+		name, version := versioned.Schema()
+		header.Set(HeaderName, name)
+		header.Set(HeaderVersion, strconv.Itoa(version))
+	}
+}
+
+type version struct {
+	decode func(header nats.Header, data []byte) (any, error)
+	// upcast turns a decoded value into the value of the next version.
+	upcast func(v any) (any, error)
+}
+
+// Schema decodes every known version of a message into T, its current
+// version, and validates the result.
+type Schema[T any] struct {
+	name     string
+	current  int
+	validate func(T) error
+	versions map[int]version
+}
+
+// New returns the schema name whose current version is current, decoded
+// into T. validate may be nil.
+func New[T any](name string, current int, validate func(T) error) *Schema[T] {
+	s := &Schema[T]{name: name, current: current, validate: validate, versions: map[int]version{}}
+	s.versions[current] = version{decode: decodeInto[T]}
+	return s
+}
+
+// Older registers the version number of s, decoded into V and upcast to the
+// type of version number+1.
+func Older[T, V any](s *Schema[T], number int, upcast func(V) (any, error)) {
+	s.versions[number] = version{
+		decode: decodeInto[V],
+		upcast: func(v any) (any, error) { return upcast(v.(V)) },
+	}
+}
+
+func decodeInto[V any](header nats.Header, data []byte) (any, error) {
+	var v V
+	err := codec.Decode(header, data, &v)
+	return v, err
+}
+
+func (s *Schema[T]) Name() string { return s.name }
+func (s *Schema[T]) Current() int { return s.current }
+
+// Versions returns the versions s decodes, oldest first.
+func (s *Schema[T]) Versions() []int {
+	versions := make([]int, 0, len(s.versions))
+	for v := range s.versions {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+// Version returns the version named by the envelope.
+func (s *Schema[T]) Version(header nats.Header) (int, error) {
+	name, number := header.Get(HeaderName), header.Get(HeaderVersion)
+	if name == "" && number == "" {
+		return 1, nil
+	}
+	if name != "" && name != s.name {
+		return 0, fmt.Errorf("%w %q, expected %q", ErrUnknownSchema, name, s.name)
+	}
+	version, err := strconv.Atoi(number)
+	if err != nil {
+		return 0, fmt.Errorf("%w %q of %s", ErrUnknownVersion, number, s.name)
+	}
+	return version, nil
+}
+
+// Decode decodes data with the codec and version of the envelope, upcasts it
+// version by version to the current one and validates it. It returns the
+// version the message was published with. Validation errors wrap
+// ErrInvalid.
+func (s *Schema[T]) Decode(header nats.Header, data []byte) (T, int, error) {
+	var zero T
+	number, err := s.Version(header)
+	if err != nil {
+		return zero, 0, err
+	}
+	v, ok := s.versions[number]
+	if !ok {
+		return zero, number, fmt.Errorf("%w %d of %s", ErrUnknownVersion, number, s.name)
+	}
+	value, err := v.decode(header, data)
+	if err != nil {
+		return zero, number, err
+	}
+	for n := number; n < s.current; n++ {
+		next := s.versions[n]
+		if next.upcast == nil {
+			return zero, number, fmt.Errorf("%w %d of %s, no upcast to %d", ErrUnknownVersion, n, s.name, n+1)
+		}
+		if value, err = next.upcast(value); err != nil {
+			return zero, number, fmt.Errorf("%w: upcasting %s from version %d: %w", ErrInvalid, s.name, n, err)
+		}
+	}
+
+	result, ok := value.(T)
+	if !ok {
+		return zero, number, fmt.Errorf("upcast of %s version %d returned %T", s.name, number, value)
+	}
+	if s.validate != nil {
+		if err := s.validate(result); err != nil {
+			return zero, number, fmt.Errorf("%w: %w", ErrInvalid, err)
+		}
+	}
+	return result, number, nil
+}
+
+// Descriptor describes a schema whatever its Go type.
+type Descriptor interface {
+	Name() string
+	Current() int
+	Versions() []int
+}
+
+var (
+	mu       sync.RWMutex
+	registry = map[string]Descriptor{}
+)
+
+// Register makes s known by its name, replacing a schema registered before.
+func Register(s Descriptor) {
+	mu.Lock()
+	defer mu.Unlock()
+	registry[s.Name()] = s
+}
+
+// Registered returns the registered schemas sorted by name.
+func Registered() []Descriptor {
+	mu.RLock()
+	defer mu.RUnlock()
+	all := make([]Descriptor, 0, len(registry))
+	for _, s := range registry {
+		all = append(all, s)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name() < all[j].Name() })
+	return all
+}
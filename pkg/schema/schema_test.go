@@ -0,0 +1,175 @@
+package schema_test
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	localStructs "ganesh.provengo.io/internal/structs"
+	"ganesh.provengo.io/pkg/codec"
+	"ganesh.provengo.io/pkg/schema"
+	"github.com/nats-io/nats.go"
+)
+
+const canonical = "6f1c5a3e-2b7d-4c1e-9a8f-0d3b5e7c9a21"
+
+var valid = localStructs.DataLogin{
+	Username:  "nicolas",
+	Password:  "XkLmPqRsTuVw",
+	UUID:      canonical,
+	Timestamp: 1700000000000,
+	Sequence:  1,
+}
+
+// encode returns the envelope and payload of v with c, stamped with the
+// schema headers when stamp is set.
+func encode(t *testing.T, c codec.Codec, v localStructs.DataLogin, stamp bool) (nats.Header, []byte) {
+	t.Helper()
+	msg, err := codec.NewMsg(c, "subject", v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stamp {
+		schema.Stamp(msg.Header, v)
+	}
+	return msg.Header, msg.Data
+}
+
+func TestDecodeHeaderlessV1(t *testing.T) {
+	old := valid
+	old.UUID = "{" + strings.ToUpper(canonical) + "}"
+	for _, c := range []codec.Codec{codec.JSON, codec.MsgPack, codec.CBOR, codec.Protobuf} {
+		header, data := encode(t, c, old, false)
+		got, version, err := localStructs.DataLoginSchema.Decode(header, data)
+		if err != nil {
+			t.Fatalf("%s: %v", c.Name(), err)
+		}
+		if version != 1 || got != valid {
+			t.Errorf("%s: got version %d, %+v; want 1, %+v", c.Name(), version, got, valid)
+		}
+	}
+}
+
+func TestDecodeCurrent(t *testing.T) {
+	header, data := encode(t, codec.JSON, valid, true)
+	if header.Get(schema.HeaderName) != "datalogin" || header.Get(schema.HeaderVersion) != strconv.Itoa(localStructs.DataLoginVersion) {
+		t.Fatalf("stamped headers %v", header)
+	}
+	got, version, err := localStructs.DataLoginSchema.Decode(header, data)
+	if err != nil || version != localStructs.DataLoginVersion || got != valid {
+		t.Fatalf("got version %d, %+v, %v", version, got, err)
+	}
+}
+
+func TestDecodeRejectsUnknownEnvelope(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		version string
+		want    error
+	}{
+		{"newer version", "datalogin", "3", schema.ErrUnknownVersion},
+		{"version 0", "datalogin", "0", schema.ErrUnknownVersion},
+		{"not a number", "datalogin", "two", schema.ErrUnknownVersion},
+		{"name without version", "datalogin", "", schema.ErrUnknownVersion},
+		{"other schema", "invoice", "1", schema.ErrUnknownSchema},
+	}
+	_, data := encode(t, codec.JSON, valid, false)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := nats.Header{}
+			header.Set(schema.HeaderName, tt.schema)
+			header.Set(schema.HeaderVersion, tt.version)
+			if _, _, err := localStructs.DataLoginSchema.Decode(header, data); !errors.Is(err, tt.want) {
+				t.Errorf("Decode() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeRejectsInvalidRecords(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(d *localStructs.DataLogin)
+		stamp  bool
+		reason string
+	}{
+		{"uppercase uuid in current version", func(d *localStructs.DataLogin) { d.UUID = strings.ToUpper(canonical) }, true, "canonical"},
+		{"braced uuid in current version", func(d *localStructs.DataLogin) { d.UUID = "{" + canonical + "}" }, true, "canonical"},
+		{"not a uuid in v1", func(d *localStructs.DataLogin) { d.UUID = "teste" }, false, "canonical"},
+		{"missing uuid", func(d *localStructs.DataLogin) { d.UUID = "" }, true, "uuid: required"},
+		{"missing sequence", func(d *localStructs.DataLogin) { d.Sequence = 0 }, true, "sequence: required"},
+		{"negative sequence", func(d *localStructs.DataLogin) { d.Sequence = -4 }, true, "sequence: negative"},
+		{"negative timestamp", func(d *localStructs.DataLogin) { d.Timestamp = -1 }, false, "timestamp: negative"},
+		{"missing username and password", func(d *localStructs.DataLogin) { d.Username, d.Password = "", "" }, true, "username: required, password: required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := valid
+			tt.change(&record)
+			header, data := encode(t, codec.JSON, record, tt.stamp)
+			_, _, err := localStructs.DataLoginSchema.Decode(header, data)
+			if !errors.Is(err, schema.ErrInvalid) || !strings.Contains(err.Error(), tt.reason) {
+				t.Fatalf("Decode() = %v, want ErrInvalid about %q", err, tt.reason)
+			}
+			if strings.Contains(err.Error(), "\n") {
+				t.Errorf("multi-line error %q does not fit a header", err)
+			}
+		})
+	}
+}
+
+func TestDecodeRejectsUndecodablePayload(t *testing.T) {
+	header, _ := encode(t, codec.JSON, valid, true)
+	_, _, err := localStructs.DataLoginSchema.Decode(header, []byte("{"))
+	if err == nil || errors.Is(err, schema.ErrInvalid) {
+		t.Fatalf("Decode() = %v, want a decode error", err)
+	}
+}
+
+// A three version chain, each upcast running in turn.
+type (
+	pointV1 struct{ X int }
+	pointV2 struct{ X, Y int }
+	point   struct{ X, Y, Z int }
+)
+
+func TestUpcastChain(t *testing.T) {
+	s := schema.New("point", 3, func(p point) error {
+		if p.X < 0 {
+			return errors.New("x: negative")
+		}
+		return nil
+	})
+	schema.Older(s, 1, func(v pointV1) (any, error) {
+		if v.X > 100 {
+			return nil, errors.New("x: out of range")
+		}
+		return pointV2{X: v.X, Y: 2}, nil
+	})
+	schema.Older(s, 2, func(v pointV2) (any, error) { return point{X: v.X, Y: v.Y, Z: 3}, nil })
+
+	if got := s.Versions(); len(got) != 3 || got[0] != 1 || got[2] != 3 {
+		t.Fatalf("Versions() = %v", got)
+	}
+	got, version, err := s.Decode(nats.Header{}, []byte(`{"X":1}`))
+	if err != nil || version != 1 || got != (point{1, 2, 3}) {
+		t.Fatalf("v1: got %+v, version %d, %v", got, version, err)
+	}
+	if _, _, err := s.Decode(nats.Header{}, []byte(`{"X":101}`)); !errors.Is(err, schema.ErrInvalid) {
+		t.Errorf("failed upcast: %v, want ErrInvalid", err)
+	}
+	if _, _, err := s.Decode(nats.Header{}, []byte(`{"X":-1}`)); !errors.Is(err, schema.ErrInvalid) {
+		t.Errorf("invalid after upcast: %v, want ErrInvalid", err)
+	}
+}
+
+func TestRegistered(t *testing.T) {
+	for _, s := range schema.Registered() {
+		if s.Name() == "datalogin" && s.Current() == localStructs.DataLoginVersion {
+			return
+		}
+	}
+	t.Fatal("datalogin is not registered")
+}
@@ -17,6 +17,7 @@ type PostData struct {
 
 func main() {
 	runtime.GOMAXPROCS(4)
+	postgresURI := localSetup.Default().Postgres.URL
 	var wg sync.WaitGroup
 	var channel = make(chan PostData)
 	var total uint64
@@ -25,7 +26,7 @@ func main() {
 		wg.Add(1)
 		go func() {
 			for j := 0; j < 100000; j++ {
-				data, _ := localEncrypt.EncryptString(localSetup.PostgresURI, "5e5e83befe0b49fc5aa40b0a058a30b9")
+				data, _ := localEncrypt.EncryptString(postgresURI, "5e5e83befe0b49fc5aa40b0a058a30b9")
 
 				atomic.AddUint64(&total, 1)
 
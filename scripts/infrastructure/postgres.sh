@@ -16,5 +16,12 @@ CREATE TABLE users (
     password text,
     hash text
 );
+CREATE TABLE client_heartbeats (
+    client_id text PRIMARY KEY,
+    ip text,
+    user_agent text,
+    protocol text,
+    last_seen timestamptz NOT NULL
+);
 INSERT INTO tasks (description) VALUES ('Finish work'), ('Have fun');
 COMMENT
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"ganesh.provengo.io/pkg/partition"
+)
+
+// Checks the ordering mode of the consumer under concurrent load: producers
+// push the events of their keys in sequence into a partition.Queue, workers
+// process them with random delays and every key must see its sequences in
+// order. The same load through an unordered queue shows what ordering
+// prevents. Exits with 1 when the ordered queue reordered an event, or lost
+// one with a policy other than drop-oldest, whose evictions leave gaps.
+
+type event struct {
+	key      string
+	sequence int
+}
+
+type result struct {
+	processed  int
+	dropped    int
+	reordered  int
+	perWorker  []int
+	elapsed    time.Duration
+	firstError string
+}
+
+func run(ordered bool, policy partition.Policy, keys, events, partitions, producers, size int) result {
+	var key func(event) string
+	if ordered {
+		key = func(e event) string { return e.key }
+	}
+	var mu sync.Mutex
+	last := map[string]int{}
+	res := result{perWorker: make([]int, partitions)}
+	queue, err := partition.New(partition.Options[event]{
+		Partitions: partitions,
+		Size:       size,
+		Key:        key,
+		Policy:     policy,
+		OnDrop: func(event) {
+			mu.Lock()
+			res.dropped++
+			mu.Unlock()
+		},
+		Spill: partition.Spill[event]{
+			Dir:  os.TempDir(),
+			Name: "ganesh-ordering",
+			Detach: func(e event) ([]byte, event) {
+				return []byte(e.key + " " + strconv.Itoa(e.sequence)), event{}
+			},
+			Attach: func(data []byte, _ event) (event, error) {
+				var e event
+				_, err := fmt.Sscanf(string(data), "%s %d", &e.key, &e.sequence)
+				return e, err
+			},
+		},
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// Each key belongs to one producer, like a key arriving through the
+	// single intake of the consumer, the producers run concurrently.
+	var produced sync.WaitGroup
+	for p := range producers {
+		produced.Add(1)
+		go func() {
+			defer produced.Done()
+			random := rand.New(rand.NewSource(int64(p)))
+			next := map[string]int{}
+			var owned []string
+			for k := p; k < keys; k += producers {
+				name := "user-" + strconv.Itoa(k)
+				owned = append(owned, name)
+				next[name] = 1
+			}
+			for len(owned) > 0 {
+				i := random.Intn(len(owned))
+				name := owned[i]
+				queue.Push(event{key: name, sequence: next[name]})
+				if next[name]++; next[name] > events {
+					owned = append(owned[:i], owned[i+1:]...)
+				}
+			}
+		}()
+	}
+
+	var workers sync.WaitGroup
+	start := time.Now()
+	for w := range partitions {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			random := rand.New(rand.NewSource(int64(1000 + w)))
+			for e := range queue.Partition(w) {
+				if random.Intn(8) == 0 {
+					time.Sleep(time.Duration(random.Intn(200)) * time.Microsecond)
+				}
+				mu.Lock()
+				if e.sequence <= last[e.key] || (policy != partition.DropOldest && e.sequence != last[e.key]+1) {
+					res.reordered++
+					if res.firstError == "" {
+						res.firstError = fmt.Sprintf("%s: sequence %d after %d", e.key, e.sequence, last[e.key])
+					}
+				}
+				last[e.key] = max(last[e.key], e.sequence)
+				res.processed++
+				res.perWorker[w]++
+				mu.Unlock()
+			}
+		}()
+	}
+
+	produced.Wait()
+	queue.Close()
+	workers.Wait()
+	res.elapsed = time.Since(start)
+	return res
+}
+
+func main() {
+	keys := flag.Int("keys", 500, "distinct keys")
+	events := flag.Int("events", 200, "events per key")
+	partitions := flag.Int("partitions", 8, "partitions, one worker each")
+	producers := flag.Int("producers", 8, "concurrent producers")
+	size := flag.Int("size", 16, "buffer of each partition")
+	policy := flag.String("policy", string(partition.Block), "policy of full partitions: block, drop-oldest or spill-to-disk")
+	flag.Parse()
+
+	failed := false
+	for _, ordered := range []bool{true, false} {
+		res := run(ordered, partition.Policy(*policy), *keys, *events, *partitions, *producers, *size)
+		mode := "unordered"
+		if ordered {
+			mode = "ordered"
+		}
+		fmt.Printf("%-9s processed %d/%d in %v, dropped %d, reordered %d, per worker %v\n",
+			mode, res.processed, *keys**events, res.elapsed.Round(time.Millisecond), res.dropped, res.reordered, res.perWorker)
+		if res.firstError != "" {
+			fmt.Printf("%-9s first reordering: %s\n", "", res.firstError)
+		}
+		if ordered && (res.reordered > 0 || res.processed+res.dropped != *keys**events) {
+			failed = true
+		}
+	}
+	if failed {
+		fmt.Println("FAIL: the ordered queue lost or reordered events")
+		os.Exit(1)
+	}
+	fmt.Println("OK: every key was processed in order")
+}
@@ -0,0 +1,15 @@
+#!/bin/sh
+# Distributed load test on localhost: AGENTS agents and a coordinator against
+# the Gin server, which must be running with NATS (scripts/infrastructure/nats.sh).
+# Extra arguments go to the coordinator, e.g. -mode open -rate 20000 -workers 2000
+
+AGENTS=${AGENTS:-3}
+
+go build -o /tmp/ganesh-http-client ./cmd/http_client || exit 1
+
+for i in $(seq 1 "$AGENTS"); do
+	/tmp/ganesh-http-client -role agent -agent-id "agent-$i" &
+done
+trap 'kill $(jobs -p) 2>/dev/null' EXIT
+
+/tmp/ganesh-http-client -role coordinator -agents "$AGENTS" "$@"